@@ -0,0 +1,177 @@
+// Package admin serves profiling, metrics and runtime endpoints on a
+// listener separate from the proxy, so they are never exposed alongside the
+// public API by accident.
+package admin
+
+import (
+	"crypto/subtle"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+
+	"gemini-antiblock/handlers"
+	"gemini-antiblock/logger"
+)
+
+// Options configures the admin server.
+type Options struct {
+	// Addr is the host:port to listen on.
+	Addr string
+	// Token, if set, must be sent as "Authorization: Bearer <token>".
+	Token string
+	// TLSCertFile and TLSKeyFile enable HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// ClientCAFile, if set, requires clients to present a certificate signed
+	// by one of its CAs (mTLS). It needs TLSCertFile and TLSKeyFile.
+	ClientCAFile string
+}
+
+// Server is the admin HTTP server.
+type Server struct {
+	*http.Server
+	opts Options
+}
+
+// NewServer creates an admin server for the given session registry and
+// metrics handler. It does not start listening.
+func NewServer(opts Options, sessions *handlers.SessionRegistry, metricsHandler http.Handler) (*Server, error) {
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, errors.New("admin TLS needs both a certificate and a key")
+	}
+	if opts.ClientCAFile != "" && opts.TLSCertFile == "" {
+		return nil, errors.New("admin mTLS needs a TLS certificate and key")
+	}
+
+	server := &http.Server{
+		Addr:              opts.Addr,
+		Handler:           Handler(opts.Token, sessions, metricsHandler),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	if opts.ClientCAFile != "" {
+		pem, err := os.ReadFile(opts.ClientCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading admin client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", opts.ClientCAFile)
+		}
+		server.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			ClientCAs:  pool,
+			ClientAuth: tls.RequireAndVerifyClientCert,
+		}
+	}
+	return &Server{Server: server, opts: opts}, nil
+}
+
+// ListenAndServe starts the server, over TLS if a certificate is configured.
+// It warns when the listener is reachable beyond localhost without any
+// authentication.
+func (s *Server) ListenAndServe() error {
+	if s.opts.Token == "" && s.opts.ClientCAFile == "" && !isLoopback(s.opts.Addr) {
+		logger.LogWarn(fmt.Sprintf("Admin server on %s has no authentication; set ADMIN_TOKEN or ADMIN_CLIENT_CA", s.opts.Addr))
+	}
+	if s.opts.TLSCertFile != "" {
+		return s.Server.ListenAndServeTLS(s.opts.TLSCertFile, s.opts.TLSKeyFile)
+	}
+	return s.Server.ListenAndServe()
+}
+
+// isLoopback reports whether addr only listens on a loopback interface.
+func isLoopback(addr string) bool {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return false
+	}
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Handler returns the admin routes, behind bearer-token auth if token is
+// set:
+//
+//	GET  /metrics                     Prometheus metrics
+//	GET  /debug/pprof/...             runtime profiles
+//	GET  /admin/sessions              active streaming sessions
+//	GET  /admin/sessions/{id}         one session
+//	POST /admin/sessions/{id}/cancel  end a session with an error event
+func Handler(token string, sessions *handlers.SessionRegistry, metricsHandler http.Handler) http.Handler {
+	router := mux.NewRouter()
+
+	router.Handle("/metrics", metricsHandler).Methods("GET")
+
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+	router.PathPrefix("/debug/pprof/").HandlerFunc(pprof.Index)
+
+	router.HandleFunc("/admin/sessions", func(w http.ResponseWriter, r *http.Request) {
+		list := sessions.List()
+		writeJSON(w, http.StatusOK, map[string]interface{}{
+			"count":    len(list),
+			"sessions": list,
+		})
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/sessions/{id}", func(w http.ResponseWriter, r *http.Request) {
+		info, ok := sessions.Get(mux.Vars(r)["id"])
+		if !ok {
+			handlers.JSONError(w, http.StatusNotFound, "Session not found", nil)
+			return
+		}
+		writeJSON(w, http.StatusOK, info)
+	}).Methods("GET")
+
+	router.HandleFunc("/admin/sessions/{id}/cancel", func(w http.ResponseWriter, r *http.Request) {
+		id := mux.Vars(r)["id"]
+		if !sessions.Cancel(id) {
+			handlers.JSONError(w, http.StatusNotFound, "Session not found", nil)
+			return
+		}
+		logger.LogWarn(fmt.Sprintf("Admin cancelled session %s from %s", id, r.RemoteAddr))
+		writeJSON(w, http.StatusAccepted, map[string]interface{}{"id": id, "cancelled": true})
+	}).Methods("POST")
+
+	if token == "" {
+		return router
+	}
+	return requireToken(token, router)
+}
+
+// requireToken rejects requests without the bearer token, including ones
+// that send the token without the Bearer scheme.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="admin"`)
+			handlers.JSONError(w, http.StatusUnauthorized, "Missing or invalid admin token", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.LogError("Failed to encode admin response:", err)
+	}
+}
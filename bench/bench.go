@@ -0,0 +1,362 @@
+// Package bench load-tests the proxy in-process: N concurrent streaming
+// clients talk to a ProxyHandler, which talks to a synthetic upstream, and
+// latency, retries, allocations and goroutine counts are reported.
+package bench
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/handlers"
+)
+
+// Options configures a benchmark run.
+type Options struct {
+	// Clients is the number of concurrent streaming clients.
+	Clients int
+	// SessionsPerClient is the number of sequential sessions per client.
+	SessionsPerClient int
+	// Upstream shapes the synthetic upstream.
+	Upstream UpstreamOptions
+	// Config is the proxy configuration; its upstream URL is replaced with
+	// the synthetic upstream.
+	Config *config.Config
+}
+
+// Result is the JSON report of a run.
+type Result struct {
+	StartedAt       time.Time     `json:"started_at"`
+	DurationSeconds float64       `json:"duration_seconds"`
+	Parameters      Parameters    `json:"parameters"`
+	Sessions        SessionCounts `json:"sessions"`
+	Throughput      Throughput    `json:"throughput"`
+	TimeToFirstMs   Percentiles   `json:"time_to_first_token_ms"`
+	SessionMs       Percentiles   `json:"session_duration_ms"`
+	Retries         RetryStats    `json:"retries_per_session"`
+	Allocations     Allocations   `json:"allocations"`
+	Goroutines      Goroutines    `json:"goroutines"`
+}
+
+// Parameters echoes the options a run used.
+type Parameters struct {
+	Clients               int     `json:"clients"`
+	SessionsPerClient     int     `json:"sessions_per_client"`
+	Chunks                int     `json:"chunks"`
+	ChunkBytes            int     `json:"chunk_bytes"`
+	ChunkIntervalMs       float64 `json:"chunk_interval_ms"`
+	InterruptProbability  float64 `json:"interrupt_probability"`
+	MaxConsecutiveRetries int     `json:"max_consecutive_retries"`
+	RetryDelayMs          float64 `json:"retry_delay_ms"`
+}
+
+// SessionCounts counts how sessions ended.
+type SessionCounts struct {
+	Total     int `json:"total"`
+	Completed int `json:"completed"`
+	// ErrorEvents is the number of sessions that ended with an SSE error
+	// event, e.g. after exhausting retries.
+	ErrorEvents int `json:"error_events"`
+	// Failed is the number of requests that failed outright.
+	Failed int `json:"failed"`
+}
+
+// Throughput is measured over the whole run.
+type Throughput struct {
+	SessionsPerSecond float64 `json:"sessions_per_second"`
+	ChunksPerSecond   float64 `json:"chunks_per_second"`
+	BytesPerSecond    float64 `json:"bytes_per_second"`
+}
+
+// Percentiles summarizes a latency distribution in milliseconds.
+type Percentiles struct {
+	P50 float64 `json:"p50"`
+	P95 float64 `json:"p95"`
+	P99 float64 `json:"p99"`
+	Max float64 `json:"max"`
+}
+
+// RetryStats summarizes upstream retries per session.
+type RetryStats struct {
+	Mean             float64 `json:"mean"`
+	P95              float64 `json:"p95"`
+	Max              int     `json:"max"`
+	UpstreamRequests int     `json:"upstream_requests"`
+}
+
+// Allocations covers the whole process during the run, including the
+// synthetic upstream and the clients.
+type Allocations struct {
+	TotalBytes        uint64  `json:"total_bytes"`
+	Mallocs           uint64  `json:"mallocs"`
+	BytesPerSession   float64 `json:"bytes_per_session"`
+	MallocsPerSession float64 `json:"mallocs_per_session"`
+}
+
+// Goroutines reports goroutine counts before, during and after the run.
+// A gap between Before and After points at leaked goroutines.
+type Goroutines struct {
+	Before int `json:"before"`
+	Peak   int `json:"peak"`
+	After  int `json:"after"`
+}
+
+type sessionResult struct {
+	firstToken time.Duration
+	duration   time.Duration
+	chunks     int
+	bytes      int
+	completed  bool
+	errorEvent bool
+	err        error
+}
+
+// Run executes a benchmark.
+func Run(ctx context.Context, opts Options) (*Result, error) {
+	if opts.Clients < 1 || opts.SessionsPerClient < 1 {
+		return nil, fmt.Errorf("clients and sessions per client must be positive")
+	}
+
+	upstream := NewUpstream(opts.Upstream)
+	upstreamServer := httptest.NewServer(upstream)
+	defer upstreamServer.Close()
+
+	cfg := *opts.Config
+	cfg.UpstreamURLBase = upstreamServer.URL
+	cfg.EnableRateLimit = false
+	proxyHandler, err := handlers.NewProxyHandler(&cfg)
+	if err != nil {
+		return nil, err
+	}
+	proxyServer := httptest.NewServer(proxyHandler)
+	defer proxyServer.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		MaxIdleConns:        opts.Clients,
+		MaxIdleConnsPerHost: opts.Clients,
+	}}
+	defer client.CloseIdleConnections()
+
+	result := &Result{
+		StartedAt: time.Now().UTC(),
+		Parameters: Parameters{
+			Clients:               opts.Clients,
+			SessionsPerClient:     opts.SessionsPerClient,
+			Chunks:                upstream.opts.Chunks,
+			ChunkBytes:            upstream.opts.ChunkBytes,
+			ChunkIntervalMs:       float64(opts.Upstream.ChunkInterval) / float64(time.Millisecond),
+			InterruptProbability:  opts.Upstream.InterruptProbability,
+			MaxConsecutiveRetries: cfg.MaxConsecutiveRetries,
+			RetryDelayMs:          float64(cfg.RetryDelayMs) / float64(time.Millisecond),
+		},
+	}
+
+	runtime.GC()
+	var before runtime.MemStats
+	runtime.ReadMemStats(&before)
+	result.Goroutines.Before = runtime.NumGoroutine()
+
+	peakDone := make(chan struct{})
+	peakResult := make(chan int)
+	go func() {
+		peak := 0
+		ticker := time.NewTicker(10 * time.Millisecond)
+		defer ticker.Stop()
+		for {
+			if n := runtime.NumGoroutine(); n > peak {
+				peak = n
+			}
+			select {
+			case <-ticker.C:
+			case <-peakDone:
+				peakResult <- peak
+				return
+			}
+		}
+	}()
+
+	results := make([]sessionResult, opts.Clients*opts.SessionsPerClient)
+	url := proxyServer.URL + "/v1beta/models/bench-model:streamGenerateContent?alt=sse"
+	start := time.Now()
+
+	var wg sync.WaitGroup
+	for c := 0; c < opts.Clients; c++ {
+		wg.Add(1)
+		go func(c int) {
+			defer wg.Done()
+			for s := 0; s < opts.SessionsPerClient; s++ {
+				i := c*opts.SessionsPerClient + s
+				if ctx.Err() != nil {
+					results[i].err = ctx.Err()
+					continue
+				}
+				results[i] = runSession(ctx, client, url, fmt.Sprintf("bench-session-%d", i))
+			}
+		}(c)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	close(peakDone)
+	result.Goroutines.Peak = <-peakResult
+
+	var after runtime.MemStats
+	runtime.ReadMemStats(&after)
+
+	client.CloseIdleConnections()
+	proxyServer.CloseClientConnections()
+	upstreamServer.CloseClientConnections()
+	result.Goroutines.After = settledGoroutines(result.Goroutines.Before)
+
+	result.DurationSeconds = elapsed.Seconds()
+	summarize(result, results, upstream.Requests(), elapsed)
+
+	sessions := float64(len(results))
+	result.Allocations = Allocations{
+		TotalBytes:        after.TotalAlloc - before.TotalAlloc,
+		Mallocs:           after.Mallocs - before.Mallocs,
+		BytesPerSession:   float64(after.TotalAlloc-before.TotalAlloc) / sessions,
+		MallocsPerSession: float64(after.Mallocs-before.Mallocs) / sessions,
+	}
+	return result, ctx.Err()
+}
+
+// runSession streams one request and records what the client saw.
+func runSession(ctx context.Context, client *http.Client, url, id string) sessionResult {
+	body := fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":%q}]}]}`, id)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(body))
+	if err != nil {
+		return sessionResult{err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return sessionResult{err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return sessionResult{err: fmt.Errorf("status %d", resp.StatusCode)}
+	}
+
+	var r sessionResult
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 0, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.HasPrefix(line, "event: error"):
+			r.errorEvent = true
+		case strings.HasPrefix(line, "data: "):
+			if r.chunks == 0 {
+				r.firstToken = time.Since(start)
+			}
+			r.chunks++
+			r.bytes += len(line)
+			if strings.Contains(line, `"text": "[done]"`) {
+				r.completed = true
+			}
+		}
+	}
+	r.duration = time.Since(start)
+	r.err = scanner.Err()
+	return r
+}
+
+// settledGoroutines waits briefly for goroutines from the run to exit.
+func settledGoroutines(before int) int {
+	n := runtime.NumGoroutine()
+	for deadline := time.Now().Add(2 * time.Second); n > before && time.Now().Before(deadline); {
+		time.Sleep(50 * time.Millisecond)
+		n = runtime.NumGoroutine()
+	}
+	return n
+}
+
+func summarize(result *Result, results []sessionResult, requests map[string]int, elapsed time.Duration) {
+	var firstTokens, durations []float64
+	chunks, bytes := 0, 0
+	for _, r := range results {
+		result.Sessions.Total++
+		switch {
+		case r.err != nil:
+			result.Sessions.Failed++
+		case r.completed:
+			result.Sessions.Completed++
+		case r.errorEvent:
+			result.Sessions.ErrorEvents++
+		default:
+			result.Sessions.Failed++
+		}
+		if r.chunks > 0 {
+			firstTokens = append(firstTokens, float64(r.firstToken)/float64(time.Millisecond))
+		}
+		if r.err == nil {
+			durations = append(durations, float64(r.duration)/float64(time.Millisecond))
+		}
+		chunks += r.chunks
+		bytes += r.bytes
+	}
+
+	seconds := elapsed.Seconds()
+	result.Throughput = Throughput{
+		SessionsPerSecond: float64(result.Sessions.Completed) / seconds,
+		ChunksPerSecond:   float64(chunks) / seconds,
+		BytesPerSecond:    float64(bytes) / seconds,
+	}
+	result.TimeToFirstMs = percentiles(firstTokens)
+	result.SessionMs = percentiles(durations)
+
+	var retries []float64
+	total := 0
+	for _, n := range requests {
+		retries = append(retries, float64(n-1))
+		total += n
+		if n-1 > result.Retries.Max {
+			result.Retries.Max = n - 1
+		}
+	}
+	result.Retries.UpstreamRequests = total
+	if len(retries) > 0 {
+		result.Retries.Mean = float64(total-len(retries)) / float64(len(retries))
+		result.Retries.P95 = percentile(sortedCopy(retries), 95)
+	}
+}
+
+func percentiles(values []float64) Percentiles {
+	if len(values) == 0 {
+		return Percentiles{}
+	}
+	sorted := sortedCopy(values)
+	return Percentiles{
+		P50: percentile(sorted, 50),
+		P95: percentile(sorted, 95),
+		P99: percentile(sorted, 99),
+		Max: sorted[len(sorted)-1],
+	}
+}
+
+func sortedCopy(values []float64) []float64 {
+	sorted := append([]float64(nil), values...)
+	sort.Float64s(sorted)
+	return sorted
+}
+
+// percentile returns the nearest-rank percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	rank := int(math.Ceil(p / 100 * float64(len(sorted))))
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
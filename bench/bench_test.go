@@ -0,0 +1,54 @@
+package bench
+
+import (
+	"context"
+	"flag"
+	"io"
+	"os"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logger.Configure(logger.Options{Level: "error", Output: io.Discard})
+	}
+	os.Exit(m.Run())
+}
+
+func TestRun(t *testing.T) {
+	result, err := Run(context.Background(), Options{
+		Clients:           4,
+		SessionsPerClient: 3,
+		Upstream:          UpstreamOptions{Chunks: 10, ChunkBytes: 32, InterruptProbability: 0.3},
+		Config:            &config.Config{MaxConsecutiveRetries: 100},
+	})
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+
+	if result.Sessions.Total != 12 || result.Sessions.Completed != 12 {
+		t.Fatalf("sessions = %+v, want 12 completed", result.Sessions)
+	}
+	if result.Retries.UpstreamRequests < 12 {
+		t.Errorf("upstream requests = %d, want at least 12", result.Retries.UpstreamRequests)
+	}
+	if result.TimeToFirstMs.P50 <= 0 || result.TimeToFirstMs.P99 < result.TimeToFirstMs.P50 {
+		t.Errorf("time to first token = %+v", result.TimeToFirstMs)
+	}
+	if result.Allocations.Mallocs == 0 || result.Goroutines.Peak < result.Goroutines.Before {
+		t.Errorf("allocations = %+v, goroutines = %+v", result.Allocations, result.Goroutines)
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tt := range []struct{ p, want float64 }{{50, 5}, {95, 10}, {99, 10}, {10, 1}, {0, 1}} {
+		if got := percentile(sorted, tt.p); got != tt.want {
+			t.Errorf("percentile(%v) = %v, want %v", tt.p, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,129 @@
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// UpstreamOptions configures the synthetic Gemini upstream.
+type UpstreamOptions struct {
+	// Chunks is the number of text chunks in a complete response.
+	Chunks int `json:"chunks"`
+	// ChunkBytes is the size of each chunk's text.
+	ChunkBytes int `json:"chunk_bytes"`
+	// ChunkInterval is the pause between chunks; zero streams as fast as
+	// possible.
+	ChunkInterval time.Duration `json:"chunk_interval_ns"`
+	// InterruptProbability is the chance, from 0 to 1, that an attempt drops
+	// the connection at a random chunk instead of finishing.
+	InterruptProbability float64 `json:"interrupt_probability"`
+}
+
+// Upstream is an in-process stand-in for the Gemini streaming API. It
+// counts requests per session so retries can be attributed.
+type Upstream struct {
+	opts UpstreamOptions
+
+	mu       sync.Mutex
+	rng      *rand.Rand
+	requests map[string]int
+}
+
+// NewUpstream creates a synthetic upstream.
+func NewUpstream(opts UpstreamOptions) *Upstream {
+	if opts.Chunks < 1 {
+		opts.Chunks = 1
+	}
+	if opts.ChunkBytes < 1 {
+		opts.ChunkBytes = 1
+	}
+	return &Upstream{
+		opts:     opts,
+		rng:      rand.New(rand.NewSource(time.Now().UnixNano())),
+		requests: make(map[string]int),
+	}
+}
+
+// Requests returns the number of upstream requests made for each session.
+func (u *Upstream) Requests() map[string]int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	counts := make(map[string]int, len(u.requests))
+	for k, v := range u.requests {
+		counts[k] = v
+	}
+	return counts
+}
+
+// interruptAt decides where this attempt drops, or returns -1.
+func (u *Upstream) interruptAt() int {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	if u.rng.Float64() >= u.opts.InterruptProbability {
+		return -1
+	}
+	return u.rng.Intn(u.opts.Chunks)
+}
+
+// ServeHTTP implements http.Handler.
+func (u *Upstream) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	session := sessionID(body)
+	u.mu.Lock()
+	u.requests[session]++
+	u.mu.Unlock()
+
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	// Send the headers before any interruption, so drops are always
+	// mid-stream rather than failed requests.
+	flusher, _ := w.(http.Flusher)
+	if flusher != nil {
+		flusher.Flush()
+	}
+
+	text := strings.Repeat("x", u.opts.ChunkBytes)
+	interruptAt := u.interruptAt()
+	for i := 0; i < u.opts.Chunks; i++ {
+		if i == interruptAt {
+			panic(http.ErrAbortHandler)
+		}
+		if i == u.opts.Chunks-1 {
+			fmt.Fprintf(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"%s[done]\"}],\"role\":\"model\"},\"finishReason\":\"STOP\"}]}\n\n", text)
+		} else {
+			fmt.Fprintf(w, "data: {\"candidates\":[{\"content\":{\"parts\":[{\"text\":\"%s\"}],\"role\":\"model\"}}]}\n\n", text)
+		}
+		if flusher != nil {
+			flusher.Flush()
+		}
+		if u.opts.ChunkInterval > 0 {
+			select {
+			case <-time.After(u.opts.ChunkInterval):
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}
+}
+
+// sessionID extracts the session marker the bench client puts in the first
+// message, which the proxy keeps unchanged across retries.
+func sessionID(body []byte) string {
+	var request struct {
+		Contents []struct {
+			Parts []struct {
+				Text string `json:"text"`
+			} `json:"parts"`
+		} `json:"contents"`
+	}
+	if json.Unmarshal(body, &request) != nil || len(request.Contents) == 0 || len(request.Contents[0].Parts) == 0 {
+		return ""
+	}
+	return request.Contents[0].Parts[0].Text
+}
@@ -0,0 +1,298 @@
+package breaker
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+// ErrOpen is returned by Allow when the breaker is rejecting calls.
+var ErrOpen = errors.New("circuit breaker is open")
+
+// State is the state of a circuit breaker.
+type State int
+
+const (
+	// StateClosed lets every call through and tracks outcomes.
+	StateClosed State = iota
+	// StateOpen rejects every call until the cool-down has elapsed.
+	StateOpen
+	// StateHalfOpen lets a limited number of probe calls through.
+	StateHalfOpen
+)
+
+// String returns the lowercase name of the state.
+func (s State) String() string {
+	switch s {
+	case StateClosed:
+		return "closed"
+	case StateOpen:
+		return "open"
+	case StateHalfOpen:
+		return "half-open"
+	default:
+		return "unknown"
+	}
+}
+
+// Options configures a Breaker.
+type Options struct {
+	// Window is the length of the rolling window used to compute rates.
+	Window time.Duration
+	// MinRequests is the number of calls, for the error rate, or stream
+	// attempts, for the interruption rate, needed in the window before that
+	// rate can trip the breaker.
+	MinRequests int
+	// ErrorRatePercent trips the breaker when upstream call failures reach
+	// this share of calls in the window.
+	ErrorRatePercent int
+	// InterruptionRatePercent trips the breaker when interrupted stream
+	// attempts reach this share of stream attempts in the window.
+	InterruptionRatePercent int
+	// OpenDuration is how long the breaker stays open before probing.
+	OpenDuration time.Duration
+	// HalfOpenRequests is the number of successful probes needed to close.
+	HalfOpenRequests int
+}
+
+const bucketCount = 10
+
+type bucket struct {
+	start        time.Time
+	calls        int
+	failures     int
+	streams      int
+	interruption int
+}
+
+// Breaker is a rolling-window circuit breaker guarding one upstream.
+type Breaker struct {
+	mu   sync.Mutex
+	opts Options
+	now  func() time.Time
+
+	state            State
+	buckets          [bucketCount]bucket
+	openedAt         time.Time
+	halfOpenAdmitted int
+	halfOpenSuccess  int
+	lastTransition   time.Time
+}
+
+// New creates a new Breaker in the closed state.
+func New(opts Options) *Breaker {
+	if opts.Window <= 0 {
+		opts.Window = 60 * time.Second
+	}
+	if opts.OpenDuration <= 0 {
+		opts.OpenDuration = 30 * time.Second
+	}
+	if opts.HalfOpenRequests <= 0 {
+		opts.HalfOpenRequests = 1
+	}
+	return &Breaker{
+		opts:           opts,
+		now:            time.Now,
+		lastTransition: time.Now(),
+	}
+}
+
+// Allow reports whether a new upstream call may be made. It returns ErrOpen
+// while the breaker is open or when the half-open probe budget is used up.
+func (b *Breaker) Allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	switch b.currentState(now) {
+	case StateOpen:
+		return ErrOpen
+	case StateHalfOpen:
+		if b.halfOpenAdmitted >= b.opts.HalfOpenRequests {
+			return ErrOpen
+		}
+		b.halfOpenAdmitted++
+	}
+	return nil
+}
+
+// RecordSuccess records an upstream call that completed normally.
+func (b *Breaker) RecordSuccess() {
+	b.record(false, false, false)
+}
+
+// RecordFailure records an upstream call that failed to connect or returned
+// a server-side error status.
+func (b *Breaker) RecordFailure() {
+	b.record(true, false, false)
+}
+
+// RecordStream records the outcome of one stream attempt. Streams that
+// finish cleanly count as successful calls; interrupted ones count against
+// the interruption rate.
+func (b *Breaker) RecordStream(interrupted bool) {
+	b.record(false, true, interrupted)
+}
+
+func (b *Breaker) record(failure, stream, interrupted bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	state := b.currentState(now)
+
+	// Calls and stream attempts are counted apart, so that each rate is
+	// taken over outcomes of its own kind.
+	bk := b.bucketFor(now)
+	if stream {
+		bk.streams++
+		if interrupted {
+			bk.interruption++
+		}
+	} else {
+		bk.calls++
+		if failure {
+			bk.failures++
+		}
+	}
+
+	bad := failure || interrupted
+	switch state {
+	case StateHalfOpen:
+		if bad {
+			b.transition(StateOpen, now)
+			return
+		}
+		b.halfOpenSuccess++
+		if b.halfOpenSuccess >= b.opts.HalfOpenRequests {
+			b.transition(StateClosed, now)
+		}
+	case StateClosed:
+		if bad && b.shouldTrip(now) {
+			b.transition(StateOpen, now)
+		}
+	}
+}
+
+// currentState advances time-based transitions and returns the state.
+// Callers must hold b.mu.
+func (b *Breaker) currentState(now time.Time) State {
+	switch b.state {
+	case StateOpen:
+		if now.Sub(b.openedAt) >= b.opts.OpenDuration {
+			b.transition(StateHalfOpen, now)
+		}
+	case StateHalfOpen:
+		// Probes whose outcome was never recorded (for example because the
+		// client went away) must not wedge the breaker in half-open.
+		if b.halfOpenAdmitted >= b.opts.HalfOpenRequests && now.Sub(b.lastTransition) >= b.opts.OpenDuration {
+			b.halfOpenAdmitted = 0
+			b.halfOpenSuccess = 0
+			b.lastTransition = now
+		}
+	}
+	return b.state
+}
+
+func (b *Breaker) transition(to State, now time.Time) {
+	b.state = to
+	b.lastTransition = now
+	b.halfOpenAdmitted = 0
+	b.halfOpenSuccess = 0
+	switch to {
+	case StateOpen:
+		b.openedAt = now
+	case StateClosed:
+		b.buckets = [bucketCount]bucket{}
+	}
+}
+
+func (b *Breaker) bucketWidth() time.Duration {
+	width := b.opts.Window / bucketCount
+	if width <= 0 {
+		width = time.Millisecond
+	}
+	return width
+}
+
+func (b *Breaker) bucketFor(now time.Time) *bucket {
+	width := b.bucketWidth()
+	start := now.Truncate(width)
+	idx := int(start.UnixNano()/int64(width)) % bucketCount
+	bk := &b.buckets[idx]
+	if !bk.start.Equal(start) {
+		*bk = bucket{start: start}
+	}
+	return bk
+}
+
+// totals sums the buckets that still fall inside the rolling window.
+func (b *Breaker) totals(now time.Time) bucket {
+	var sum bucket
+	cutoff := now.Add(-b.opts.Window)
+	for _, bk := range b.buckets {
+		if bk.start.IsZero() || !bk.start.After(cutoff) {
+			continue
+		}
+		sum.calls += bk.calls
+		sum.failures += bk.failures
+		sum.streams += bk.streams
+		sum.interruption += bk.interruption
+	}
+	return sum
+}
+
+func (b *Breaker) shouldTrip(now time.Time) bool {
+	sum := b.totals(now)
+	if b.opts.ErrorRatePercent > 0 && sum.calls > 0 && sum.calls >= b.opts.MinRequests &&
+		sum.failures*100 >= b.opts.ErrorRatePercent*sum.calls {
+		return true
+	}
+	if b.opts.InterruptionRatePercent > 0 && sum.streams > 0 && sum.streams >= b.opts.MinRequests &&
+		sum.interruption*100 >= b.opts.InterruptionRatePercent*sum.streams {
+		return true
+	}
+	return false
+}
+
+// Snapshot is a point-in-time view of a breaker, suitable for health output.
+type Snapshot struct {
+	State            string    `json:"state"`
+	Calls            int       `json:"calls"`
+	Failures         int       `json:"failures"`
+	Streams          int       `json:"streams"`
+	Interruptions    int       `json:"interruptions"`
+	LastTransitionAt time.Time `json:"last_transition_at"`
+}
+
+// State returns the current state of the breaker.
+func (b *Breaker) State() State {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.currentState(b.now())
+}
+
+// Snapshot returns the current state and rolling-window counters.
+func (b *Breaker) Snapshot() Snapshot {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := b.now()
+	state := b.currentState(now)
+	sum := b.totals(now)
+	return Snapshot{
+		State:            state.String(),
+		Calls:            sum.calls,
+		Failures:         sum.failures,
+		Streams:          sum.streams,
+		Interruptions:    sum.interruption,
+		LastTransitionAt: b.lastTransition.UTC(),
+	}
+}
+
+// IsFailureStatus reports whether an upstream HTTP status should count as a
+// failure. Quota exhaustion counts as well, since retrying into it only
+// makes the outage worse.
+func IsFailureStatus(code int) bool {
+	return code == 429 || code >= 500
+}
@@ -0,0 +1,195 @@
+package breaker
+
+import (
+	"testing"
+	"time"
+)
+
+// clock is a manually advanced time source.
+type clock struct{ t time.Time }
+
+func (c *clock) now() time.Time { return c.t }
+
+func (c *clock) advance(d time.Duration) { c.t = c.t.Add(d) }
+
+// newTestBreaker creates a breaker driven by a clock of its own.
+func newTestBreaker(opts Options) (*Breaker, *clock) {
+	c := &clock{t: time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)}
+	b := New(opts)
+	b.now = c.now
+	b.lastTransition = c.now()
+	return b, c
+}
+
+func assertState(t *testing.T, b *Breaker, want State) {
+	t.Helper()
+	if got := b.State(); got != want {
+		t.Fatalf("state = %s, want %s", got, want)
+	}
+}
+
+func TestTripOnErrorRate(t *testing.T) {
+	b, _ := newTestBreaker(Options{Window: time.Minute, MinRequests: 4, ErrorRatePercent: 50})
+
+	b.RecordSuccess()
+	b.RecordFailure()
+	b.RecordFailure()
+	// Two failures in three calls are above the rate, but below the
+	// minimum number of calls.
+	assertState(t, b, StateClosed)
+
+	b.RecordSuccess()
+	assertState(t, b, StateClosed)
+	b.RecordFailure()
+	assertState(t, b, StateOpen)
+	if err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow while open = %v, want ErrOpen", err)
+	}
+}
+
+func TestTripOnInterruptionRate(t *testing.T) {
+	b, _ := newTestBreaker(Options{Window: time.Minute, MinRequests: 3, ErrorRatePercent: 50, InterruptionRatePercent: 60})
+
+	b.RecordStream(true)
+	b.RecordStream(false)
+	b.RecordStream(false)
+	assertState(t, b, StateClosed)
+	// Interruptions are not failures, so only the interruption rate
+	// (2 of 4 streams, then 3 of 5) can trip the breaker.
+	b.RecordStream(true)
+	assertState(t, b, StateClosed)
+	b.RecordStream(true)
+	assertState(t, b, StateOpen)
+}
+
+func TestMixedCallsAndStreams(t *testing.T) {
+	b, _ := newTestBreaker(Options{Window: time.Minute, MinRequests: 3, ErrorRatePercent: 50, InterruptionRatePercent: 50})
+
+	// Clean streams do not dilute the error rate of upstream calls.
+	b.RecordStream(false)
+	b.RecordStream(false)
+	b.RecordStream(false)
+	b.RecordSuccess()
+	b.RecordFailure()
+	assertState(t, b, StateClosed)
+	b.RecordFailure()
+	assertState(t, b, StateOpen)
+	if s := b.Snapshot(); s.Calls != 3 || s.Failures != 2 || s.Streams != 3 {
+		t.Errorf("snapshot counts %d calls, %d failures and %d streams, want 3, 2 and 3", s.Calls, s.Failures, s.Streams)
+	}
+
+	// Nor do successful calls dilute the interruption rate of streams.
+	b, _ = newTestBreaker(Options{Window: time.Minute, MinRequests: 3, ErrorRatePercent: 50, InterruptionRatePercent: 50})
+	for i := 0; i < 4; i++ {
+		b.RecordSuccess()
+	}
+	b.RecordStream(true)
+	b.RecordStream(false)
+	// Two stream attempts are below the minimum.
+	assertState(t, b, StateClosed)
+	b.RecordStream(true)
+	assertState(t, b, StateOpen)
+}
+
+func TestRollingWindow(t *testing.T) {
+	b, c := newTestBreaker(Options{Window: time.Minute, MinRequests: 3, ErrorRatePercent: 50})
+
+	b.RecordFailure()
+	b.RecordFailure()
+	c.advance(61 * time.Second)
+	// The old failures have left the window, so this one is alone.
+	b.RecordFailure()
+	assertState(t, b, StateClosed)
+	if s := b.Snapshot(); s.Calls != 1 || s.Failures != 1 {
+		t.Errorf("snapshot counts %d calls and %d failures, want 1 and 1", s.Calls, s.Failures)
+	}
+
+	c.advance(30 * time.Second)
+	b.RecordFailure()
+	b.RecordSuccess()
+	assertState(t, b, StateClosed)
+	b.RecordFailure()
+	assertState(t, b, StateOpen)
+}
+
+func TestHalfOpenRecovery(t *testing.T) {
+	b, c := newTestBreaker(Options{Window: time.Minute, MinRequests: 1, ErrorRatePercent: 50, OpenDuration: 30 * time.Second, HalfOpenRequests: 2})
+	b.RecordFailure()
+	assertState(t, b, StateOpen)
+
+	c.advance(29 * time.Second)
+	assertState(t, b, StateOpen)
+	c.advance(time.Second)
+	assertState(t, b, StateHalfOpen)
+
+	// Only HalfOpenRequests probes are admitted.
+	for i := 0; i < 2; i++ {
+		if err := b.Allow(); err != nil {
+			t.Fatalf("probe %d: %v", i+1, err)
+		}
+	}
+	if err := b.Allow(); err != ErrOpen {
+		t.Errorf("Allow beyond the probes = %v, want ErrOpen", err)
+	}
+
+	b.RecordSuccess()
+	assertState(t, b, StateHalfOpen)
+	b.RecordSuccess()
+	assertState(t, b, StateClosed)
+	// Closing starts a fresh window.
+	if s := b.Snapshot(); s.Calls != 0 {
+		t.Errorf("snapshot after closing counts %d calls, want 0", s.Calls)
+	}
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow after closing: %v", err)
+	}
+}
+
+func TestHalfOpenProbeFailure(t *testing.T) {
+	b, c := newTestBreaker(Options{Window: time.Minute, MinRequests: 1, InterruptionRatePercent: 50, OpenDuration: 30 * time.Second, HalfOpenRequests: 2})
+	b.RecordStream(true)
+	c.advance(30 * time.Second)
+	assertState(t, b, StateHalfOpen)
+
+	b.Allow()
+	b.RecordStream(true)
+	assertState(t, b, StateOpen)
+	// The cool-down starts again from the failed probe.
+	c.advance(29 * time.Second)
+	assertState(t, b, StateOpen)
+	c.advance(time.Second)
+	assertState(t, b, StateHalfOpen)
+}
+
+func TestHalfOpenUnrecordedProbes(t *testing.T) {
+	b, c := newTestBreaker(Options{Window: time.Minute, MinRequests: 1, ErrorRatePercent: 50, OpenDuration: 30 * time.Second, HalfOpenRequests: 1})
+	b.RecordFailure()
+	c.advance(30 * time.Second)
+
+	if err := b.Allow(); err != nil {
+		t.Fatal(err)
+	}
+	// The probe's outcome is never recorded.
+	if err := b.Allow(); err != ErrOpen {
+		t.Fatalf("Allow with the probe outstanding = %v, want ErrOpen", err)
+	}
+	c.advance(30 * time.Second)
+	if err := b.Allow(); err != nil {
+		t.Errorf("Allow after the probe timed out: %v", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	g := NewGroup(Options{MinRequests: 1, ErrorRatePercent: 50})
+	if g.Get("a") != g.Get("a") {
+		t.Error("Get returned different breakers for the same upstream")
+	}
+	g.Get("b").RecordFailure()
+	if !g.AnyOpen() {
+		t.Error("AnyOpen = false with an open breaker")
+	}
+	snapshots := g.Snapshots()
+	if snapshots["a"].State != "closed" || snapshots["b"].State != "open" {
+		t.Errorf("snapshots = %+v", snapshots)
+	}
+}
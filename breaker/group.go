@@ -0,0 +1,80 @@
+package breaker
+
+import (
+	"sync"
+
+	"gemini-antiblock/metrics"
+)
+
+// Group holds one Breaker per upstream, created lazily with shared options.
+type Group struct {
+	mu       sync.Mutex
+	opts     Options
+	breakers map[string]*Breaker
+}
+
+// NewGroup creates an empty breaker group.
+func NewGroup(opts Options) *Group {
+	return &Group{
+		opts:     opts,
+		breakers: make(map[string]*Breaker),
+	}
+}
+
+// Get returns the breaker for the given upstream, creating it if needed.
+func (g *Group) Get(upstream string) *Breaker {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	b, ok := g.breakers[upstream]
+	if !ok {
+		b = New(g.opts)
+		g.breakers[upstream] = b
+	}
+	return b
+}
+
+// Snapshots returns a snapshot of every known breaker keyed by upstream.
+func (g *Group) Snapshots() map[string]Snapshot {
+	g.mu.Lock()
+	breakers := make(map[string]*Breaker, len(g.breakers))
+	for name, b := range g.breakers {
+		breakers[name] = b
+	}
+	g.mu.Unlock()
+
+	snapshots := make(map[string]Snapshot, len(breakers))
+	for name, b := range breakers {
+		snapshots[name] = b.Snapshot()
+	}
+	return snapshots
+}
+
+// AnyOpen reports whether any breaker in the group is currently open.
+func (g *Group) AnyOpen() bool {
+	for _, s := range g.Snapshots() {
+		if s.State == StateOpen.String() {
+			return true
+		}
+	}
+	return false
+}
+
+// RegisterMetrics exposes the state of every breaker in the group as a
+// gauge with one series per state, set to 1 for the current one.
+func (g *Group) RegisterMetrics(reg *metrics.Registry) {
+	states := []State{StateClosed, StateOpen, StateHalfOpen}
+	metrics.NewGaugeFunc(reg, "gemini_antiblock_circuit_breaker_state",
+		"Current circuit breaker state per upstream (1 for the active state).",
+		func(emit func(value float64, labelValues ...string)) {
+			for upstream, snapshot := range g.Snapshots() {
+				for _, state := range states {
+					value := 0.0
+					if snapshot.State == state.String() {
+						value = 1
+					}
+					emit(value, upstream, state.String())
+				}
+			}
+		}, "upstream", "state")
+}
@@ -0,0 +1,99 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"time"
+
+	"gemini-antiblock/bench"
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// runBench implements the "bench" subcommand: it drives concurrent streaming
+// clients through an in-process proxy backed by a synthetic upstream and
+// writes the results as JSON. It returns the process exit code.
+func runBench(args []string) int {
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	clients := fs.Int("clients", 50, "number of concurrent streaming clients")
+	sessions := fs.Int("sessions", 4, "sequential sessions per client")
+	chunks := fs.Int("chunks", 50, "chunks per complete upstream response")
+	chunkBytes := fs.Int("chunk-bytes", 256, "text bytes per chunk")
+	chunkInterval := fs.Duration("chunk-interval", 5*time.Millisecond, "pause between upstream chunks")
+	interrupt := fs.Float64("interrupt", 0.1, "probability, from 0 to 1, that an upstream attempt drops mid-stream")
+	output := fs.String("o", "bench_output.txt", "file to write JSON results to")
+	verbose := fs.Bool("v", false, "log proxy activity at the configured LOG_LEVEL")
+	fs.Parse(args)
+
+	if *interrupt < 0 || *interrupt > 1 {
+		fmt.Fprintln(os.Stderr, "-interrupt must be between 0 and 1")
+		return 2
+	}
+
+	cfg, err := config.Load(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logOptions := logger.Options{Level: cfg.LogLevel, Format: cfg.LogFormat, LogContent: cfg.LogContent}
+	if !*verbose {
+		logOptions.Output = io.Discard
+	}
+	logger.Configure(logOptions)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	result, runErr := bench.Run(ctx, bench.Options{
+		Clients:           *clients,
+		SessionsPerClient: *sessions,
+		Upstream: bench.UpstreamOptions{
+			Chunks:               *chunks,
+			ChunkBytes:           *chunkBytes,
+			ChunkInterval:        *chunkInterval,
+			InterruptProbability: *interrupt,
+		},
+		Config: cfg,
+	})
+	if result == nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", runErr)
+		return 1
+	}
+	if runErr != nil {
+		fmt.Fprintf(os.Stderr, "bench interrupted: %v\n", runErr)
+	}
+
+	fmt.Printf("%d sessions in %.2fs: %d completed, %d error events, %d failed\n",
+		result.Sessions.Total, result.DurationSeconds,
+		result.Sessions.Completed, result.Sessions.ErrorEvents, result.Sessions.Failed)
+	fmt.Printf("throughput: %.1f sessions/s, %.0f chunks/s, %.0f bytes/s\n",
+		result.Throughput.SessionsPerSecond, result.Throughput.ChunksPerSecond, result.Throughput.BytesPerSecond)
+	fmt.Printf("time to first token: p50 %.1fms, p95 %.1fms, p99 %.1fms\n",
+		result.TimeToFirstMs.P50, result.TimeToFirstMs.P95, result.TimeToFirstMs.P99)
+	fmt.Printf("retries per session: mean %.2f, p95 %.0f, max %d\n",
+		result.Retries.Mean, result.Retries.P95, result.Retries.Max)
+	fmt.Printf("allocations: %.0f bytes/session, %.0f mallocs/session\n",
+		result.Allocations.BytesPerSession, result.Allocations.MallocsPerSession)
+	fmt.Printf("goroutines: %d before, %d peak, %d after\n",
+		result.Goroutines.Before, result.Goroutines.Peak, result.Goroutines.After)
+
+	data, err := json.MarshalIndent(result, "", "  ")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+	if err := os.WriteFile(*output, append(data, '\n'), 0o644); err != nil {
+		fmt.Fprintf(os.Stderr, "bench: %v\n", err)
+		return 1
+	}
+	fmt.Printf("results written to %s\n", *output)
+	if result.Sessions.Failed > 0 || runErr != nil {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"gemini-antiblock/config"
+)
+
+// runConfig implements the "config" subcommand. "config check" loads the
+// configuration the proxy would run with, from the same file, environment
+// and flags, and prints it with secrets masked. It returns the process exit
+// code: 1 if any setting is invalid.
+func runConfig(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		fmt.Fprintln(os.Stderr, "Usage: gemini-antiblock config check [-config file] [flags]")
+		return 2
+	}
+
+	cfg, err := config.Load(args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return 0
+	}
+	if cfg == nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 2
+	}
+
+	if cfg.File != "" {
+		fmt.Printf("# Effective configuration (file %s)\n\n", cfg.File)
+	} else {
+		fmt.Print("# Effective configuration (no config file)\n\n")
+	}
+	if err := cfg.WriteTOML(os.Stdout); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr)
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	fmt.Fprintln(os.Stderr, "\nConfiguration is valid.")
+	return 0
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/replay"
+)
+
+// runReplay implements the "replay" subcommand: it re-runs recorded
+// transcripts through the current streaming logic and reports sessions whose
+// client output changed. It returns the process exit code.
+func runReplay(args []string) int {
+	fs := flag.NewFlagSet("replay", flag.ExitOnError)
+	requestID := fs.String("request-id", "", "only replay the transcript with this request ID")
+	verbose := fs.Bool("v", false, "log session processing at the configured LOG_LEVEL")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), "Usage: gemini-antiblock replay [flags] <transcripts.jsonl>...")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return 2
+	}
+
+	cfg, err := config.Load(nil)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		return 1
+	}
+	logOptions := logger.Options{Level: cfg.LogLevel, Format: cfg.LogFormat, LogContent: cfg.LogContent}
+	if !*verbose {
+		logOptions.Output = io.Discard
+	}
+	logger.Configure(logOptions)
+
+	replayed, changed, skipped := 0, 0, 0
+	for _, path := range fs.Args() {
+		transcripts, err := replay.Load(path)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%s: %v\n", path, err)
+			return 1
+		}
+
+		for _, t := range transcripts {
+			if *requestID != "" && t.RequestID != *requestID {
+				continue
+			}
+
+			result, err := replay.Run(cfg, t)
+			if errors.Is(err, replay.ErrNotReplayable) {
+				skipped++
+				continue
+			}
+			if err != nil {
+				fmt.Fprintf(os.Stderr, "%s: %v\n", t.RequestID, err)
+				return 1
+			}
+
+			replayed++
+			if !result.Changed() {
+				continue
+			}
+			changed++
+			fmt.Printf("CHANGED %s (outcome %s, attempts %d recorded, %d used)\n",
+				t.RequestID, t.Outcome, result.AttemptsRecorded, result.AttemptsUsed)
+			if result.Diff != "" {
+				fmt.Println(result.Diff)
+			}
+		}
+	}
+
+	fmt.Printf("%d replayed, %d changed, %d skipped\n", replayed, changed, skipped)
+	if changed > 0 {
+		return 1
+	}
+	return 0
+}
@@ -1,62 +1,563 @@
 package config
 
 import (
+	"errors"
+	"flag"
+	"fmt"
 	"os"
+	"reflect"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
 )
 
-// Config holds all configuration values
+// Config holds all configuration values.
+//
+// Each field is tagged with its key in the config file ("section.name") and
+// its environment variable. Command-line flags are named after the
+// environment variable, lowercased with dashes (MAX_CONSECUTIVE_RETRIES is
+// -max-consecutive-retries). Durations are given in milliseconds.
 type Config struct {
-	UpstreamURLBase            string
-	MaxConsecutiveRetries      int
-	DebugMode                  bool
-	RetryDelayMs               time.Duration
-	SwallowThoughtsAfterRetry  bool
-	Port                       string
-	EnableRateLimit            bool
-	RateLimitCount             int
-	RateLimitWindowSeconds     int
-	EnablePunctuationHeuristic bool
-}
-
-// LoadConfig loads configuration from environment variables
-func LoadConfig() *Config {
+	UpstreamURLBase            string        `key:"upstream.url_base" env:"UPSTREAM_URL_BASE"`
+	MaxConsecutiveRetries      int           `key:"retry.max_consecutive_retries" env:"MAX_CONSECUTIVE_RETRIES"`
+	DebugMode                  bool          `key:"log.debug_mode" env:"DEBUG_MODE"`
+	LogLevel                   string        `key:"log.level" env:"LOG_LEVEL"`
+	LogFormat                  string        `key:"log.format" env:"LOG_FORMAT"`
+	LogContent                 bool          `key:"log.content" env:"LOG_CONTENT"`
+	RetryDelayMs               time.Duration `key:"retry.delay_ms" env:"RETRY_DELAY_MS"`
+	SwallowThoughtsAfterRetry  bool          `key:"retry.swallow_thoughts_after_retry" env:"SWALLOW_THOUGHTS_AFTER_RETRY"`
+	Port                       string        `key:"server.port" env:"PORT"`
+	DrainTimeoutSeconds        int           `key:"server.drain_timeout_seconds" env:"DRAIN_TIMEOUT_SECONDS"`
+	EnableRateLimit            bool          `key:"rate_limit.enabled" env:"ENABLE_RATE_LIMIT"`
+	RateLimitCount             int           `key:"rate_limit.count" env:"RATE_LIMIT_COUNT"`
+	RateLimitWindowSeconds     int           `key:"rate_limit.window_seconds" env:"RATE_LIMIT_WINDOW_SECONDS"`
+	EnablePunctuationHeuristic bool          `key:"retry.punctuation_heuristic" env:"ENABLE_PUNCTUATION_HEURISTIC"`
+
+	// Upstream requests go through UpstreamProxy (http, https, socks5 or
+	// socks5h URL) if set, and trust UpstreamCAFile's certificates in
+	// addition to the system roots. The dial, TLS handshake and
+	// response-header timeouts bound connecting to the upstream;
+	// UpstreamStreamTimeoutMs bounds a whole upstream request, streamed
+	// body included; by default only the client and session end a stream.
+	// A zero timeout or pool size means no limit.
+	UpstreamProxy                   string        `key:"upstream.proxy" env:"UPSTREAM_PROXY" secret:"true"`
+	UpstreamCAFile                  string        `key:"upstream.ca_file" env:"UPSTREAM_CA_FILE"`
+	UpstreamDialTimeoutMs           time.Duration `key:"upstream.dial_timeout_ms" env:"UPSTREAM_DIAL_TIMEOUT_MS"`
+	UpstreamTLSHandshakeTimeoutMs   time.Duration `key:"upstream.tls_handshake_timeout_ms" env:"UPSTREAM_TLS_HANDSHAKE_TIMEOUT_MS"`
+	UpstreamResponseHeaderTimeoutMs time.Duration `key:"upstream.response_header_timeout_ms" env:"UPSTREAM_RESPONSE_HEADER_TIMEOUT_MS"`
+	UpstreamStreamTimeoutMs         time.Duration `key:"upstream.stream_timeout_ms" env:"UPSTREAM_STREAM_TIMEOUT_MS"`
+	UpstreamHTTP2                   bool          `key:"upstream.http2" env:"UPSTREAM_HTTP2"`
+	UpstreamMaxIdleConns            int           `key:"upstream.max_idle_conns" env:"UPSTREAM_MAX_IDLE_CONNS"`
+	UpstreamMaxIdleConnsPerHost     int           `key:"upstream.max_idle_conns_per_host" env:"UPSTREAM_MAX_IDLE_CONNS_PER_HOST"`
+	UpstreamMaxConnsPerHost         int           `key:"upstream.max_conns_per_host" env:"UPSTREAM_MAX_CONNS_PER_HOST"`
+	UpstreamIdleConnTimeoutMs       time.Duration `key:"upstream.idle_conn_timeout_ms" env:"UPSTREAM_IDLE_CONN_TIMEOUT_MS"`
+
+	// The proxy listens on UnixSocket if set, otherwise on Port. TLSCert
+	// and TLSKey enable HTTPS; the files are reloaded when they change.
+	// EnableHTTP2 offers HTTP/2 over TLS and EnableH2C accepts cleartext
+	// HTTP/2 with prior knowledge. A zero timeout or header limit means no
+	// limit (Go's 1 MB default for MaxHeaderBytes).
+	UnixSocket          string        `key:"server.unix_socket" env:"UNIX_SOCKET"`
+	TLSCert             string        `key:"server.tls_cert" env:"TLS_CERT"`
+	TLSKey              string        `key:"server.tls_key" env:"TLS_KEY"`
+	EnableHTTP2         bool          `key:"server.http2" env:"ENABLE_HTTP2"`
+	EnableH2C           bool          `key:"server.h2c" env:"ENABLE_H2C"`
+	ReadHeaderTimeoutMs time.Duration `key:"server.read_header_timeout_ms" env:"READ_HEADER_TIMEOUT_MS"`
+	IdleTimeoutMs       time.Duration `key:"server.idle_timeout_ms" env:"IDLE_TIMEOUT_MS"`
+	MaxHeaderBytes      int           `key:"server.max_header_bytes" env:"MAX_HEADER_BYTES"`
+
+	// Rate limiting uses a token bucket per key holding up to
+	// RateLimitBurst tokens (0 means RateLimitCount). In "wait" mode a
+	// request waits up to RateLimitMaxWaitMs for a token; in "reject" mode,
+	// or when the wait would be longer, it is answered with 429.
+	RateLimitBurst     int           `key:"rate_limit.burst" env:"RATE_LIMIT_BURST"`
+	RateLimitMode      string        `key:"rate_limit.mode" env:"RATE_LIMIT_MODE"`
+	RateLimitMaxWaitMs time.Duration `key:"rate_limit.max_wait_ms" env:"RATE_LIMIT_MAX_WAIT_MS"`
+
+	// RateLimitRules replace the default per-key rule built from
+	// RateLimitCount and RateLimitWindowSeconds. Client IPs are taken from
+	// X-Forwarded-For when the connection comes from one of
+	// RateLimitTrustedProxies.
+	RateLimitRules          []LimitRule `key:"rate_limit.rules" env:"RATE_LIMIT_RULES"`
+	RateLimitTrustedProxies []string    `key:"rate_limit.trusted_proxies" env:"RATE_LIMIT_TRUSTED_PROXIES"`
+
+	// RateLimitStore is where buckets are kept: "memory" in each process, or
+	// "redis" to share them between replicas. If Redis is unreachable,
+	// limits fall back to in-process buckets.
+	RateLimitStore          string        `key:"rate_limit.store" env:"RATE_LIMIT_STORE"`
+	RateLimitRedisAddr      string        `key:"rate_limit.redis_addr" env:"RATE_LIMIT_REDIS_ADDR"`
+	RateLimitRedisPassword  string        `key:"rate_limit.redis_password" env:"RATE_LIMIT_REDIS_PASSWORD" secret:"true"`
+	RateLimitRedisDB        int           `key:"rate_limit.redis_db" env:"RATE_LIMIT_REDIS_DB"`
+	RateLimitRedisTimeoutMs time.Duration `key:"rate_limit.redis_timeout_ms" env:"RATE_LIMIT_REDIS_TIMEOUT_MS"`
+
+	// Client request headers matching ForwardHeaders and not DenyHeaders
+	// are passed upstream, on the first attempt and on retries. Names are
+	// case-insensitive and may end in "*" to match a prefix; "*" alone
+	// matches every header. InjectHeaders ("Name: value") are set on every
+	// upstream request. Upstream response headers matching ResponseHeaders
+	// are mirrored on streaming responses.
+	ForwardHeaders  []string `key:"headers.forward" env:"FORWARD_HEADERS"`
+	DenyHeaders     []string `key:"headers.deny" env:"DENY_HEADERS"`
+	InjectHeaders   []string `key:"headers.inject" env:"INJECT_HEADERS" secret:"true"`
+	ResponseHeaders []string `key:"headers.response" env:"RESPONSE_HEADERS"`
+
+	// ConcurrencyMaxInFlight caps the streaming sessions in progress (0
+	// means no cap). Further sessions wait up to ConcurrencyQueueTimeoutMs
+	// in a queue of at most ConcurrencyMaxQueue requests, which is served
+	// tenant by tenant in weighted round-robin. ConcurrencyTenantWeights
+	// holds "api-key=weight" entries; other tenants have weight 1.
+	ConcurrencyMaxInFlight    int           `key:"concurrency.max_in_flight" env:"CONCURRENCY_MAX_IN_FLIGHT"`
+	ConcurrencyMaxQueue       int           `key:"concurrency.max_queue" env:"CONCURRENCY_MAX_QUEUE"`
+	ConcurrencyQueueTimeoutMs time.Duration `key:"concurrency.queue_timeout_ms" env:"CONCURRENCY_QUEUE_TIMEOUT_MS"`
+	ConcurrencyTenantWeights  []string      `key:"concurrency.tenant_weights" env:"CONCURRENCY_TENANT_WEIGHTS" secret:"keys"`
+
+	// CORSAllowedOrigins holds exact origins and patterns with one "*"
+	// wildcard, such as https://*.example.com; "*" alone allows any origin
+	// and an empty list disables CORS. Credentials can only be allowed for
+	// listed origins.
+	CORSAllowedOrigins   []string `key:"cors.allowed_origins" env:"CORS_ALLOWED_ORIGINS"`
+	CORSAllowedMethods   []string `key:"cors.allowed_methods" env:"CORS_ALLOWED_METHODS"`
+	CORSAllowedHeaders   []string `key:"cors.allowed_headers" env:"CORS_ALLOWED_HEADERS"`
+	CORSExposedHeaders   []string `key:"cors.exposed_headers" env:"CORS_EXPOSED_HEADERS"`
+	CORSAllowCredentials bool     `key:"cors.allow_credentials" env:"CORS_ALLOW_CREDENTIALS"`
+	CORSMaxAgeSeconds    int      `key:"cors.max_age_seconds" env:"CORS_MAX_AGE_SECONDS"`
+
+	// InjectedPrompt is appended to each streaming request's system
+	// instruction. It must ask for the [done] token that marks a complete
+	// answer.
+	InjectedPrompt string `key:"prompt.injected" env:"INJECTED_PROMPT"`
+
+	ReadinessProbeAPIKey         string `key:"readiness.probe_api_key" env:"READINESS_PROBE_API_KEY" secret:"true"`
+	ReadinessProbeTTLSeconds     int    `key:"readiness.probe_ttl_seconds" env:"READINESS_PROBE_TTL_SECONDS"`
+	ReadinessProbeTimeoutSeconds int    `key:"readiness.probe_timeout_seconds" env:"READINESS_PROBE_TIMEOUT_SECONDS"`
+
+	EnableAdmin   bool   `key:"admin.enabled" env:"ENABLE_ADMIN"`
+	AdminAddr     string `key:"admin.addr" env:"ADMIN_ADDR"`
+	AdminToken    string `key:"admin.token" env:"ADMIN_TOKEN" secret:"true"`
+	AdminTLSCert  string `key:"admin.tls_cert" env:"ADMIN_TLS_CERT"`
+	AdminTLSKey   string `key:"admin.tls_key" env:"ADMIN_TLS_KEY"`
+	AdminClientCA string `key:"admin.client_ca" env:"ADMIN_CLIENT_CA"`
+
+	EnableCircuitBreaker                  bool `key:"circuit_breaker.enabled" env:"ENABLE_CIRCUIT_BREAKER"`
+	CircuitBreakerWindowSeconds           int  `key:"circuit_breaker.window_seconds" env:"CIRCUIT_BREAKER_WINDOW_SECONDS"`
+	CircuitBreakerMinRequests             int  `key:"circuit_breaker.min_requests" env:"CIRCUIT_BREAKER_MIN_REQUESTS"`
+	CircuitBreakerErrorRatePercent        int  `key:"circuit_breaker.error_rate_percent" env:"CIRCUIT_BREAKER_ERROR_RATE_PERCENT"`
+	CircuitBreakerInterruptionRatePercent int  `key:"circuit_breaker.interruption_rate_percent" env:"CIRCUIT_BREAKER_INTERRUPTION_RATE_PERCENT"`
+	CircuitBreakerOpenSeconds             int  `key:"circuit_breaker.open_seconds" env:"CIRCUIT_BREAKER_OPEN_SECONDS"`
+	CircuitBreakerHalfOpenRequests        int  `key:"circuit_breaker.half_open_requests" env:"CIRCUIT_BREAKER_HALF_OPEN_REQUESTS"`
+
+	// ModelFallbacks maps a model to the model used after it keeps failing.
+	ModelFallbacks       map[string]string `key:"model_fallback.chains" env:"MODEL_FALLBACKS"`
+	ModelFallbackAfter   int               `key:"model_fallback.after" env:"MODEL_FALLBACK_AFTER"`
+	ModelFallbackReasons []string          `key:"model_fallback.reasons" env:"MODEL_FALLBACK_REASONS"`
+
+	EnableHedging        bool          `key:"hedging.enabled" env:"ENABLE_HEDGING"`
+	HedgeDelayMs         time.Duration `key:"hedging.delay_ms" env:"HEDGE_DELAY_MS"`
+	HedgeBudgetPerMinute int           `key:"hedging.budget_per_minute" env:"HEDGE_BUDGET_PER_MINUTE"`
+
+	EnableTracing      bool   `key:"tracing.enabled" env:"ENABLE_TRACING"`
+	OTLPEndpoint       string `key:"tracing.otlp_endpoint" env:"OTEL_EXPORTER_OTLP_ENDPOINT"`
+	TracingServiceName string `key:"tracing.service_name" env:"OTEL_SERVICE_NAME"`
+
+	EnableRecorder        bool     `key:"recorder.enabled" env:"ENABLE_RECORDER"`
+	RecorderPath          string   `key:"recorder.path" env:"RECORDER_PATH"`
+	RecorderMaxMB         int      `key:"recorder.max_mb" env:"RECORDER_MAX_MB"`
+	RecorderMaxBackups    int      `key:"recorder.max_backups" env:"RECORDER_MAX_BACKUPS"`
+	RecorderSamplePercent int      `key:"recorder.sample_percent" env:"RECORDER_SAMPLE_PERCENT"`
+	RecorderRedactFields  []string `key:"recorder.redact_fields" env:"RECORDER_REDACT_FIELDS"`
+
+	// MetricsModels are the models that get their own series in the
+	// request metrics, together with every model in ModelFallbacks. Other
+	// models are counted as "other", so clients cannot create series.
+	MetricsModels []string `key:"metrics.models" env:"METRICS_MODELS"`
+
+	// File is the config file that was loaded, if any.
+	File string
+
+	// sources records where each setting came from, by file key.
+	sources map[string]string
+}
+
+// DefaultInjectedPrompt asks the model to end its answer with [done].
+const DefaultInjectedPrompt = "IMPORTANT: At the very end of your entire response, you must write the token [done] to signal completion. This is a mandatory technical requirement."
+
+// Defaults returns the built-in configuration.
+func Defaults() *Config {
 	return &Config{
-		UpstreamURLBase:            getEnvString("UPSTREAM_URL_BASE", "https://generativelanguage.googleapis.com"),
-		Port:                       getEnvString("PORT", "8080"),
-		DebugMode:                  getEnvBool("DEBUG_MODE", true),
-		MaxConsecutiveRetries:      getEnvInt("MAX_CONSECUTIVE_RETRIES", 100),
-		RetryDelayMs:               time.Duration(getEnvInt("RETRY_DELAY_MS", 750)) * time.Millisecond,
-		SwallowThoughtsAfterRetry:  getEnvBool("SWALLOW_THOUGHTS_AFTER_RETRY", true),
-		EnableRateLimit:            getEnvBool("ENABLE_RATE_LIMIT", false),
-		RateLimitCount:             getEnvInt("RATE_LIMIT_COUNT", 10),
-		RateLimitWindowSeconds:     getEnvInt("RATE_LIMIT_WINDOW_SECONDS", 60),
-		EnablePunctuationHeuristic: getEnvBool("ENABLE_PUNCTUATION_HEURISTIC", true),
+		UpstreamURLBase:            "https://generativelanguage.googleapis.com",
+		Port:                       "8080",
+		DrainTimeoutSeconds:        30,
+		DebugMode:                  true,
+		LogFormat:                  "text",
+		MaxConsecutiveRetries:      100,
+		RetryDelayMs:               750 * time.Millisecond,
+		SwallowThoughtsAfterRetry:  true,
+		RateLimitCount:             10,
+		RateLimitWindowSeconds:     60,
+		EnablePunctuationHeuristic: true,
+
+		UpstreamDialTimeoutMs:           10000 * time.Millisecond,
+		UpstreamTLSHandshakeTimeoutMs:   10000 * time.Millisecond,
+		UpstreamResponseHeaderTimeoutMs: 30000 * time.Millisecond,
+		UpstreamStreamTimeoutMs:         0,
+		UpstreamHTTP2:                   true,
+		UpstreamMaxIdleConns:            200,
+		UpstreamMaxIdleConnsPerHost:     60,
+		UpstreamIdleConnTimeoutMs:       90000 * time.Millisecond,
+
+		EnableHTTP2:         true,
+		ReadHeaderTimeoutMs: 10000 * time.Millisecond,
+		IdleTimeoutMs:       120000 * time.Millisecond,
+		MaxHeaderBytes:      1 << 20,
+
+		RateLimitMode:      "wait",
+		RateLimitMaxWaitMs: 30000 * time.Millisecond,
+
+		RateLimitStore:          "memory",
+		RateLimitRedisAddr:      "localhost:6379",
+		RateLimitRedisTimeoutMs: 100 * time.Millisecond,
+
+		ConcurrencyMaxQueue:       100,
+		ConcurrencyQueueTimeoutMs: 30000 * time.Millisecond,
+
+		ForwardHeaders: []string{
+			"Authorization", "X-Goog-Api-Key", "Content-Type", "Accept",
+			"X-Goog-User-Project", "X-Goog-Api-Client", "X-Server-Timeout",
+		},
+		ResponseHeaders: []string{"Server-Timing", "X-Goog-*"},
+
+		CORSAllowedOrigins: []string{"*"},
+		CORSAllowedMethods: []string{"GET", "POST", "OPTIONS"},
+		CORSAllowedHeaders: []string{"Content-Type", "Authorization", "X-Goog-Api-Key", "X-Goog-Api-Client", "X-Goog-User-Project"},
+		CORSExposedHeaders: []string{"X-Request-Id", "Retry-After", "X-RateLimit-Limit", "X-RateLimit-Remaining", "X-RateLimit-Reset", "X-Antiblock-Model-Fallback"},
+		CORSMaxAgeSeconds:  600,
+
+		InjectedPrompt: DefaultInjectedPrompt,
+
+		ReadinessProbeTTLSeconds:     10,
+		ReadinessProbeTimeoutSeconds: 5,
+
+		AdminAddr: "127.0.0.1:6060",
+
+		CircuitBreakerWindowSeconds:           60,
+		CircuitBreakerMinRequests:             20,
+		CircuitBreakerErrorRatePercent:        50,
+		CircuitBreakerInterruptionRatePercent: 80,
+		CircuitBreakerOpenSeconds:             30,
+		CircuitBreakerHalfOpenRequests:        3,
+
+		ModelFallbacks:       map[string]string{},
+		ModelFallbackAfter:   3,
+		ModelFallbackReasons: []string{"BLOCK", "FINISH_ABNORMAL", "FINISH_EMPTY_RESPONSE"},
+
+		HedgeDelayMs:         2000 * time.Millisecond,
+		HedgeBudgetPerMinute: 10,
+
+		OTLPEndpoint:       "http://localhost:4318",
+		TracingServiceName: "gemini-antiblock-proxy",
+
+		RecorderPath:          "transcripts.jsonl",
+		RecorderMaxMB:         100,
+		RecorderMaxBackups:    5,
+		RecorderSamplePercent: 100,
+
+		MetricsModels: []string{"gemini-2.5-pro", "gemini-2.5-flash", "gemini-2.5-flash-lite", "gemini-2.0-flash", "gemini-2.0-flash-lite"},
 	}
 }
 
-func getEnvString(key, defaultValue string) string {
-	if value := os.Getenv(key); value != "" {
-		return value
+// Sources of a setting, as reported by Source.
+const (
+	SourceDefault = "default"
+	SourceEnv     = "env"
+	SourceFlag    = "flag"
+)
+
+// Load builds the configuration from, in increasing order of precedence, the
+// defaults, the config file, environment variables and the command-line
+// flags in args. The config file is named by the -config flag or the
+// CONFIG_FILE environment variable; its format follows the extension (.toml,
+// .yaml or .yml).
+//
+// Every invalid value is reported, not just the first: the returned error is
+// a *ValidationError listing all of them. The returned Config is nil only if
+// args cannot be parsed.
+func Load(args []string) (*Config, error) {
+	flagValues, configFile, err := parseFlags(args)
+	if err != nil {
+		return nil, err
+	}
+	if configFile == "" {
+		configFile = os.Getenv("CONFIG_FILE")
 	}
-	return defaultValue
+
+	cfg := Defaults()
+	cfg.sources = make(map[string]string)
+	var problems []string
+
+	if configFile != "" {
+		cfg.File = configFile
+		problems = append(problems, cfg.applyFile(configFile)...)
+	}
+
+	for _, f := range fields {
+		if value := os.Getenv(f.env); value != "" {
+			if err := f.set(cfg, value); err != nil {
+				problems = append(problems, fmt.Sprintf("%s=%q: %v", f.env, value, err))
+				continue
+			}
+			cfg.sources[f.key] = SourceEnv
+		}
+	}
+
+	for _, f := range fields {
+		if value, ok := flagValues[f.flag]; ok {
+			if err := f.set(cfg, value); err != nil {
+				problems = append(problems, fmt.Sprintf("-%s=%q: %v", f.flag, value, err))
+				continue
+			}
+			cfg.sources[f.key] = SourceFlag
+		}
+	}
+
+	// DEBUG_MODE is kept as a shorthand for LOG_LEVEL=debug.
+	if cfg.LogLevel == "" {
+		cfg.LogLevel = "info"
+		if cfg.DebugMode {
+			cfg.LogLevel = "debug"
+		}
+	}
+
+	problems = append(problems, cfg.validate()...)
+	if len(problems) > 0 {
+		return cfg, &ValidationError{Problems: problems}
+	}
+	return cfg, nil
+}
+
+// Source returns where the setting with the given file key came from: a
+// config file path, SourceEnv, SourceFlag or SourceDefault.
+func (c *Config) Source(key string) string {
+	if source, ok := c.sources[key]; ok {
+		return source
+	}
+	return SourceDefault
+}
+
+// ValidationError lists every problem found while loading a configuration.
+type ValidationError struct {
+	Problems []string
+}
+
+func (e *ValidationError) Error() string {
+	if len(e.Problems) == 1 {
+		return "invalid configuration: " + e.Problems[0]
+	}
+	return fmt.Sprintf("invalid configuration (%d problems):\n  %s", len(e.Problems), strings.Join(e.Problems, "\n  "))
+}
+
+// parseFlags parses the -config flag and one flag per setting. Values are
+// returned by flag name so they can be applied after the file and env.
+func parseFlags(args []string) (values map[string]string, configFile string, err error) {
+	values = make(map[string]string)
+	fs := flag.NewFlagSet("gemini-antiblock", flag.ContinueOnError)
+	fs.StringVar(&configFile, "config", "", "config file (.toml, .yaml or .yml); defaults to $CONFIG_FILE")
+	for _, f := range fields {
+		name := f.flag
+		usage := fmt.Sprintf("%s (env %s)", f.key, f.env)
+		if f.isBool() {
+			fs.BoolFunc(name, usage, func(v string) error { values[name] = v; return nil })
+		} else {
+			fs.Func(name, usage, func(v string) error { values[name] = v; return nil })
+		}
+	}
+	if err := fs.Parse(args); err != nil {
+		return nil, "", err
+	}
+	if fs.NArg() > 0 {
+		return nil, "", fmt.Errorf("unexpected argument %q", fs.Arg(0))
+	}
+	return values, configFile, nil
 }
 
-func getEnvInt(key string, defaultValue int) int {
-	if value := os.Getenv(key); value != "" {
-		if intValue, err := strconv.Atoi(value); err == nil {
-			return intValue
+// field describes one tagged Config field.
+type field struct {
+	key    string // file key, "section.name"
+	env    string
+	flag   string
+	secret bool
+	// secretKeys marks lists of "secret=value" entries, where only the
+	// part before the last '=' is secret.
+	secretKeys bool
+	index      int
+}
+
+var fields = func() []field {
+	t := reflect.TypeOf(Config{})
+	var fs []field
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		key := sf.Tag.Get("key")
+		if key == "" {
+			continue
 		}
+		env := sf.Tag.Get("env")
+		fs = append(fs, field{
+			key:        key,
+			env:        env,
+			flag:       strings.ReplaceAll(strings.ToLower(env), "_", "-"),
+			secret:     sf.Tag.Get("secret") != "",
+			secretKeys: sf.Tag.Get("secret") == "keys",
+			index:      i,
+		})
 	}
-	return defaultValue
+	return fs
+}()
+
+func fieldByKey(key string) (field, bool) {
+	for _, f := range fields {
+		if f.key == key {
+			return f, true
+		}
+	}
+	return field{}, false
+}
+
+func (f field) value(cfg *Config) reflect.Value {
+	return reflect.ValueOf(cfg).Elem().Field(f.index)
+}
+
+func (f field) isBool() bool {
+	return reflect.TypeOf(Config{}).Field(f.index).Type.Kind() == reflect.Bool
 }
 
-func getEnvBool(key string, defaultValue bool) bool {
-	if value := os.Getenv(key); value != "" {
-		if boolValue, err := strconv.ParseBool(value); err == nil {
-			return boolValue
+// set parses a string value, as given in the environment or a flag, into
+// the field.
+func (f field) set(cfg *Config, value string) error {
+	v := f.value(cfg)
+	switch v.Interface().(type) {
+	case string:
+		v.SetString(value)
+	case int:
+		n, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return errors.New("not an integer")
+		}
+		v.SetInt(int64(n))
+	case bool:
+		b, err := strconv.ParseBool(strings.TrimSpace(value))
+		if err != nil {
+			return errors.New("not a boolean (use true or false)")
+		}
+		v.SetBool(b)
+	case time.Duration:
+		ms, err := strconv.Atoi(strings.TrimSpace(value))
+		if err != nil {
+			return errors.New("not an integer number of milliseconds")
+		}
+		v.Set(reflect.ValueOf(time.Duration(ms) * time.Millisecond))
+	case []string:
+		v.Set(reflect.ValueOf(splitList(value)))
+	case map[string]string:
+		chains, err := parseFallbackChains(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(chains))
+	case []LimitRule:
+		rules, err := ParseLimitRules(value)
+		if err != nil {
+			return err
+		}
+		v.Set(reflect.ValueOf(rules))
+	default:
+		return fmt.Errorf("unsupported setting type %s", v.Type())
+	}
+	return nil
+}
+
+// format renders the field's value in the form set accepts.
+func (f field) format(cfg *Config) string {
+	switch value := f.value(cfg).Interface().(type) {
+	case time.Duration:
+		return strconv.FormatInt(value.Milliseconds(), 10)
+	case []string:
+		return strings.Join(value, ",")
+	case map[string]string:
+		return formatFallbackChains(value)
+	case []LimitRule:
+		return formatLimitRules(value)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+func splitList(value string) []string {
+	var items []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// parseFallbackChains parses chains such as
+// "gemini-2.5-pro>gemini-2.5-flash>gemini-2.0-flash;gemini-2.5-flash-lite>gemini-2.0-flash-lite"
+// into a map from each model to the next one in its chain.
+func parseFallbackChains(value string) (map[string]string, error) {
+	next := make(map[string]string)
+	for _, chain := range strings.Split(value, ";") {
+		if strings.TrimSpace(chain) == "" {
+			continue
+		}
+		models := strings.Split(chain, ">")
+		if len(models) < 2 {
+			return nil, fmt.Errorf("fallback chain %q needs at least two models separated by '>'", strings.TrimSpace(chain))
+		}
+		for i := 0; i+1 < len(models); i++ {
+			from := strings.TrimSpace(models[i])
+			to := strings.TrimSpace(models[i+1])
+			if from == "" || to == "" {
+				return nil, fmt.Errorf("fallback chain %q has an empty model name", strings.TrimSpace(chain))
+			}
+			if from == to {
+				return nil, fmt.Errorf("fallback chain %q falls back from %s to itself", strings.TrimSpace(chain), from)
+			}
+			if existing, ok := next[from]; ok && existing != to {
+				return nil, fmt.Errorf("model %s falls back to both %s and %s", from, existing, to)
+			}
+			next[from] = to
+		}
+	}
+	return next, nil
+}
+
+// formatFallbackChains renders a fallback map as chains parseFallbackChains
+// accepts, starting each chain from a model nothing falls back to.
+func formatFallbackChains(next map[string]string) string {
+	targets := make(map[string]bool, len(next))
+	for _, to := range next {
+		targets[to] = true
+	}
+	var starts []string
+	for from := range next {
+		if !targets[from] {
+			starts = append(starts, from)
+		}
+	}
+	sort.Strings(starts)
+
+	var chains []string
+	for _, model := range starts {
+		chain := []string{model}
+		seen := map[string]bool{model: true}
+		for to, ok := next[model]; ok && !seen[to]; to, ok = next[model] {
+			chain = append(chain, to)
+			seen[to] = true
+			model = to
 		}
+		chains = append(chains, strings.Join(chain, ">"))
 	}
-	return defaultValue
+	return strings.Join(chains, ";")
 }
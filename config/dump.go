@@ -0,0 +1,117 @@
+package config
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// WriteTOML writes the configuration in config file form. Secrets are
+// masked, and settings that are not defaults are annotated with where they
+// came from.
+func (c *Config) WriteTOML(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+
+	var sections []string
+	bySection := make(map[string][]field)
+	for _, f := range fields {
+		section := f.key[:strings.Index(f.key, ".")]
+		if _, ok := bySection[section]; !ok {
+			sections = append(sections, section)
+		}
+		bySection[section] = append(bySection[section], f)
+	}
+
+	for i, section := range sections {
+		if i > 0 {
+			fmt.Fprintln(bw)
+		}
+		fmt.Fprintf(bw, "[%s]\n", section)
+		for _, f := range bySection[section] {
+			line := fmt.Sprintf("%s = %s", f.key[len(section)+1:], c.tomlValue(f))
+			switch source := c.Source(f.key); source {
+			case SourceDefault:
+			case SourceEnv:
+				line += "  # env " + f.env
+			case SourceFlag:
+				line += "  # flag -" + f.flag
+			default:
+				line += "  # " + source
+			}
+			fmt.Fprintln(bw, line)
+		}
+	}
+	return bw.Flush()
+}
+
+func (c *Config) tomlValue(f field) string {
+	switch value := f.value(c).Interface().(type) {
+	case string:
+		if f.secret && value != "" {
+			return strconv.Quote(logger.MaskSecret(value))
+		}
+		return strconv.Quote(logger.Redact(value))
+	case time.Duration:
+		return strconv.FormatInt(value.Milliseconds(), 10)
+	case []string:
+		if f.secretKeys {
+			return tomlList(maskKeys(value))
+		}
+		if f.secret {
+			// Secret lists hold "Name: value" entries; only values are
+			// masked.
+			masked := make([]string, len(value))
+			for i, item := range value {
+				name, secret, ok := strings.Cut(item, ":")
+				if !ok {
+					masked[i] = logger.MaskSecret(item)
+					continue
+				}
+				masked[i] = name + ": " + logger.MaskSecret(strings.TrimSpace(secret))
+			}
+			return tomlList(masked)
+		}
+		return tomlList(value)
+	case map[string]string:
+		chains := formatFallbackChains(value)
+		if chains == "" {
+			return "[]"
+		}
+		return tomlList(strings.Split(chains, ";"))
+	case []LimitRule:
+		items := make([]string, len(value))
+		for i, r := range value {
+			items[i] = r.Masked().String()
+		}
+		return tomlList(items)
+	default:
+		return fmt.Sprint(value)
+	}
+}
+
+// maskKeys masks the secret part of "secret=value" entries.
+func maskKeys(items []string) []string {
+	masked := make([]string, len(items))
+	for i, item := range items {
+		j := strings.LastIndex(item, "=")
+		if j < 0 {
+			masked[i] = logger.MaskSecret(item)
+			continue
+		}
+		masked[i] = logger.MaskSecret(strings.TrimSpace(item[:j])) + item[j:]
+	}
+	return masked
+}
+
+func tomlList(items []string) string {
+	quoted := make([]string, len(items))
+	for i, item := range items {
+		quoted[i] = strconv.Quote(item)
+	}
+	return "[" + strings.Join(quoted, ", ") + "]"
+}
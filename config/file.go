@@ -0,0 +1,135 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// A parsed config file is a tree of map[string]interface{} sections whose
+// leaves are strings, []interface{} lists or nil. Scalars stay strings so
+// file values go through the same parsing and validation as environment
+// variables.
+
+// readFile parses a TOML or YAML config file, chosen by extension.
+func readFile(path string) (map[string]interface{}, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".toml":
+		return parseTOML(string(data))
+	case ".yaml", ".yml":
+		return parseYAML(string(data))
+	default:
+		return nil, fmt.Errorf("unknown config file format %q (use .toml, .yaml or .yml)", filepath.Ext(path))
+	}
+}
+
+// applyFile sets every field named in the config file and returns the
+// problems found, including settings the file names that do not exist.
+func (c *Config) applyFile(path string) []string {
+	tree, err := readFile(path)
+	if err != nil {
+		return []string{fmt.Sprintf("config file %s: %v", path, err)}
+	}
+
+	values := make(map[string]interface{})
+	flatten("", tree, values)
+	keys := make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var problems []string
+	for _, key := range keys {
+		f, ok := fieldByKey(key)
+		if !ok {
+			kind := "setting"
+			if _, isSection := values[key].(map[string]interface{}); isSection {
+				kind = "section"
+			}
+			problems = append(problems, fmt.Sprintf("%s: unknown %s %q", path, kind, key))
+			continue
+		}
+		if err := c.setFromFile(f, values[key]); err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s = %s: %v", path, key, describeFileValue(values[key]), err))
+			continue
+		}
+		if values[key] != nil {
+			c.sources[key] = path
+		}
+	}
+	return problems
+}
+
+// flatten collects the leaves of tree by dotted key. Sections that contain
+// no settings are kept whole so they are reported once as unknown.
+func flatten(prefix string, tree map[string]interface{}, out map[string]interface{}) {
+	for name, value := range tree {
+		key := name
+		if prefix != "" {
+			key = prefix + "." + name
+		}
+		if section, ok := value.(map[string]interface{}); ok && isSection(key) {
+			flatten(key, section, out)
+			continue
+		}
+		out[key] = value
+	}
+}
+
+// isSection reports whether any setting lives under key.
+func isSection(key string) bool {
+	for _, f := range fields {
+		if strings.HasPrefix(f.key, key+".") {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *Config) setFromFile(f field, value interface{}) error {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return f.set(c, value)
+	case []interface{}:
+		var items []string
+		for _, item := range value {
+			s, ok := item.(string)
+			if !ok {
+				return fmt.Errorf("list items must be plain values")
+			}
+			items = append(items, s)
+		}
+		switch f.value(c).Interface().(type) {
+		case []string:
+			f.value(c).Set(reflect.ValueOf(items))
+			return nil
+		case map[string]string, []LimitRule:
+			return f.set(c, strings.Join(items, ";"))
+		default:
+			return fmt.Errorf("expected a single value, not a list")
+		}
+	default:
+		return fmt.Errorf("expected a value, not a section")
+	}
+}
+
+func describeFileValue(value interface{}) string {
+	switch value := value.(type) {
+	case string:
+		return fmt.Sprintf("%q", value)
+	case []interface{}:
+		return "[...]"
+	default:
+		return "{...}"
+	}
+}
@@ -0,0 +1,179 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// LimitDimensions are the request attributes a limit rule can be keyed by.
+var LimitDimensions = []string{"tenant", "ip", "model"}
+
+// LimitRule is a rate limit with its own request and token budgets, kept
+// separately for every combination of its dimensions' values. A request is
+// admitted only if every rule that applies to it has budget left.
+type LimitRule struct {
+	Dimensions []LimitDimension
+	// RequestsPerMinute and TokensPerMinute are the budgets; zero means
+	// unlimited.
+	RequestsPerMinute int
+	TokensPerMinute   int
+}
+
+// LimitDimension keys a rule by a request attribute. With a Match, the rule
+// only applies to requests whose attribute equals it (for ip, lies in the
+// CIDR range).
+type LimitDimension struct {
+	Name  string
+	Match string
+}
+
+// String renders the rule as ParseLimitRules accepts it, e.g.
+// "tenant+model=gemini-2.5-pro:rpm=10,tpm=50000".
+func (r LimitRule) String() string {
+	dims := make([]string, len(r.Dimensions))
+	for i, d := range r.Dimensions {
+		dims[i] = d.Name
+		if d.Match != "" {
+			dims[i] += "=" + d.Match
+		}
+	}
+	var budgets []string
+	if r.RequestsPerMinute > 0 {
+		budgets = append(budgets, fmt.Sprintf("rpm=%d", r.RequestsPerMinute))
+	}
+	if r.TokensPerMinute > 0 {
+		budgets = append(budgets, fmt.Sprintf("tpm=%d", r.TokensPerMinute))
+	}
+	return strings.Join(dims, "+") + ":" + strings.Join(budgets, ",")
+}
+
+// Masked returns the rule with its tenant match, which is a client API key,
+// masked so that the rule can be logged or printed.
+func (r LimitRule) Masked() LimitRule {
+	dims := make([]LimitDimension, len(r.Dimensions))
+	for i, d := range r.Dimensions {
+		if d.Name == "tenant" && d.Match != "" {
+			d.Match = logger.MaskSecret(d.Match)
+		}
+		dims[i] = d
+	}
+	r.Dimensions = dims
+	return r
+}
+
+// ParseLimitRules parses rules separated by ';', such as
+// "ip:rpm=30;tenant:rpm=60,tpm=100000;tenant+model=gemini-2.5-pro:tpm=50000".
+func ParseLimitRules(value string) ([]LimitRule, error) {
+	var rules []LimitRule
+	for _, text := range strings.Split(value, ";") {
+		if text = strings.TrimSpace(text); text == "" {
+			continue
+		}
+		rule, err := parseLimitRule(text)
+		if err != nil {
+			return nil, fmt.Errorf("limit rule %q: %v", text, err)
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+func parseLimitRule(text string) (LimitRule, error) {
+	var rule LimitRule
+	dims, budgets, ok := strings.Cut(text, ":")
+	if !ok {
+		return rule, fmt.Errorf("expected dimensions:budgets")
+	}
+
+	seen := make(map[string]bool)
+	for _, dim := range strings.Split(dims, "+") {
+		name, match, _ := strings.Cut(strings.TrimSpace(dim), "=")
+		name, match = strings.TrimSpace(name), strings.TrimSpace(match)
+		if !isLimitDimension(name) {
+			return rule, fmt.Errorf("unknown dimension %q (use %s)", name, strings.Join(LimitDimensions, ", "))
+		}
+		if seen[name] {
+			return rule, fmt.Errorf("dimension %s given twice", name)
+		}
+		seen[name] = true
+		if name == "ip" && match != "" {
+			if _, err := ParseCIDR(match); err != nil {
+				return rule, err
+			}
+		}
+		rule.Dimensions = append(rule.Dimensions, LimitDimension{Name: name, Match: match})
+	}
+
+	for _, budget := range strings.Split(budgets, ",") {
+		name, n, _ := strings.Cut(strings.TrimSpace(budget), "=")
+		limit, err := strconv.Atoi(strings.TrimSpace(n))
+		if err != nil || limit <= 0 {
+			return rule, fmt.Errorf("budget %q is not a positive integer", strings.TrimSpace(budget))
+		}
+		switch strings.TrimSpace(name) {
+		case "rpm":
+			rule.RequestsPerMinute = limit
+		case "tpm":
+			rule.TokensPerMinute = limit
+		default:
+			return rule, fmt.Errorf("unknown budget %q (use rpm or tpm)", strings.TrimSpace(name))
+		}
+	}
+	return rule, nil
+}
+
+func formatLimitRules(rules []LimitRule) string {
+	texts := make([]string, len(rules))
+	for i, r := range rules {
+		texts[i] = r.String()
+	}
+	return strings.Join(texts, ";")
+}
+
+func isLimitDimension(name string) bool {
+	for _, d := range LimitDimensions {
+		if name == d {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDR parses a CIDR range, or a single IP address as a range holding
+// only that address.
+func ParseCIDR(value string) (*net.IPNet, error) {
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return nil, fmt.Errorf("%q is not an IP address or CIDR range", value)
+		}
+		if ip4 := ip.To4(); ip4 != nil {
+			ip = ip4
+		}
+		bits := 8 * len(ip)
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return nil, fmt.Errorf("%q is not an IP address or CIDR range", value)
+	}
+	return ipNet, nil
+}
+
+// ParseTenantWeight parses a concurrency queue weight such as "api-key=3".
+func ParseTenantWeight(item string) (tenant string, weight int, err error) {
+	i := strings.LastIndex(item, "=")
+	if i <= 0 {
+		return "", 0, fmt.Errorf("tenant weight %q must be written as tenant=weight", logger.MaskSecret(item))
+	}
+	tenant = strings.TrimSpace(item[:i])
+	weight, err = strconv.Atoi(strings.TrimSpace(item[i+1:]))
+	if err != nil || weight < 1 {
+		return "", 0, fmt.Errorf("tenant weight for %s must be a positive integer", logger.MaskSecret(tenant))
+	}
+	return tenant, weight, nil
+}
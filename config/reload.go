@@ -0,0 +1,111 @@
+package config
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"os"
+	"strings"
+	"time"
+)
+
+// restartSettings are the settings, by key or by section, that are only
+// read at startup. A reload leaves them unchanged.
+var restartSettings = []string{
+	"upstream.",
+	"server.port",
+	"server.unix_socket",
+	"server.tls_cert",
+	"server.tls_key",
+	"server.http2",
+	"server.h2c",
+	"server.read_header_timeout_ms",
+	"server.idle_timeout_ms",
+	"server.max_header_bytes",
+	"rate_limit.store",
+	"rate_limit.redis_addr",
+	"rate_limit.redis_password",
+	"rate_limit.redis_db",
+	"rate_limit.redis_timeout_ms",
+	"readiness.",
+	"admin.",
+	"circuit_breaker.",
+	"tracing.",
+	"recorder.",
+}
+
+// NeedsRestart reports whether the setting with the given key only takes
+// effect after a restart.
+func NeedsRestart(key string) bool {
+	for _, s := range restartSettings {
+		if key == s || (strings.HasSuffix(s, ".") && strings.HasPrefix(key, s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Changes compares two configurations and returns the keys of the settings
+// that differ, split into those a running proxy can apply and those that
+// need a restart.
+func Changes(current, next *Config) (reloadable, restart []string) {
+	for _, f := range fields {
+		if f.format(current) == f.format(next) {
+			continue
+		}
+		if NeedsRestart(f.key) {
+			restart = append(restart, f.key)
+		} else {
+			reloadable = append(reloadable, f.key)
+		}
+	}
+	return reloadable, restart
+}
+
+// KeepRestartSettings copies the settings that need a restart from current,
+// so that c describes what the running process actually uses.
+func (c *Config) KeepRestartSettings(current *Config) {
+	if c.sources == nil {
+		c.sources = make(map[string]string)
+	}
+	for _, f := range fields {
+		if !NeedsRestart(f.key) {
+			continue
+		}
+		f.value(c).Set(f.value(current))
+		if source, ok := current.sources[f.key]; ok {
+			c.sources[f.key] = source
+		} else {
+			delete(c.sources, f.key)
+		}
+	}
+}
+
+// WatchFile polls path every interval and calls onChange when its content
+// changes, until ctx is done. A file that cannot be read counts as changed
+// once, so the failed reload gets reported.
+func WatchFile(ctx context.Context, path string, interval time.Duration, onChange func()) {
+	last := fileDigest(path)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if digest := fileDigest(path); !bytes.Equal(digest, last) {
+				last = digest
+				onChange()
+			}
+		}
+	}
+}
+
+func fileDigest(path string) []byte {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	sum := sha256.Sum256(data)
+	return sum[:]
+}
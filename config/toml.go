@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+// parseTOML parses a TOML document into the config file tree.
+func parseTOML(data string) (map[string]interface{}, error) {
+	var doc map[string]interface{}
+	if _, err := toml.Decode(data, &doc); err != nil {
+		return nil, err
+	}
+	return tomlTree(doc).(map[string]interface{}), nil
+}
+
+// tomlTree converts decoded TOML values to the file tree form, turning
+// scalars back into strings.
+func tomlTree(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		tree := make(map[string]interface{}, len(value))
+		for name, item := range value {
+			tree[name] = tomlTree(item)
+		}
+		return tree
+	case []map[string]interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = tomlTree(item)
+		}
+		return list
+	case []interface{}:
+		list := make([]interface{}, len(value))
+		for i, item := range value {
+			list[i] = tomlTree(item)
+		}
+		return list
+	case string:
+		return value
+	case int64:
+		return strconv.FormatInt(value, 10)
+	case float64:
+		// Keep a decimal point so that integer settings reject 1.0.
+		text := strconv.FormatFloat(value, 'g', -1, 64)
+		if !strings.ContainsAny(text, ".eIN") {
+			text += ".0"
+		}
+		return text
+	case bool:
+		return strconv.FormatBool(value)
+	case time.Time:
+		return value.Format(time.RFC3339Nano)
+	default:
+		return fmt.Sprint(value)
+	}
+}
@@ -0,0 +1,228 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"gemini-antiblock/logger"
+)
+
+// interruptionReasons are the reasons streaming sessions report, accepted
+// in MODEL_FALLBACK_REASONS.
+var interruptionReasons = []string{"DROP", "BLOCK", "FINISH_DURING_THOUGHT", "FINISH_EMPTY_RESPONSE", "FINISH_ABNORMAL"}
+
+// validate checks value ranges and combinations of settings.
+func (c *Config) validate() []string {
+	v := &validator{cfg: c}
+
+	v.check("upstream.url_base", validURL(c.UpstreamURLBase), "must be an http or https URL")
+	if c.UpstreamProxy != "" {
+		u, err := url.Parse(c.UpstreamProxy)
+		v.check("upstream.proxy", err == nil && u.Host != "" &&
+			(u.Scheme == "http" || u.Scheme == "https" || u.Scheme == "socks5" || u.Scheme == "socks5h"),
+			"must be an http, https, socks5 or socks5h URL")
+	}
+	v.atLeast("upstream.dial_timeout_ms", int(c.UpstreamDialTimeoutMs.Milliseconds()), 0)
+	v.atLeast("upstream.tls_handshake_timeout_ms", int(c.UpstreamTLSHandshakeTimeoutMs.Milliseconds()), 0)
+	v.atLeast("upstream.response_header_timeout_ms", int(c.UpstreamResponseHeaderTimeoutMs.Milliseconds()), 0)
+	v.atLeast("upstream.stream_timeout_ms", int(c.UpstreamStreamTimeoutMs.Milliseconds()), 0)
+	v.atLeast("upstream.max_idle_conns", c.UpstreamMaxIdleConns, 0)
+	v.atLeast("upstream.max_idle_conns_per_host", c.UpstreamMaxIdleConnsPerHost, 0)
+	v.atLeast("upstream.max_conns_per_host", c.UpstreamMaxConnsPerHost, 0)
+	v.atLeast("upstream.idle_conn_timeout_ms", int(c.UpstreamIdleConnTimeoutMs.Milliseconds()), 0)
+	if c.UnixSocket == "" {
+		port, err := strconv.Atoi(c.Port)
+		v.check("server.port", err == nil && port > 0 && port < 65536, "must be a port number between 1 and 65535")
+	}
+	v.atLeast("server.drain_timeout_seconds", c.DrainTimeoutSeconds, 0)
+	v.check("server.tls_cert", (c.TLSCert == "") == (c.TLSKey == ""), "must be set together with server.tls_key")
+	v.check("server.h2c", !c.EnableH2C || c.TLSCert == "", "only applies without TLS; HTTP/2 over TLS is set by server.http2")
+	v.atLeast("server.read_header_timeout_ms", int(c.ReadHeaderTimeoutMs.Milliseconds()), 0)
+	v.atLeast("server.idle_timeout_ms", int(c.IdleTimeoutMs.Milliseconds()), 0)
+	v.atLeast("server.max_header_bytes", c.MaxHeaderBytes, 0)
+
+	v.oneOf("log.level", strings.ToLower(c.LogLevel), "debug", "info", "warn", "warning", "error")
+	v.oneOf("log.format", c.LogFormat, "text", "json")
+
+	v.atLeast("retry.max_consecutive_retries", c.MaxConsecutiveRetries, 0)
+	v.atLeast("retry.delay_ms", int(c.RetryDelayMs.Milliseconds()), 0)
+
+	v.check("prompt.injected", strings.Contains(c.InjectedPrompt, "[done]"), "must ask for the [done] token")
+
+	v.atLeast("rate_limit.count", c.RateLimitCount, 1)
+	v.atLeast("rate_limit.window_seconds", c.RateLimitWindowSeconds, 1)
+	v.atLeast("rate_limit.burst", c.RateLimitBurst, 0)
+	v.oneOf("rate_limit.mode", c.RateLimitMode, "wait", "reject")
+	v.atLeast("rate_limit.max_wait_ms", int(c.RateLimitMaxWaitMs.Milliseconds()), 0)
+	for _, proxy := range c.RateLimitTrustedProxies {
+		_, err := ParseCIDR(proxy)
+		v.check("rate_limit.trusted_proxies", err == nil, fmt.Sprint(err))
+	}
+	v.oneOf("rate_limit.store", c.RateLimitStore, "memory", "redis")
+	if c.RateLimitStore == "redis" {
+		v.check("rate_limit.redis_addr", c.RateLimitRedisAddr != "", "must be set when rate_limit.store is redis")
+		v.atLeast("rate_limit.redis_db", c.RateLimitRedisDB, 0)
+		v.atLeast("rate_limit.redis_timeout_ms", int(c.RateLimitRedisTimeoutMs.Milliseconds()), 1)
+	}
+
+	v.atLeast("concurrency.max_in_flight", c.ConcurrencyMaxInFlight, 0)
+	v.atLeast("concurrency.max_queue", c.ConcurrencyMaxQueue, 0)
+	v.atLeast("concurrency.queue_timeout_ms", int(c.ConcurrencyQueueTimeoutMs.Milliseconds()), 1)
+	for _, item := range c.ConcurrencyTenantWeights {
+		_, _, err := ParseTenantWeight(item)
+		v.check("concurrency.tenant_weights", err == nil, fmt.Sprint(err))
+	}
+
+	headerLists := []struct {
+		key      string
+		patterns []string
+	}{
+		{"headers.forward", c.ForwardHeaders},
+		{"headers.deny", c.DenyHeaders},
+		{"headers.response", c.ResponseHeaders},
+	}
+	for _, list := range headerLists {
+		for _, pattern := range list.patterns {
+			v.check(list.key, pattern == "*" || validHeaderName(strings.TrimSuffix(pattern, "*")),
+				fmt.Sprintf("%q is not a header name, optionally ending in *", pattern))
+		}
+	}
+	for _, item := range c.InjectHeaders {
+		name, _, ok := strings.Cut(item, ":")
+		v.check("headers.inject", ok && validHeaderName(strings.TrimSpace(name)), "entries must be written as Name: value")
+	}
+
+	for _, origin := range c.CORSAllowedOrigins {
+		v.check("cors.allowed_origins", origin == "*" || (strings.Count(origin, "*") <= 1 && strings.Contains(origin, "://")),
+			fmt.Sprintf("%q must be *, an origin such as https://app.example.com, or a pattern with one * such as https://*.example.com", origin))
+		if origin == "*" {
+			v.check("cors.allow_credentials", !c.CORSAllowCredentials, "requires cors.allowed_origins to list origins instead of *")
+		}
+	}
+	v.atLeast("cors.max_age_seconds", c.CORSMaxAgeSeconds, 0)
+
+	v.atLeast("readiness.probe_ttl_seconds", c.ReadinessProbeTTLSeconds, 0)
+	v.atLeast("readiness.probe_timeout_seconds", c.ReadinessProbeTimeoutSeconds, 1)
+
+	if c.EnableAdmin {
+		v.check("admin.addr", c.AdminAddr != "", "must be set when the admin server is enabled")
+		v.check("admin.tls_key", (c.AdminTLSCert == "") == (c.AdminTLSKey == ""), "must be set together with admin.tls_cert")
+		v.check("admin.client_ca", c.AdminClientCA == "" || c.AdminTLSCert != "", "requires admin.tls_cert and admin.tls_key")
+	}
+
+	v.atLeast("circuit_breaker.window_seconds", c.CircuitBreakerWindowSeconds, 1)
+	v.atLeast("circuit_breaker.min_requests", c.CircuitBreakerMinRequests, 1)
+	v.percent("circuit_breaker.error_rate_percent", c.CircuitBreakerErrorRatePercent, 1)
+	v.percent("circuit_breaker.interruption_rate_percent", c.CircuitBreakerInterruptionRatePercent, 1)
+	v.atLeast("circuit_breaker.open_seconds", c.CircuitBreakerOpenSeconds, 1)
+	v.atLeast("circuit_breaker.half_open_requests", c.CircuitBreakerHalfOpenRequests, 1)
+
+	for from := range c.ModelFallbacks {
+		seen := map[string]bool{from: true}
+		for model, ok := c.ModelFallbacks[from]; ok; model, ok = c.ModelFallbacks[model] {
+			if seen[model] {
+				v.fail("model_fallback.chains", fmt.Sprintf("fallback from %s loops back to %s", from, model))
+				break
+			}
+			seen[model] = true
+		}
+	}
+	v.atLeast("model_fallback.after", c.ModelFallbackAfter, 1)
+	for _, reason := range c.ModelFallbackReasons {
+		v.oneOf("model_fallback.reasons", reason, interruptionReasons...)
+	}
+
+	v.atLeast("hedging.delay_ms", int(c.HedgeDelayMs.Milliseconds()), 1)
+	v.atLeast("hedging.budget_per_minute", c.HedgeBudgetPerMinute, 0)
+
+	if c.EnableTracing {
+		v.check("tracing.otlp_endpoint", validURL(c.OTLPEndpoint), "must be an http or https URL")
+		v.check("tracing.service_name", c.TracingServiceName != "", "must not be empty")
+	}
+
+	if c.EnableRecorder {
+		v.check("recorder.path", c.RecorderPath != "", "must be set when the recorder is enabled")
+	}
+	v.atLeast("recorder.max_mb", c.RecorderMaxMB, 1)
+	v.atLeast("recorder.max_backups", c.RecorderMaxBackups, 0)
+	v.percent("recorder.sample_percent", c.RecorderSamplePercent, 0)
+
+	return v.problems
+}
+
+type validator struct {
+	cfg      *Config
+	problems []string
+}
+
+// fail records a problem with the setting, naming its source so the value
+// can be found.
+func (v *validator) fail(key, message string) {
+	f, _ := fieldByKey(key)
+	name := fmt.Sprintf("%s (%s)", key, f.env)
+	switch source := v.cfg.Source(key); source {
+	case SourceEnv:
+		name = f.env
+	case SourceFlag:
+		name = "-" + f.flag
+	case SourceDefault:
+	default:
+		name = fmt.Sprintf("%s: %s", source, key)
+	}
+	value := f.format(v.cfg)
+	if f.secretKeys {
+		value = strings.Join(maskKeys(f.value(v.cfg).Interface().([]string)), ",")
+	} else if f.secret && value != "" {
+		value = logger.MaskSecret(value)
+	}
+	v.problems = append(v.problems, fmt.Sprintf("%s=%s: %s", name, value, message))
+}
+
+func (v *validator) check(key string, ok bool, message string) {
+	if !ok {
+		v.fail(key, message)
+	}
+}
+
+func (v *validator) atLeast(key string, value, min int) {
+	switch {
+	case value >= min:
+	case min == 0:
+		v.fail(key, "must not be negative")
+	default:
+		v.fail(key, fmt.Sprintf("must be at least %d", min))
+	}
+}
+
+func (v *validator) percent(key string, value, min int) {
+	v.check(key, value >= min && value <= 100, fmt.Sprintf("must be between %d and 100", min))
+}
+
+func (v *validator) oneOf(key, value string, allowed ...string) {
+	for _, a := range allowed {
+		if value == a {
+			return
+		}
+	}
+	v.fail(key, fmt.Sprintf("%q is not one of %s", value, strings.Join(allowed, ", ")))
+}
+
+// validHeaderName reports whether name is a valid HTTP header field name.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, r := range name {
+		if r > 0x7e || r <= ' ' || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func validURL(value string) bool {
+	u, err := url.Parse(value)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseYAML parses a single YAML document into the config file tree.
+// Scalars keep the text they were written with, so "yes" stays a string
+// and is rejected by boolean settings just like in the environment.
+func parseYAML(data string) (map[string]interface{}, error) {
+	decoder := yaml.NewDecoder(strings.NewReader(data))
+	var doc yaml.Node
+	if err := decoder.Decode(&doc); err != nil {
+		if errors.Is(err, io.EOF) {
+			return map[string]interface{}{}, nil
+		}
+		return nil, err
+	}
+	var next yaml.Node
+	if err := decoder.Decode(&next); !errors.Is(err, io.EOF) {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("line %d: multiple documents are not supported", next.Line)
+	}
+
+	root := &doc
+	if root.Kind == yaml.DocumentNode {
+		if len(root.Content) == 0 {
+			return map[string]interface{}{}, nil
+		}
+		root = root.Content[0]
+	}
+	if root.Kind == yaml.ScalarNode && root.Tag == "!!null" {
+		return map[string]interface{}{}, nil
+	}
+	if root.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("line %d: the document must be a mapping", root.Line)
+	}
+	tree, err := yamlTree(root)
+	if err != nil {
+		return nil, err
+	}
+	return tree.(map[string]interface{}), nil
+}
+
+// yamlTree converts a YAML node to the file tree form.
+func yamlTree(node *yaml.Node) (interface{}, error) {
+	switch node.Kind {
+	case yaml.AliasNode:
+		return yamlTree(node.Alias)
+	case yaml.ScalarNode:
+		if node.Tag == "!!null" {
+			return nil, nil
+		}
+		return node.Value, nil
+	case yaml.SequenceNode:
+		list := make([]interface{}, len(node.Content))
+		for i, item := range node.Content {
+			value, err := yamlTree(item)
+			if err != nil {
+				return nil, err
+			}
+			list[i] = value
+		}
+		return list, nil
+	case yaml.MappingNode:
+		tree := make(map[string]interface{}, len(node.Content)/2)
+		for i := 0; i+1 < len(node.Content); i += 2 {
+			key, valueNode := node.Content[i], node.Content[i+1]
+			if key.Kind != yaml.ScalarNode {
+				return nil, fmt.Errorf("line %d: mapping keys must be plain values", key.Line)
+			}
+			if key.Value == "<<" {
+				return nil, fmt.Errorf("line %d: merge keys are not supported", key.Line)
+			}
+			if _, exists := tree[key.Value]; exists {
+				return nil, fmt.Errorf("line %d: key %q is already defined", key.Line, key.Value)
+			}
+			value, err := yamlTree(valueNode)
+			if err != nil {
+				return nil, err
+			}
+			tree[key.Value] = value
+		}
+		return tree, nil
+	default:
+		return nil, fmt.Errorf("line %d: unexpected YAML node", node.Line)
+	}
+}
@@ -1,8 +1,10 @@
 module gemini-antiblock
 
-go 1.21
+go 1.24
 
 require (
+	github.com/BurntSushi/toml v1.6.0
 	github.com/gorilla/mux v1.8.1
 	github.com/joho/godotenv v1.5.1
+	gopkg.in/yaml.v3 v3.0.1
 )
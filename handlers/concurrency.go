@@ -0,0 +1,247 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/metrics"
+)
+
+var (
+	// ErrQueueFull is returned by Acquire when the wait queue is full.
+	ErrQueueFull = errors.New("concurrency queue is full")
+	// ErrQueueTimeout is returned by Acquire when no slot became free
+	// within the queue timeout.
+	ErrQueueTimeout = errors.New("timed out waiting in the concurrency queue")
+)
+
+// ConcurrencyLimiter caps the number of streaming sessions in flight.
+// Sessions beyond the cap wait in a bounded queue that is served tenant by
+// tenant in weighted round-robin, so that a tenant with a burst of requests
+// cannot starve the others. A session holds its slot until it ends,
+// retries included.
+type ConcurrencyLimiter struct {
+	mu       sync.Mutex
+	max      int // 0 means no cap
+	maxQueue int
+	timeout  time.Duration
+	weights  map[string]int
+
+	inFlight int
+	queued   int
+	// tenants are the tenants with waiters, in round-robin order. The one
+	// at next is being served and may start credit more sessions before
+	// its turn passes.
+	tenants  []*tenantQueue
+	byTenant map[string]*tenantQueue
+	next     int
+	credit   int
+}
+
+type tenantQueue struct {
+	tenant  string
+	waiters []*queueWaiter
+}
+
+type queueWaiter struct {
+	ready   chan struct{} // closed when the waiter is given a slot
+	granted bool
+}
+
+// NewConcurrencyLimiter creates a limiter without a cap.
+func NewConcurrencyLimiter() *ConcurrencyLimiter {
+	return &ConcurrencyLimiter{byTenant: make(map[string]*tenantQueue)}
+}
+
+// SetConfig applies the concurrency settings. Raising the cap lets queued
+// sessions start at once; lowering it lets sessions in flight finish.
+func (l *ConcurrencyLimiter) SetConfig(cfg *config.Config) {
+	weights := make(map[string]int, len(cfg.ConcurrencyTenantWeights))
+	for _, item := range cfg.ConcurrencyTenantWeights {
+		if tenant, weight, err := config.ParseTenantWeight(item); err == nil {
+			weights[tenant] = weight
+		}
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = cfg.ConcurrencyMaxInFlight
+	l.maxQueue = cfg.ConcurrencyMaxQueue
+	l.timeout = cfg.ConcurrencyQueueTimeoutMs
+	l.weights = weights
+	l.dispatch()
+}
+
+// Acquire takes a slot for a session of tenant, queueing for one if all are
+// taken. It returns ErrQueueFull if the queue is full, ErrQueueTimeout if
+// no slot became free within the queue timeout, and ctx's error if ctx is
+// done first. Otherwise release must be called when the session ends.
+func (l *ConcurrencyLimiter) Acquire(ctx context.Context, tenant string) (release func(), err error) {
+	l.mu.Lock()
+	if l.max <= 0 || (l.inFlight < l.max && l.queued == 0) {
+		l.inFlight++
+		l.mu.Unlock()
+		return l.releaseFunc(), nil
+	}
+	if l.queued >= l.maxQueue {
+		l.mu.Unlock()
+		return nil, ErrQueueFull
+	}
+	w := l.enqueue(tenant)
+	timeout := l.timeout
+	l.mu.Unlock()
+
+	start := time.Now()
+	defer func() {
+		metrics.ConcurrencyQueueWait.Observe(time.Since(start).Seconds())
+	}()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-w.ready:
+		return l.releaseFunc(), nil
+	case <-timer.C:
+		err = ErrQueueTimeout
+	case <-ctx.Done():
+		err = ctx.Err()
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if w.granted {
+		// The slot was handed over just as the wait ended.
+		l.inFlight--
+		l.dispatch()
+	} else {
+		l.remove(tenant, w)
+	}
+	return nil, err
+}
+
+// InFlight returns the number of sessions holding a slot.
+func (l *ConcurrencyLimiter) InFlight() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.inFlight
+}
+
+// Queued returns the number of sessions waiting for a slot.
+func (l *ConcurrencyLimiter) Queued() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.queued
+}
+
+// RegisterMetrics exposes the sessions in flight and the queue depth as
+// gauges.
+func (l *ConcurrencyLimiter) RegisterMetrics(reg *metrics.Registry) {
+	metrics.NewGaugeFunc(reg, "gemini_antiblock_concurrency_in_flight",
+		"Streaming sessions holding a concurrency slot.",
+		func(emit func(value float64, labelValues ...string)) {
+			emit(float64(l.InFlight()))
+		})
+	metrics.NewGaugeFunc(reg, "gemini_antiblock_concurrency_queue_depth",
+		"Streaming sessions waiting for a concurrency slot.",
+		func(emit func(value float64, labelValues ...string)) {
+			emit(float64(l.Queued()))
+		})
+}
+
+func (l *ConcurrencyLimiter) releaseFunc() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			l.inFlight--
+			l.dispatch()
+		})
+	}
+}
+
+// enqueue adds a waiter for tenant. The caller must hold the mutex.
+func (l *ConcurrencyLimiter) enqueue(tenant string) *queueWaiter {
+	q := l.byTenant[tenant]
+	if q == nil {
+		q = &tenantQueue{tenant: tenant}
+		l.byTenant[tenant] = q
+		l.tenants = append(l.tenants, q)
+	}
+	w := &queueWaiter{ready: make(chan struct{})}
+	q.waiters = append(q.waiters, w)
+	l.queued++
+	return w
+}
+
+// remove takes a waiter that gave up out of the queue. The caller must hold
+// the mutex.
+func (l *ConcurrencyLimiter) remove(tenant string, w *queueWaiter) {
+	q := l.byTenant[tenant]
+	for i, other := range q.waiters {
+		if other == w {
+			q.waiters = append(q.waiters[:i], q.waiters[i+1:]...)
+			l.queued--
+			break
+		}
+	}
+	if len(q.waiters) == 0 {
+		l.dropTenant(q)
+	}
+}
+
+// dispatch hands free slots to waiters, taking up to weight waiters from
+// each tenant in turn. The caller must hold the mutex.
+func (l *ConcurrencyLimiter) dispatch() {
+	for l.queued > 0 && (l.max <= 0 || l.inFlight < l.max) {
+		if l.next >= len(l.tenants) {
+			l.next = 0
+		}
+		q := l.tenants[l.next]
+		if l.credit <= 0 {
+			l.credit = l.weight(q.tenant)
+		}
+		w := q.waiters[0]
+		q.waiters = q.waiters[1:]
+		l.queued--
+		l.inFlight++
+		w.granted = true
+		close(w.ready)
+
+		l.credit--
+		if len(q.waiters) == 0 {
+			l.dropTenant(q)
+		} else if l.credit == 0 {
+			l.next++
+		}
+	}
+}
+
+// dropTenant removes a tenant without waiters from the round-robin. The
+// caller must hold the mutex.
+func (l *ConcurrencyLimiter) dropTenant(q *tenantQueue) {
+	delete(l.byTenant, q.tenant)
+	for i, other := range l.tenants {
+		if other != q {
+			continue
+		}
+		l.tenants = append(l.tenants[:i], l.tenants[i+1:]...)
+		switch {
+		case i < l.next:
+			l.next--
+		case i == l.next:
+			// The turn passes to the tenant that moved into place.
+			l.credit = 0
+		}
+		return
+	}
+}
+
+func (l *ConcurrencyLimiter) weight(tenant string) int {
+	if weight, ok := l.weights[tenant]; ok {
+		return weight
+	}
+	return 1
+}
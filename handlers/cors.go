@@ -0,0 +1,131 @@
+package handlers
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+
+	"gemini-antiblock/config"
+)
+
+// CORSPolicy decides which browser origins may call the proxy and which
+// CORS headers they get.
+type CORSPolicy struct {
+	anyOrigin   bool
+	origins     []originPattern
+	methods     string
+	headers     string
+	exposed     string
+	credentials bool
+	maxAge      string
+}
+
+// originPattern matches an origin exactly, or with one wildcard between
+// prefix and suffix that stands for at least one character.
+type originPattern struct {
+	prefix   string
+	suffix   string
+	wildcard bool
+}
+
+// NewCORSPolicy creates the policy described by cfg.
+func NewCORSPolicy(cfg *config.Config) *CORSPolicy {
+	p := &CORSPolicy{
+		methods:     strings.Join(cfg.CORSAllowedMethods, ", "),
+		headers:     strings.Join(cfg.CORSAllowedHeaders, ", "),
+		exposed:     strings.Join(cfg.CORSExposedHeaders, ", "),
+		credentials: cfg.CORSAllowCredentials,
+	}
+	if cfg.CORSMaxAgeSeconds > 0 {
+		p.maxAge = strconv.Itoa(cfg.CORSMaxAgeSeconds)
+	}
+	for _, origin := range cfg.CORSAllowedOrigins {
+		origin = strings.ToLower(strings.TrimSuffix(origin, "/"))
+		if origin == "*" {
+			p.anyOrigin = true
+			continue
+		}
+		prefix, suffix, wildcard := strings.Cut(origin, "*")
+		p.origins = append(p.origins, originPattern{prefix: prefix, suffix: suffix, wildcard: wildcard})
+	}
+	return p
+}
+
+// AllowsOrigin reports whether a request from origin may read responses.
+func (p *CORSPolicy) AllowsOrigin(origin string) bool {
+	if origin == "" {
+		return false
+	}
+	if p.anyOrigin {
+		return true
+	}
+	origin = strings.ToLower(origin)
+	for _, pattern := range p.origins {
+		if pattern.matches(origin) {
+			return true
+		}
+	}
+	return false
+}
+
+func (o originPattern) matches(origin string) bool {
+	if !o.wildcard {
+		return origin == o.prefix
+	}
+	return len(origin) > len(o.prefix)+len(o.suffix) &&
+		strings.HasPrefix(origin, o.prefix) && strings.HasSuffix(origin, o.suffix)
+}
+
+// Apply sets the CORS headers for r on w. Preflight requests are answered
+// with 204, and Apply reports that they were. Requests from origins the
+// policy does not allow get no CORS headers, so browsers block them.
+func (p *CORSPolicy) Apply(w http.ResponseWriter, r *http.Request) (preflight bool) {
+	origin := r.Header.Get("Origin")
+	preflight = r.Method == http.MethodOptions && origin != "" && r.Header.Get("Access-Control-Request-Method") != ""
+
+	h := w.Header()
+	if !p.anyOrigin || p.credentials {
+		h.Add("Vary", "Origin")
+	}
+	if preflight {
+		h.Add("Vary", "Access-Control-Request-Method")
+		h.Add("Vary", "Access-Control-Request-Headers")
+	}
+	if p.AllowsOrigin(origin) {
+		if p.anyOrigin && !p.credentials {
+			h.Set("Access-Control-Allow-Origin", "*")
+		} else {
+			h.Set("Access-Control-Allow-Origin", origin)
+		}
+		if p.credentials {
+			h.Set("Access-Control-Allow-Credentials", "true")
+		}
+		if preflight {
+			h.Set("Access-Control-Allow-Methods", p.methods)
+			h.Set("Access-Control-Allow-Headers", p.headers)
+			if p.maxAge != "" {
+				h.Set("Access-Control-Max-Age", p.maxAge)
+			}
+		} else if p.exposed != "" {
+			h.Set("Access-Control-Expose-Headers", p.exposed)
+		}
+	}
+	if preflight {
+		w.WriteHeader(http.StatusNoContent)
+	}
+	return preflight
+}
+
+// CORSMiddleware applies the policy returned by policy to every request,
+// answering preflight requests itself. policy is called per request so that
+// a reloaded configuration takes effect at once.
+func CORSMiddleware(policy func() *CORSPolicy) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if policy().Apply(w, r) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
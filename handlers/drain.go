@@ -0,0 +1,109 @@
+package handlers
+
+import (
+	"context"
+	"sync"
+)
+
+// Drainer coordinates graceful shutdown of streaming sessions. Once draining
+// starts, new sessions are refused while active ones may run to completion;
+// aborting tells the remaining ones to end with an error event.
+type Drainer struct {
+	mu       sync.Mutex
+	draining bool
+	active   int
+	idle     chan struct{}
+	abort    chan struct{}
+}
+
+// NewDrainer creates a drainer that is accepting sessions.
+func NewDrainer() *Drainer {
+	return &Drainer{
+		idle:  make(chan struct{}),
+		abort: make(chan struct{}),
+	}
+}
+
+// Track registers a session. It returns false if the drainer is draining;
+// otherwise done must be called when the session ends.
+func (d *Drainer) Track() (done func(), ok bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.draining {
+		return nil, false
+	}
+	d.active++
+
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			d.mu.Lock()
+			defer d.mu.Unlock()
+			d.active--
+			d.checkIdle()
+		})
+	}, true
+}
+
+// Start begins draining. It is safe to call more than once.
+func (d *Drainer) Start() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.draining = true
+	d.checkIdle()
+}
+
+// checkIdle signals Wait once draining has started and no sessions remain.
+// The caller must hold d.mu.
+func (d *Drainer) checkIdle() {
+	if !d.draining || d.active > 0 {
+		return
+	}
+	select {
+	case <-d.idle:
+	default:
+		close(d.idle)
+	}
+}
+
+// Draining reports whether draining has started.
+func (d *Drainer) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.draining
+}
+
+// Active returns the number of sessions in progress.
+func (d *Drainer) Active() int {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.active
+}
+
+// Abort tells the remaining sessions to stop. It is safe to call more than
+// once.
+func (d *Drainer) Abort() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	select {
+	case <-d.abort:
+	default:
+		close(d.abort)
+	}
+}
+
+// Aborted is closed when Abort is called.
+func (d *Drainer) Aborted() <-chan struct{} {
+	return d.abort
+}
+
+// Wait blocks until draining has started and every session has ended, or
+// ctx is done.
+func (d *Drainer) Wait(ctx context.Context) error {
+	select {
+	case <-d.idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
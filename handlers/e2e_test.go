@@ -0,0 +1,1801 @@
+package handlers_test
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/pem"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httputil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gemini-antiblock/admin"
+	"gemini-antiblock/config"
+	"gemini-antiblock/handlers"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/mock-server/scenario"
+	"gemini-antiblock/ratelimit"
+	"gemini-antiblock/ratelimit/fakeredis"
+)
+
+// These tests run the proxy against the mock server's scenario engine, both
+// in-process, and assert on the exact bytes a client receives.
+
+const doneLine = `data: {"candidates": [{"content": {"parts": [{"text": "[done]"}]}}]}`
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logger.Configure(logger.Options{Level: "error", Output: io.Discard})
+	}
+	os.Exit(m.Run())
+}
+
+type harness struct {
+	upstream *scenario.Server
+	handler  *handlers.ProxyHandler
+	proxy    *httptest.Server
+
+	mu              sync.Mutex
+	upstreamHeaders []http.Header // received by the upstream, in order
+	upstreamPaths   []string
+	// upstreamCancelled counts upstream requests the proxy abandoned
+	// before the mock finished answering them.
+	upstreamCancelled int
+}
+
+// newHarness starts the mock upstream with the built-in scenarios plus
+// extra, all without chunk delays, and a proxy in front of it.
+func newHarness(t *testing.T, configure func(*config.Config), extra ...*scenario.Scenario) *harness {
+	t.Helper()
+
+	scenarios := scenario.Builtin()
+	for _, sc := range extra {
+		if err := scenarios.Add(sc); err != nil {
+			t.Fatalf("invalid scenario: %v", err)
+		}
+	}
+	for _, sc := range scenarios {
+		sc.DelayMs, sc.JitterMs = 0, 0
+	}
+	h := &harness{upstream: scenario.NewServer(scenarios, "type-1")}
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		h.mu.Lock()
+		h.upstreamHeaders = append(h.upstreamHeaders, r.Header.Clone())
+		h.upstreamPaths = append(h.upstreamPaths, r.URL.Path)
+		h.mu.Unlock()
+		h.upstream.ServeHTTP(w, r)
+		if r.Context().Err() != nil {
+			h.mu.Lock()
+			h.upstreamCancelled++
+			h.mu.Unlock()
+		}
+	}))
+	t.Cleanup(upstream.Close)
+
+	cfg := &config.Config{
+		UpstreamURLBase:           upstream.URL,
+		MaxConsecutiveRetries:     3,
+		RetryDelayMs:              0,
+		SwallowThoughtsAfterRetry: true,
+		ForwardHeaders:            config.Defaults().ForwardHeaders,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+	handler, err := handlers.NewProxyHandler(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.handler = handler
+	h.proxy = httptest.NewServer(handlers.CORSMiddleware(h.handler.CORSPolicy)(h.handler))
+	t.Cleanup(h.proxy.Close)
+
+	return h
+}
+
+// received returns the headers of every upstream request so far.
+func (h *harness) received() []http.Header {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]http.Header(nil), h.upstreamHeaders...)
+}
+
+// paths returns the path of every upstream request so far.
+func (h *harness) paths() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.upstreamPaths...)
+}
+
+// cancelled returns how many upstream requests were cancelled so far.
+func (h *harness) cancelled() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.upstreamCancelled
+}
+
+// waitUntil polls cond until it holds, failing the test after two seconds.
+func waitUntil(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+// requestBody is unique per test so conversations never share attempt counts.
+func requestBody(t *testing.T) string {
+	return fmt.Sprintf(`{"contents":[{"role":"user","parts":[{"text":%q}]}]}`, t.Name())
+}
+
+// stream sends a streaming request routed to the named scenario.
+func (h *harness) stream(t *testing.T, scenarioName string) (*http.Response, string) {
+	t.Helper()
+	url := fmt.Sprintf("%s/%s/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", h.proxy.URL, scenarioName)
+	return h.post(t, url)
+}
+
+func (h *harness) post(t *testing.T, url string) (*http.Response, string) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodPost, url, strings.NewReader(requestBody(t)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Goog-Api-Key", "test-key")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatalf("request failed: %v", err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatalf("reading response: %v", err)
+	}
+	return resp, string(body)
+}
+
+// attempts returns how many upstream requests the test's conversation made.
+func (h *harness) attempts(t *testing.T, scenarioName string) int {
+	return h.upstream.Attempts(scenario.ConversationKey(scenarioName, http.Header{}, []byte(requestBody(t))))
+}
+
+// text renders a mock text chunk exactly as the mock server encodes it.
+func text(s string) string {
+	return fmt.Sprintf(`data: {"candidates":[{"content":{"parts":[{"text":%q}],"role":"model"}}]}`, s)
+}
+
+func thought(s string) string {
+	return fmt.Sprintf(`data: {"candidates":[{"content":{"parts":[{"text":%q,"thought":true}],"role":"model"}}]}`, s)
+}
+
+func final(s, finishReason string) string {
+	return fmt.Sprintf(`data: {"candidates":[{"content":{"parts":[{"text":%q}],"role":"model"},"finishReason":%q}]}`, s, finishReason)
+}
+
+// sse joins lines into the event stream the client receives.
+func sse(lines ...string) string {
+	return strings.Join(lines, "\n\n") + "\n\n"
+}
+
+func assertOutput(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("client output mismatch\n got: %q\nwant: %q", got, want)
+	}
+}
+
+func TestStreamCleanCompletion(t *testing.T) {
+	h := newHarness(t, nil)
+	resp, body := h.stream(t, "type-1")
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200", resp.StatusCode)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	assertOutput(t, body, sse(
+		thought("Let me think about this question..."),
+		thought("I need to consider multiple aspects of this problem."),
+		text("Based on your question, I can provide the following response:\n\n"),
+		text("This is a mock response that simulates a streaming API. "),
+		text("The response is being delivered in chunks with random delays. "),
+		text("This particular test case (Case 1) includes thinking parts but "),
+		text("deliberately does not include a [done] marker at the end. "),
+		text("This helps test scenarios where the stream might be interrupted "),
+		final("before completion.", "STOP"),
+		doneLine,
+	))
+	if n := h.attempts(t, "type-1"); n != 1 {
+		t.Errorf("upstream attempts = %d, want 1", n)
+	}
+}
+
+func TestDoneTokenStripping(t *testing.T) {
+	h := newHarness(t, nil, &scenario.Scenario{
+		Name: "done-token",
+		Attempts: []scenario.Attempt{{Steps: []scenario.Step{
+			{Text: "All finished "},
+			{Text: "now.[done]", FinishReason: "STOP"},
+		}}},
+	})
+
+	t.Run("whole token", func(t *testing.T) {
+		_, body := h.stream(t, "done-token")
+		assertOutput(t, body, sse(
+			text("All finished "),
+			final("now.", "STOP"),
+			doneLine,
+		))
+	})
+
+	t.Run("split across chunks", func(t *testing.T) {
+		// "[do" could be the start of the sentinel, so it is held back and
+		// dropped once "ne]" completes it.
+		_, body := h.stream(t, "type-2")
+		assertOutput(t, body, sse(
+			thought("Analyzing the request and preparing response..."),
+			text("This is test case 2, which demonstrates splitting the [done] marker. "),
+			text("The response will be delivered normally, but the final [done] token "),
+			text("will be split across multiple chunks to test the proxy's ability "),
+			text("to handle partial markers. "),
+			text("Here comes the content ending with a split done marker: "),
+			text(""),
+			final("", "STOP"),
+			doneLine,
+		))
+	})
+}
+
+func TestInterruptionReasonsAreRetried(t *testing.T) {
+	succeed := scenario.Attempt{Steps: []scenario.Step{{Text: "Recovered.", FinishReason: "STOP"}}}
+
+	tests := []struct {
+		reason string
+		first  []scenario.Step
+		want   string
+	}{
+		{
+			reason: "DROP",
+			first:  []scenario.Step{{Text: "Partial "}, {Disconnect: true}},
+			want:   sse(text("Partial "), final("Recovered.", "STOP"), doneLine),
+		},
+		{
+			reason: "BLOCK",
+			first:  []scenario.Step{{Text: "Partial "}, {BlockReason: "SAFETY"}},
+			want:   sse(text("Partial "), final("Recovered.", "STOP"), doneLine),
+		},
+		{
+			reason: "FINISH_DURING_THOUGHT",
+			first:  []scenario.Step{{Text: "Hmm", Thought: true, FinishReason: "STOP"}},
+			want:   sse(final("Recovered.", "STOP"), doneLine),
+		},
+		{
+			reason: "FINISH_EMPTY_RESPONSE",
+			first:  []scenario.Step{{FinishReason: "STOP"}},
+			want:   sse(final("Recovered.", "STOP"), doneLine),
+		},
+		{
+			reason: "FINISH_ABNORMAL",
+			first:  []scenario.Step{{Text: "Partial "}, {FinishReason: "RECITATION"}},
+			want:   sse(text("Partial "), final("Recovered.", "STOP"), doneLine),
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.reason, func(t *testing.T) {
+			name := strings.ToLower(strings.ReplaceAll(tt.reason, "_", "-"))
+			h := newHarness(t, nil, &scenario.Scenario{
+				Name:     name,
+				Attempts: []scenario.Attempt{{Steps: tt.first}, succeed},
+			})
+
+			resp, body := h.stream(t, name)
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("status = %d, want 200", resp.StatusCode)
+			}
+			assertOutput(t, body, tt.want)
+			if n := h.attempts(t, name); n != 2 {
+				t.Errorf("upstream attempts = %d, want 2", n)
+			}
+		})
+	}
+}
+
+func TestSwallowModeAfterRetry(t *testing.T) {
+	h := newHarness(t, nil, &scenario.Scenario{
+		Name: "swallow",
+		Attempts: []scenario.Attempt{
+			{Steps: []scenario.Step{
+				{Text: "Planning", Thought: true},
+				{Text: "The answer is "},
+				{Disconnect: true},
+			}},
+			{Steps: []scenario.Step{
+				{Text: "Re-planning from scratch", Thought: true},
+				{Text: "forty-two."},
+				{Text: "Late thought", Thought: true},
+				{Text: "", FinishReason: "STOP"},
+			}},
+		},
+	})
+
+	// The thought before the first formal text is forwarded. After the
+	// retry, thoughts are swallowed until formal text resumes; later
+	// thoughts pass through again.
+	_, body := h.stream(t, "swallow")
+	assertOutput(t, body, sse(
+		thought("Planning"),
+		text("The answer is "),
+		text("forty-two."),
+		thought("Late thought"),
+		final("", "STOP"),
+		doneLine,
+	))
+
+	t.Run("disabled", func(t *testing.T) {
+		h := newHarness(t, func(cfg *config.Config) { cfg.SwallowThoughtsAfterRetry = false }, h.upstreamScenario(t, "swallow"))
+		_, body := h.stream(t, "swallow")
+		assertOutput(t, body, sse(
+			thought("Planning"),
+			text("The answer is "),
+			thought("Re-planning from scratch"),
+			text("forty-two."),
+			thought("Late thought"),
+			final("", "STOP"),
+			doneLine,
+		))
+	})
+}
+
+// upstreamScenario returns a scenario by name from the built-in set or the
+// scenarios a harness was created with.
+func (h *harness) upstreamScenario(t *testing.T, name string) *scenario.Scenario {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/"+name+"/", nil)
+	sc, ok := h.upstream.Select(req)
+	if !ok || sc.Name != name {
+		t.Fatalf("scenario %s not found", name)
+	}
+	return sc
+}
+
+func TestRetryLimitErrorEvent(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) { cfg.MaxConsecutiveRetries = 2 })
+
+	resp, body := h.stream(t, "type-3")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("status = %d, want 200 (errors after the stream started are sent as events)", resp.StatusCode)
+	}
+	assertOutput(t, body, "event: error\n"+
+		`data: {"error":{"code":504,"details":[{"@type":"proxy.debug","accumulated_text_chars":0}],`+
+		`"message":"Retry limit (2) exceeded after stream interruption. Last reason: FINISH_EMPTY_RESPONSE.",`+
+		`"status":"DEADLINE_EXCEEDED"}}`+"\n\n")
+	if n := h.attempts(t, "type-3"); n != 3 {
+		t.Errorf("upstream attempts = %d, want 3", n)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	breakerConfig := func(errorRate, interruptionRate int) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.EnableCircuitBreaker = true
+			cfg.CircuitBreakerWindowSeconds = 60
+			cfg.CircuitBreakerMinRequests = 2
+			cfg.CircuitBreakerErrorRatePercent = errorRate
+			cfg.CircuitBreakerInterruptionRatePercent = interruptionRate
+			cfg.CircuitBreakerOpenSeconds = 60
+			cfg.CircuitBreakerHalfOpenRequests = 1
+		}
+	}
+	unavailable := &scenario.Scenario{
+		Name:     "unavailable",
+		Attempts: []scenario.Attempt{{Status: http.StatusServiceUnavailable, Message: "The model is overloaded."}},
+	}
+
+	t.Run("fails fast while open", func(t *testing.T) {
+		h := newHarness(t, breakerConfig(50, 0), unavailable)
+		for i := 0; i < 2; i++ {
+			if resp, _ := h.stream(t, "unavailable"); resp.StatusCode != http.StatusServiceUnavailable {
+				t.Fatalf("request %d: status = %d, want the upstream's 503", i+1, resp.StatusCode)
+			}
+		}
+
+		resp, body := h.stream(t, "unavailable")
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", resp.StatusCode)
+		}
+		assertOutput(t, body, `{"error":{"code":503,"message":"Upstream is temporarily unavailable",`+
+			`"status":"UNAVAILABLE","details":"Circuit breaker is open for the upstream server"}}`+"\n")
+		if n := h.attempts(t, "unavailable"); n != 2 {
+			t.Errorf("upstream attempts = %d, want 2 (none while open)", n)
+		}
+		if got := h.handler.Breakers.Snapshots()[h.handler.Config().UpstreamURLBase].State; got != "open" {
+			t.Errorf("breaker state = %q, want open", got)
+		}
+	})
+
+	t.Run("sessions in flight stop retrying", func(t *testing.T) {
+		h := newHarness(t, breakerConfig(0, 50))
+		// The first drop alone is below the minimum; the retry and its drop
+		// reach it and trip the breaker before the session retries again.
+		resp, body := h.stream(t, "drop-block-succeed")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		assertOutput(t, body, sse(
+			thought("Thinking about the answer..."),
+			text("The first part of the answer "),
+			text("continues here, "),
+			"event: error\n"+
+				`data: {"error":{"code":503,"details":[{"@type":"proxy.debug","accumulated_text_chars":45}],`+
+				`"message":"Upstream circuit breaker is open; retries abandoned after stream interruption. Last reason: DROP.",`+
+				`"status":"UNAVAILABLE"}}`,
+		))
+		if n := h.attempts(t, "drop-block-succeed"); n != 2 {
+			t.Errorf("upstream attempts = %d, want 2", n)
+		}
+	})
+
+	t.Run("failed retries are not stream interruptions", func(t *testing.T) {
+		h := newHarness(t, breakerConfig(100, 100), &scenario.Scenario{
+			Name: "drop-unavailable-succeed",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{Text: "Hello"}, {Disconnect: true}}},
+				{Status: http.StatusServiceUnavailable, Message: "The model is overloaded."},
+				{Steps: []scenario.Step{{Text: " world", FinishReason: "STOP"}}},
+			},
+		})
+		drops := metrics.StreamInterruptions.Value("DROP")
+		resp, body := h.stream(t, "drop-unavailable-succeed")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		assertOutput(t, body, sse(text("Hello"), final(" world", "STOP"), doneLine))
+		if n := h.attempts(t, "drop-unavailable-succeed"); n != 3 {
+			t.Errorf("upstream attempts = %d, want 3", n)
+		}
+		if n := metrics.StreamInterruptions.Value("DROP") - drops; n != 1 {
+			t.Errorf("DROP interruptions = %v, want 1", n)
+		}
+		snap := h.handler.Breakers.Snapshots()[h.handler.Config().UpstreamURLBase]
+		if snap.Failures != 1 || snap.Streams != 2 || snap.Interruptions != 1 {
+			t.Errorf("breaker recorded %d failures and %d of %d streams interrupted, want 1 and 1 of 2",
+				snap.Failures, snap.Interruptions, snap.Streams)
+		}
+	})
+}
+
+func TestModelFallback(t *testing.T) {
+	fallbackConfig := func(reasons ...string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.ModelFallbacks = map[string]string{"gemini-pro": "gemini-flash"}
+			cfg.ModelFallbackAfter = 1
+			cfg.ModelFallbackReasons = reasons
+		}
+	}
+	blockThenAnswer := &scenario.Scenario{
+		Name: "block-then-answer",
+		Attempts: []scenario.Attempt{
+			{Steps: []scenario.Step{{BlockReason: "SAFETY"}}},
+			{Steps: []scenario.Step{{Text: "The answer.", FinishReason: "STOP"}}},
+		},
+	}
+
+	t.Run("streaming", func(t *testing.T) {
+		h := newHarness(t, fallbackConfig("DROP"))
+		resp, body := h.stream(t, "drop-block-succeed")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		comment := ": model-fallback from=gemini-pro to=gemini-flash reason=DROP\n\n"
+		if !strings.HasPrefix(body, sse(thought("Thinking about the answer..."), text("The first part of the answer "))+comment) {
+			t.Errorf("the fallback comment does not follow the dropped attempt:\n%s", body)
+		}
+		if !strings.Contains(body, text("and finally finishes.")) {
+			t.Errorf("the session did not complete:\n%s", body)
+		}
+		paths := h.paths()
+		if len(paths) != 4 {
+			t.Fatalf("upstream paths = %q, want 4 attempts", paths)
+		}
+		for i, path := range paths {
+			want := "/drop-block-succeed/v1beta/models/gemini-flash:streamGenerateContent"
+			if i == 0 {
+				want = "/drop-block-succeed/v1beta/models/gemini-pro:streamGenerateContent"
+			}
+			if path != want {
+				t.Errorf("attempt %d path = %s, want %s", i+1, path, want)
+			}
+		}
+	})
+
+	t.Run("no switch without a retry", func(t *testing.T) {
+		h := newHarness(t, func(cfg *config.Config) {
+			fallbackConfig("DROP")(cfg)
+			cfg.MaxConsecutiveRetries = 0
+		})
+		_, body := h.stream(t, "drop-block-succeed")
+		if strings.Contains(body, "model-fallback") {
+			t.Errorf("the client was told of a switch no attempt followed:\n%s", body)
+		}
+		if !strings.Contains(body, `"code":504`) {
+			t.Errorf("the session did not end at the retry limit:\n%s", body)
+		}
+		if paths := h.paths(); len(paths) != 1 {
+			t.Errorf("upstream paths = %q, want only the initial attempt", paths)
+		}
+	})
+
+	t.Run("non-streaming", func(t *testing.T) {
+		h := newHarness(t, fallbackConfig("BLOCK"), blockThenAnswer)
+		resp, body := h.post(t, h.proxy.URL+"/block-then-answer/v1beta/models/gemini-pro:generateContent")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Antiblock-Model-Fallback"); got != "gemini-pro>gemini-flash" {
+			t.Errorf("fallback header = %q, want gemini-pro>gemini-flash", got)
+		}
+		if !strings.Contains(body, "The answer.") {
+			t.Errorf("body = %s, want the fallback model's answer", body)
+		}
+		if paths := h.paths(); len(paths) != 2 || paths[1] != "/block-then-answer/v1beta/models/gemini-flash:generateContent" {
+			t.Errorf("upstream paths = %q, want a retry on gemini-flash", paths)
+		}
+	})
+
+	t.Run("non-streaming client gone cancels the fallback", func(t *testing.T) {
+		h := newHarness(t, fallbackConfig("BLOCK"), &scenario.Scenario{
+			Name: "block-then-stall",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{BlockReason: "SAFETY"}}},
+				{HeaderDelayMs: 30000, Steps: []scenario.Step{{Text: "Too late.", FinishReason: "STOP"}}},
+			},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		url := h.proxy.URL + "/block-then-stall/v1beta/models/gemini-pro:generateContent"
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(requestBody(t)))
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			if resp, err := http.DefaultClient.Do(req); err == nil {
+				resp.Body.Close()
+			}
+		}()
+
+		waitUntil(t, "the fallback request is sent", func() bool { return len(h.paths()) == 2 })
+		cancel()
+		<-done
+		waitUntil(t, "the fallback request is cancelled", func() bool { return h.cancelled() == 1 })
+	})
+
+	t.Run("countTokens passes through", func(t *testing.T) {
+		h := newHarness(t, fallbackConfig("BLOCK", "FINISH_EMPTY_RESPONSE"), blockThenAnswer)
+		resp, body := h.post(t, h.proxy.URL+"/block-then-answer/v1beta/models/gemini-pro:countTokens")
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-Antiblock-Model-Fallback"); got != "" {
+			t.Errorf("fallback header = %q, want none", got)
+		}
+		if !strings.Contains(body, `"blockReason":"SAFETY"`) {
+			t.Errorf("body = %s, want the upstream response unchanged", body)
+		}
+		if n := h.attempts(t, "block-then-answer"); n != 1 {
+			t.Errorf("upstream attempts = %d, want 1", n)
+		}
+	})
+}
+
+func TestRequestMetricsModelLabel(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.MetricsModels = []string{"gemini-pro"}
+		cfg.ModelFallbacks = map[string]string{"gemini-ultra": "gemini-flash"}
+	})
+	for _, tc := range []struct{ model, label string }{
+		{"gemini-pro", "gemini-pro"},
+		{"gemini-flash", "gemini-flash"},
+		{"made-up-model-1", "other"},
+		{"made-up-model-2", "other"},
+	} {
+		before := metrics.RequestsTotal.Value("streaming", tc.label, "200")
+		url := fmt.Sprintf("%s/type-1/v1beta/models/%s:streamGenerateContent?alt=sse", h.proxy.URL, tc.model)
+		if resp, _ := h.post(t, url); resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: status = %d, want 200", tc.model, resp.StatusCode)
+		}
+		if n := metrics.RequestsTotal.Value("streaming", tc.label, "200") - before; n != 1 {
+			t.Errorf("%s: requests counted as model %q = %v, want 1", tc.model, tc.label, n)
+		}
+	}
+	if n := metrics.RequestsTotal.Value("streaming", "made-up-model-1", "200"); n != 0 {
+		t.Errorf("an unknown model got its own series")
+	}
+}
+
+func TestHedging(t *testing.T) {
+	hedged := func(perMinute int) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.EnableHedging = true
+			cfg.HedgeDelayMs = 50 * time.Millisecond
+			cfg.HedgeBudgetPerMinute = perMinute
+		}
+	}
+	// streamAs sends a streaming request with the given API key.
+	streamAs := func(t *testing.T, h *harness, scenarioName, apiKey string) int {
+		url := fmt.Sprintf("%s/%s/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", h.proxy.URL, scenarioName)
+		req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(requestBody(t)))
+		req.Header.Set("X-Goog-Api-Key", apiKey)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("hedge wins and the loser is cancelled", func(t *testing.T) {
+		h := newHarness(t, hedged(10), &scenario.Scenario{
+			Name: "slow-first",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{StallSeconds: 30}, {Text: "Too late.", FinishReason: "STOP"}}},
+				{Steps: []scenario.Step{{Text: "The hedge answers.", FinishReason: "STOP"}}},
+			},
+		})
+		var logs bytes.Buffer
+		logger.Configure(logger.Options{Level: "info", Format: "json", Output: &logs})
+		resp, body := h.stream(t, "slow-first")
+		logger.Configure(logger.Options{Level: "error", Output: io.Discard})
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		assertOutput(t, body, sse(final("The hedge answers.", "STOP"), doneLine))
+		logged := false
+		for _, line := range strings.Split(logs.String(), "\n") {
+			if strings.Contains(line, "Hedge request won the race") {
+				logged = true
+				if !strings.Contains(line, `"request_id":"`+resp.Header.Get("X-Request-Id")+`"`) {
+					t.Errorf("hedge decision logged without the request ID: %s", line)
+				}
+			}
+		}
+		if !logged {
+			t.Error("the hedge decision was not logged")
+		}
+		if n := h.attempts(t, "slow-first"); n != 2 {
+			t.Errorf("upstream attempts = %d, want 2", n)
+		}
+		waitUntil(t, "the stalled request is cancelled", func() bool { return h.cancelled() == 1 })
+	})
+
+	t.Run("budget per tenant", func(t *testing.T) {
+		h := newHarness(t, hedged(1), &scenario.Scenario{
+			Name: "slow-start",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{StallSeconds: 0.2}, {Text: "Done.", FinishReason: "STOP"}}},
+			},
+		})
+		for i, tc := range []struct {
+			apiKey   string
+			requests int
+		}{
+			{"tenant-a", 2},
+			{"tenant-a", 1}, // tenant-a's budget is spent
+			{"tenant-b", 2},
+		} {
+			before := len(h.paths())
+			if code := streamAs(t, h, "slow-start", tc.apiKey); code != http.StatusOK {
+				t.Fatalf("request %d: status = %d, want 200", i+1, code)
+			}
+			if n := len(h.paths()) - before; n != tc.requests {
+				t.Errorf("request %d from %s made %d upstream requests, want %d", i+1, tc.apiKey, n, tc.requests)
+			}
+		}
+	})
+
+	t.Run("client gone during a hedged retry", func(t *testing.T) {
+		h := newHarness(t, hedged(10), &scenario.Scenario{
+			Name: "drop-then-stall",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{Text: "Hello"}, {Disconnect: true}}},
+				{Steps: []scenario.Step{{StallSeconds: 30}, {Text: " world", FinishReason: "STOP"}}},
+			},
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		url := h.proxy.URL + "/drop-then-stall/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(requestBody(t)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+
+		// The retry and its hedge both stall until the client goes away.
+		waitUntil(t, "the retry is hedged", func() bool { return len(h.paths()) == 3 })
+		cancel()
+		waitUntil(t, "both racing requests are cancelled", func() bool { return h.cancelled() == 2 })
+	})
+}
+
+func TestConfigReloadKeepsSessionSnapshot(t *testing.T) {
+	h := newHarness(t, nil, &scenario.Scenario{
+		Name: "slow-drop",
+		Attempts: []scenario.Attempt{
+			{Steps: []scenario.Step{
+				{Text: "The answer is "},
+				{StallSeconds: 0.2},
+				{Disconnect: true},
+			}},
+			{Steps: []scenario.Step{
+				{Text: "forty-two.", FinishReason: "STOP"},
+			}},
+		},
+	})
+
+	url := h.proxy.URL + "/slow-drop/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(requestBody(t)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if first, err := reader.ReadString('\n'); err != nil || first != text("The answer is ")+"\n" {
+		t.Fatalf("first line = %q, %v", first, err)
+	}
+
+	// Retries are disabled while the first session is running. It keeps
+	// the limit it started with and recovers from the drop.
+	reloaded := *h.handler.Config()
+	reloaded.MaxConsecutiveRetries = 0
+	h.handler.SetConfig(&reloaded)
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading rest of stream: %v", err)
+	}
+	assertOutput(t, text("The answer is ")+"\n"+string(rest), sse(
+		text("The answer is "),
+		final("forty-two.", "STOP"),
+		doneLine,
+	))
+
+	// A new session uses the reloaded limit.
+	t.Run("new session", func(t *testing.T) {
+		_, body := h.stream(t, "slow-drop")
+		if !strings.Contains(body, "Retry limit (0) exceeded") {
+			t.Errorf("stream with reloaded config = %q, want the retry limit error", body)
+		}
+	})
+}
+
+func TestInitialErrorPassthrough(t *testing.T) {
+	h := newHarness(t, nil, &scenario.Scenario{
+		Name:     "unavailable",
+		Attempts: []scenario.Attempt{{Status: http.StatusServiceUnavailable, Message: "The model is overloaded."}},
+	})
+
+	t.Run("rate limited", func(t *testing.T) {
+		resp, body := h.stream(t, "rate-limited")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want 429", resp.StatusCode)
+		}
+		assertOutput(t, body, `{"error":{"code":429,"message":"Resource has been exhausted (e.g. check quota).","status":"RESOURCE_EXHAUSTED"}}`+"\n")
+		if n := h.attempts(t, "rate-limited"); n != 1 {
+			t.Errorf("upstream attempts = %d, want 1 (initial errors are not retried)", n)
+		}
+	})
+
+	t.Run("unavailable", func(t *testing.T) {
+		resp, body := h.stream(t, "unavailable")
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", resp.StatusCode)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json; charset=utf-8" {
+			t.Errorf("Content-Type = %q", ct)
+		}
+		assertOutput(t, body, `{"error":{"code":503,"message":"The model is overloaded.","status":"UNAVAILABLE"}}`+"\n")
+	})
+
+	t.Run("non-streaming", func(t *testing.T) {
+		resp, body := h.post(t, h.proxy.URL+"/unavailable/v1beta/models/gemini-pro:generateContent")
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", resp.StatusCode)
+		}
+		assertOutput(t, body, `{"error":{"code":503,"message":"The model is overloaded.","status":"UNAVAILABLE"}}`+"\n")
+	})
+}
+
+func TestRateLimit(t *testing.T) {
+	limited := func(mode string, count, windowSeconds, burst int, maxWait time.Duration) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.EnableRateLimit = true
+			cfg.RateLimitMode = mode
+			cfg.RateLimitCount = count
+			cfg.RateLimitWindowSeconds = windowSeconds
+			cfg.RateLimitBurst = burst
+			cfg.RateLimitMaxWaitMs = maxWait
+		}
+	}
+
+	t.Run("reject", func(t *testing.T) {
+		h := newHarness(t, limited("reject", 2, 60, 0, 0))
+		for i := 0; i < 2; i++ {
+			resp, _ := h.stream(t, "type-1")
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("request %d: status = %d, want 200", i+1, resp.StatusCode)
+			}
+			if got, want := resp.Header.Get("X-RateLimit-Remaining"), strconv.Itoa(1-i); got != want {
+				t.Errorf("request %d: X-RateLimit-Remaining = %q, want %q", i+1, got, want)
+			}
+		}
+
+		resp, body := h.stream(t, "type-1")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want 429", resp.StatusCode)
+		}
+		assertOutput(t, body, `{"error":{"code":429,"message":"Rate limit exceeded","status":"RESOURCE_EXHAUSTED","details":"Retry after 30 seconds"}}`+"\n")
+		wantHeaders := map[string]string{
+			"Retry-After":           "30",
+			"X-RateLimit-Limit":     "2",
+			"X-RateLimit-Remaining": "0",
+			"X-RateLimit-Reset":     "60",
+		}
+		for name, want := range wantHeaders {
+			if got := resp.Header.Get(name); got != want {
+				t.Errorf("%s = %q, want %q", name, got, want)
+			}
+		}
+	})
+
+	t.Run("wait", func(t *testing.T) {
+		h := newHarness(t, limited("wait", 10, 1, 1, time.Second))
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("request %d: status = %d, want 200", i+1, resp.StatusCode)
+			}
+		}
+		if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+			t.Errorf("three requests with a burst of 1 at 10/s took %v, want at least 200ms", elapsed)
+		}
+	})
+
+	t.Run("wait longer than max", func(t *testing.T) {
+		h := newHarness(t, limited("wait", 1, 60, 0, time.Second))
+		h.stream(t, "type-1")
+		resp, _ := h.stream(t, "type-1")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("status = %d, want 429", resp.StatusCode)
+		}
+		if got := resp.Header.Get("Retry-After"); got != "60" {
+			t.Errorf("Retry-After = %q, want 60", got)
+		}
+	})
+
+	t.Run("keyless clients are limited by ip", func(t *testing.T) {
+		h := newHarness(t, limited("reject", 1, 60, 0, 0))
+		url := h.proxy.URL + "/type-1/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+		for i, want := range []int{http.StatusOK, http.StatusTooManyRequests} {
+			resp, err := http.Post(url, "application/json", strings.NewReader(requestBody(t)))
+			if err != nil {
+				t.Fatal(err)
+			}
+			io.Copy(io.Discard, resp.Body)
+			resp.Body.Close()
+			if resp.StatusCode != want {
+				t.Errorf("keyless request %d: status = %d, want %d", i+1, resp.StatusCode, want)
+			}
+		}
+		if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+			t.Errorf("request with a key: status = %d, want 200 (keyed separately)", resp.StatusCode)
+		}
+	})
+
+	t.Run("client gone while waiting", func(t *testing.T) {
+		h := newHarness(t, limited("wait", 1, 60, 0, time.Minute))
+		h.stream(t, "type-1")
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		req := httptest.NewRequest(http.MethodPost, "/type-1/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", strings.NewReader(requestBody(t))).WithContext(ctx)
+		req.Header.Set("X-Goog-Api-Key", "test-key")
+		done := make(chan struct{})
+		go func() {
+			h.handler.ServeHTTP(httptest.NewRecorder(), req)
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(2 * time.Second):
+			t.Fatal("handler kept waiting after the client went away")
+		}
+		if n := h.attempts(t, "type-1"); n != 1 {
+			t.Errorf("upstream attempts = %d, want 1", n)
+		}
+	})
+}
+
+func TestRateLimitRules(t *testing.T) {
+	rules := func(rules string, trusted ...string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.EnableRateLimit = true
+			cfg.RateLimitMode = "reject"
+			cfg.RateLimitTrustedProxies = trusted
+			var err error
+			if cfg.RateLimitRules, err = config.ParseLimitRules(rules); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// keyless sends a streaming request without an API key, as forwarded
+	// for the given client.
+	keyless := func(t *testing.T, h *harness, forwardedFor string) int {
+		req, _ := http.NewRequest(http.MethodPost, h.proxy.URL+"/type-1/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", strings.NewReader(requestBody(t)))
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("client ip from trusted proxy", func(t *testing.T) {
+		h := newHarness(t, rules("ip:rpm=1", "127.0.0.0/8"))
+		if code := keyless(t, h, "198.51.100.7, 203.0.113.5"); code != http.StatusOK {
+			t.Fatalf("first request: status = %d, want 200", code)
+		}
+		if code := keyless(t, h, "203.0.113.5"); code != http.StatusTooManyRequests {
+			t.Errorf("same client: status = %d, want 429", code)
+		}
+		if code := keyless(t, h, "203.0.113.6"); code != http.StatusOK {
+			t.Errorf("other client: status = %d, want 200", code)
+		}
+	})
+
+	t.Run("untrusted forwarded for", func(t *testing.T) {
+		h := newHarness(t, rules("ip:rpm=1", "10.0.0.0/8"))
+		keyless(t, h, "203.0.113.5")
+		if code := keyless(t, h, "203.0.113.6"); code != http.StatusTooManyRequests {
+			t.Errorf("spoofed X-Forwarded-For: status = %d, want 429", code)
+		}
+	})
+
+	t.Run("model match", func(t *testing.T) {
+		h := newHarness(t, rules("tenant+model=gemini-flash:rpm=1"))
+		for i := 0; i < 2; i++ {
+			if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+				t.Fatalf("other model: status = %d, want 200", resp.StatusCode)
+			}
+		}
+	})
+
+	t.Run("retries count against requests", func(t *testing.T) {
+		h := newHarness(t, rules("tenant:rpm=3"), &scenario.Scenario{
+			Name: "drop-twice",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{Text: "Hello"}}},
+				{Steps: []scenario.Step{{Text: "Hello"}}},
+				{Steps: []scenario.Step{{Text: "Hello", FinishReason: "STOP"}}},
+			},
+		})
+		if resp, _ := h.stream(t, "drop-twice"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusTooManyRequests {
+			t.Errorf("after a request and two retries: status = %d, want 429", resp.StatusCode)
+		}
+	})
+
+	t.Run("tokens from every attempt", func(t *testing.T) {
+		h := newHarness(t, rules("tenant:rpm=100,tpm=100"), &scenario.Scenario{
+			Name: "usage",
+			Attempts: []scenario.Attempt{
+				{Steps: []scenario.Step{{Text: "Hello", TotalTokens: 60}}},
+				{Steps: []scenario.Step{{Text: " world", TotalTokens: 30}, {FinishReason: "STOP", TotalTokens: 50}}},
+			},
+		})
+		if resp, _ := h.stream(t, "usage"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("status = %d, want 200", resp.StatusCode)
+		}
+		resp, _ := h.stream(t, "type-1")
+		if resp.StatusCode != http.StatusTooManyRequests {
+			t.Fatalf("after 110 tokens: status = %d, want 429", resp.StatusCode)
+		}
+		if got := resp.Header.Get("X-RateLimit-Limit"); got != "100" {
+			t.Errorf("X-RateLimit-Limit = %q, want the token budget 100", got)
+		}
+	})
+}
+
+func TestRateLimitSharedStore(t *testing.T) {
+	server, err := fakeredis.NewServer("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	// replica starts a proxy keeping its buckets in the shared server.
+	replica := func() *harness {
+		h := newHarness(t, func(cfg *config.Config) {
+			cfg.EnableRateLimit = true
+			cfg.RateLimitMode = "reject"
+			cfg.RateLimitCount = 2
+			cfg.RateLimitWindowSeconds = 60
+		})
+		redisStore := ratelimit.NewRedisStore(ratelimit.RedisOptions{Addr: server.Addr(), Password: "secret", Timeout: time.Second})
+		t.Cleanup(func() { redisStore.Close() })
+		h.handler.RateLimits.SetStore(ratelimit.NewFallbackStore(redisStore, ratelimit.NewMemoryStore()))
+		return h
+	}
+	a, b := replica(), replica()
+
+	if resp, _ := a.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+		t.Fatalf("replica a: status = %d, want 200", resp.StatusCode)
+	}
+	resp, _ := b.stream(t, "type-1")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("replica b: status = %d, want 200", resp.StatusCode)
+	}
+	if got := resp.Header.Get("X-RateLimit-Remaining"); got != "0" {
+		t.Errorf("replica b: X-RateLimit-Remaining = %q, want 0", got)
+	}
+	if resp, _ := a.stream(t, "type-1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("replica a after the shared budget is spent: status = %d, want 429", resp.StatusCode)
+	}
+
+	// Without the store, each replica falls back to its own buckets.
+	server.SetDown(true)
+	for i := 0; i < 2; i++ {
+		if resp, _ := a.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+			t.Fatalf("store down, request %d: status = %d, want 200", i+1, resp.StatusCode)
+		}
+	}
+	if resp, _ := a.stream(t, "type-1"); resp.StatusCode != http.StatusTooManyRequests {
+		t.Errorf("store down, local budget spent: status = %d, want 429", resp.StatusCode)
+	}
+}
+
+func TestHeaderForwarding(t *testing.T) {
+	h := newHarness(t, func(cfg *config.Config) {
+		cfg.ForwardHeaders = append(cfg.ForwardHeaders, "X-Trace-*")
+		cfg.DenyHeaders = []string{"X-Trace-Internal"}
+		cfg.InjectHeaders = []string{"X-Goog-User-Project: billing-project"}
+		cfg.ResponseHeaders = []string{"Server-Timing", "X-Goog-*"}
+	}, &scenario.Scenario{
+		Name: "drop-with-headers",
+		Attempts: []scenario.Attempt{
+			{
+				Headers: map[string]string{"Server-Timing": "gfet4t7; dur=120", "X-Goog-Safety": "ok", "X-Other": "hidden"},
+				Steps:   []scenario.Step{{Text: "Hello"}},
+			},
+			{Steps: []scenario.Step{{Text: " world", FinishReason: "STOP"}}},
+		},
+	})
+
+	// Lowercase names as an HTTP/2 client sends them, set without
+	// canonicalization.
+	req, _ := http.NewRequest(http.MethodPost, h.proxy.URL+"/drop-with-headers/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", strings.NewReader(requestBody(t)))
+	for name, value := range map[string]string{
+		"x-goog-api-key":      "test-key",
+		"x-goog-api-client":   "genai-js/1.0",
+		"x-goog-user-project": "client-project",
+		"x-server-timeout":    "30",
+		"x-trace-session":     "abc",
+		"x-trace-internal":    "secret",
+		"cookie":              "session=1",
+	} {
+		req.Header[name] = []string{value}
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+
+	received := h.received()
+	if len(received) != 2 {
+		t.Fatalf("upstream received %d requests, want the initial one and a retry", len(received))
+	}
+	want := map[string]string{
+		"X-Goog-Api-Key":      "test-key",
+		"X-Goog-Api-Client":   "genai-js/1.0",
+		"X-Goog-User-Project": "billing-project",
+		"X-Server-Timeout":    "30",
+		"X-Trace-Session":     "abc",
+		"X-Trace-Internal":    "",
+		"Cookie":              "",
+	}
+	for i, headers := range received {
+		for name, value := range want {
+			if got := headers.Get(name); got != value {
+				t.Errorf("upstream request %d: %s = %q, want %q", i+1, name, got, value)
+			}
+		}
+	}
+
+	for name, value := range map[string]string{
+		"Server-Timing": "gfet4t7; dur=120",
+		"X-Goog-Safety": "ok",
+		"X-Other":       "",
+		"Content-Type":  "text/event-stream; charset=utf-8",
+	} {
+		if got := resp.Header.Get(name); got != value {
+			t.Errorf("client response %s = %q, want %q", name, got, value)
+		}
+	}
+}
+
+func TestUpstreamTransport(t *testing.T) {
+	slow := []*scenario.Scenario{
+		{
+			Name:     "slow-headers",
+			Attempts: []scenario.Attempt{{HeaderDelayMs: 2000, Steps: []scenario.Step{{Text: "late", FinishReason: "STOP"}}}},
+		},
+		{
+			Name: "slow-stream",
+			Attempts: []scenario.Attempt{{Steps: []scenario.Step{
+				{Text: "Hello"},
+				{StallSeconds: 0.3},
+				{Text: " world", FinishReason: "STOP"},
+			}}},
+		},
+	}
+
+	// serve starts another proxy with cfg, for settings that only apply
+	// when the upstream client is created.
+	serve := func(t *testing.T, cfg config.Config) *httptest.Server {
+		t.Helper()
+		handler, err := handlers.NewProxyHandler(&cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		proxy := httptest.NewServer(handler)
+		t.Cleanup(proxy.Close)
+		return proxy
+	}
+
+	t.Run("outbound proxy", func(t *testing.T) {
+		var mu sync.Mutex
+		var proxied []string
+		forward := httptest.NewServer(&httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				mu.Lock()
+				proxied = append(proxied, r.In.URL.Host)
+				mu.Unlock()
+				r.Out.URL = r.In.URL
+			},
+			FlushInterval: -1,
+		})
+		defer forward.Close()
+
+		h := newHarness(t, func(cfg *config.Config) { cfg.UpstreamProxy = forward.URL })
+		_, body := h.stream(t, "drop-block-succeed")
+		if !strings.Contains(body, `"finishReason":"STOP"`) {
+			t.Fatalf("stream did not complete: %q", body)
+		}
+		upstreamHost := strings.TrimPrefix(h.handler.Config().UpstreamURLBase, "http://")
+		mu.Lock()
+		defer mu.Unlock()
+		if n := h.attempts(t, "drop-block-succeed"); len(proxied) != n || n < 2 {
+			t.Errorf("%d of %d upstream requests went through the proxy, want all of at least 2", len(proxied), n)
+		}
+		for _, host := range proxied {
+			if host != upstreamHost {
+				t.Errorf("proxied a request for %s, want %s", host, upstreamHost)
+			}
+		}
+	})
+
+	t.Run("custom CA", func(t *testing.T) {
+		h := newHarness(t, nil)
+		upstream := httptest.NewTLSServer(h.upstream)
+		defer upstream.Close()
+		caFile := filepath.Join(t.TempDir(), "ca.pem")
+		ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: upstream.Certificate().Raw})
+		if err := os.WriteFile(caFile, ca, 0o600); err != nil {
+			t.Fatal(err)
+		}
+
+		cfg := *h.handler.Config()
+		cfg.UpstreamURLBase = upstream.URL
+		h.proxy = serve(t, cfg)
+		if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status without the CA = %d, want 502", resp.StatusCode)
+		}
+
+		cfg.UpstreamCAFile = caFile
+		h.proxy = serve(t, cfg)
+		if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusOK {
+			t.Errorf("status with the CA = %d, want 200", resp.StatusCode)
+		}
+
+		cfg.UpstreamCAFile = filepath.Join(t.TempDir(), "missing.pem")
+		if _, err := handlers.NewProxyHandler(&cfg); err == nil {
+			t.Error("created a proxy with a missing CA file")
+		}
+	})
+
+	t.Run("timeouts", func(t *testing.T) {
+		h := newHarness(t, func(cfg *config.Config) {
+			cfg.UpstreamResponseHeaderTimeoutMs = 100 * time.Millisecond
+		}, slow...)
+
+		start := time.Now()
+		if resp, _ := h.stream(t, "slow-headers"); resp.StatusCode != http.StatusBadGateway {
+			t.Errorf("status for late response headers = %d, want 502", resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Errorf("late response headers took %v to fail", elapsed)
+		}
+
+		// The response header timeout does not limit the stream.
+		_, body := h.stream(t, "slow-stream")
+		assertOutput(t, body, sse(text("Hello"), final(" world", "STOP"), doneLine))
+		if n := h.attempts(t, "slow-stream"); n != 1 {
+			t.Errorf("upstream attempts = %d, want 1", n)
+		}
+	})
+}
+
+func TestCORS(t *testing.T) {
+	cors := func(credentials bool, origins ...string) func(*config.Config) {
+		return func(cfg *config.Config) {
+			defaults := config.Defaults()
+			cfg.CORSAllowedOrigins = origins
+			cfg.CORSAllowedMethods = defaults.CORSAllowedMethods
+			cfg.CORSAllowedHeaders = defaults.CORSAllowedHeaders
+			cfg.CORSExposedHeaders = []string{"X-Request-Id", "Retry-After"}
+			cfg.CORSAllowCredentials = credentials
+			cfg.CORSMaxAgeSeconds = 600
+		}
+	}
+	preflight := func(t *testing.T, h *harness, origin string) *http.Response {
+		req, _ := http.NewRequest(http.MethodOptions, h.proxy.URL+"/v1beta/models/gemini-pro:streamGenerateContent", nil)
+		req.Header.Set("Origin", origin)
+		req.Header.Set("Access-Control-Request-Method", "POST")
+		req.Header.Set("Access-Control-Request-Headers", "content-type, x-goog-api-key, x-goog-api-client")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNoContent {
+			t.Fatalf("preflight status = %d, want 204", resp.StatusCode)
+		}
+		return resp
+	}
+	// get sends a request from origin to an upstream scenario.
+	get := func(t *testing.T, h *harness, origin, scenarioName string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, h.proxy.URL+"/"+scenarioName+"/v1beta/models/gemini-pro:streamGenerateContent?alt=sse", strings.NewReader(requestBody(t)))
+		req.Header.Set("Origin", origin)
+		req.Header.Set("X-Goog-Api-Key", "test-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+		return resp
+	}
+	assertHeaders := func(t *testing.T, what string, resp *http.Response, want map[string]string) {
+		t.Helper()
+		for name, value := range want {
+			if got := resp.Header.Get(name); got != value {
+				t.Errorf("%s %s = %q, want %q", what, name, got, value)
+			}
+		}
+	}
+
+	t.Run("any origin", func(t *testing.T) {
+		h := newHarness(t, cors(false, "*"))
+		assertHeaders(t, "preflight", preflight(t, h, "https://app.example.com"), map[string]string{
+			"Access-Control-Allow-Origin":      "*",
+			"Access-Control-Allow-Methods":     "GET, POST, OPTIONS",
+			"Access-Control-Allow-Headers":     "Content-Type, Authorization, X-Goog-Api-Key, X-Goog-Api-Client, X-Goog-User-Project",
+			"Access-Control-Max-Age":           "600",
+			"Access-Control-Allow-Credentials": "",
+		})
+		assertHeaders(t, "stream", get(t, h, "https://app.example.com", "type-1"), map[string]string{
+			"Access-Control-Allow-Origin":   "*",
+			"Access-Control-Expose-Headers": "X-Request-Id, Retry-After",
+		})
+		assertHeaders(t, "error", get(t, h, "https://app.example.com", "rate-limited"), map[string]string{
+			"Access-Control-Allow-Origin": "*",
+		})
+		assertHeaders(t, "request without Origin", get(t, h, "", "type-1"), map[string]string{
+			"Access-Control-Allow-Origin": "",
+		})
+	})
+
+	t.Run("listed origins with credentials", func(t *testing.T) {
+		h := newHarness(t, cors(true, "https://app.example.com", "https://*.example.org"))
+		assertHeaders(t, "preflight", preflight(t, h, "https://app.example.com"), map[string]string{
+			"Access-Control-Allow-Origin":      "https://app.example.com",
+			"Access-Control-Allow-Credentials": "true",
+		})
+		resp := get(t, h, "https://eu.example.org", "type-1")
+		assertHeaders(t, "wildcard origin", resp, map[string]string{
+			"Access-Control-Allow-Origin":      "https://eu.example.org",
+			"Access-Control-Allow-Credentials": "true",
+			"Vary":                             "Origin",
+		})
+
+		for _, origin := range []string{"https://evil.example.com", "https://example.org", "http://eu.example.org"} {
+			assertHeaders(t, origin+" preflight", preflight(t, h, origin), map[string]string{
+				"Access-Control-Allow-Origin":  "",
+				"Access-Control-Allow-Methods": "",
+			})
+			assertHeaders(t, origin, get(t, h, origin, "type-1"), map[string]string{
+				"Access-Control-Allow-Origin":      "",
+				"Access-Control-Allow-Credentials": "",
+			})
+		}
+	})
+}
+
+func TestConcurrencyLimit(t *testing.T) {
+	limited := func(maxQueue int, queueTimeout time.Duration) func(*config.Config) {
+		return func(cfg *config.Config) {
+			cfg.ConcurrencyMaxInFlight = 1
+			cfg.ConcurrencyMaxQueue = maxQueue
+			cfg.ConcurrencyQueueTimeoutMs = queueTimeout
+		}
+	}
+	// hold drops its first attempt and stalls in the second before
+	// finishing, keeping its session in flight across a retry.
+	hold := &scenario.Scenario{
+		Name: "hold",
+		Attempts: []scenario.Attempt{
+			{Steps: []scenario.Step{{Text: "Hello"}}},
+			{Steps: []scenario.Step{{Text: " world"}, {StallSeconds: 0.5}, {Text: "[done]", FinishReason: "STOP"}}},
+		},
+	}
+	// holding starts a hold session and waits until it has its slot.
+	holding := func(t *testing.T, h *harness) <-chan int {
+		status := make(chan int, 1)
+		go func() {
+			resp, _ := h.stream(t, "hold")
+			status <- resp.StatusCode
+		}()
+		for h.handler.Concurrency.InFlight() == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		return status
+	}
+
+	t.Run("queue timeout", func(t *testing.T) {
+		h := newHarness(t, limited(10, 100*time.Millisecond), hold)
+		held := holding(t, h)
+
+		start := time.Now()
+		resp, body := h.stream(t, "type-1")
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("status = %d, want 503", resp.StatusCode)
+		}
+		if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+			t.Errorf("rejected after %v, want after the 100ms queue timeout", elapsed)
+		}
+		assertOutput(t, body, `{"error":{"code":503,"message":"Too many concurrent requests","status":"UNAVAILABLE","details":"No streaming slot became free within 100 ms"}}`+"\n")
+
+		if code := <-held; code != http.StatusOK {
+			t.Errorf("held session: status = %d, want 200", code)
+		}
+		if n := h.attempts(t, "hold"); n != 2 {
+			t.Errorf("held session made %d upstream attempts, want 2", n)
+		}
+	})
+
+	t.Run("queue full", func(t *testing.T) {
+		h := newHarness(t, limited(0, time.Minute), hold)
+		held := holding(t, h)
+		if resp, _ := h.stream(t, "type-1"); resp.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("status = %d, want 503", resp.StatusCode)
+		}
+		<-held
+	})
+
+	t.Run("queued until the session ends", func(t *testing.T) {
+		h := newHarness(t, limited(10, time.Minute), hold)
+		held := holding(t, h)
+		queued := make(chan int, 1)
+		go func() {
+			resp, _ := h.stream(t, "type-1")
+			queued <- resp.StatusCode
+		}()
+		for h.handler.Concurrency.Queued() == 0 {
+			time.Sleep(5 * time.Millisecond)
+		}
+		// The held session retries while the other request waits.
+		select {
+		case code := <-queued:
+			t.Fatalf("queued request finished with %d before the held session", code)
+		case code := <-held:
+			if code != http.StatusOK {
+				t.Errorf("held session: status = %d, want 200", code)
+			}
+		}
+		if code := <-queued; code != http.StatusOK {
+			t.Errorf("queued request: status = %d, want 200", code)
+		}
+	})
+
+	t.Run("client gone releases the slot", func(t *testing.T) {
+		h := newHarness(t, limited(10, time.Minute))
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		url := h.proxy.URL + "/stall/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+		req, _ := http.NewRequestWithContext(ctx, http.MethodPost, url, strings.NewReader(requestBody(t)))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if _, err := bufio.NewReader(resp.Body).ReadString('\n'); err != nil {
+			t.Fatal(err)
+		}
+
+		queued := make(chan int, 1)
+		go func() {
+			resp, _ := h.stream(t, "type-1")
+			queued <- resp.StatusCode
+		}()
+		waitUntil(t, "a request is queued", func() bool { return h.handler.Concurrency.Queued() == 1 })
+
+		// The stalled session gives up its slot as soon as its client leaves.
+		cancel()
+		select {
+		case code := <-queued:
+			if code != http.StatusOK {
+				t.Errorf("queued request: status = %d, want 200", code)
+			}
+		case <-time.After(2 * time.Second):
+			t.Fatal("queued request still waiting after the slot holder went away")
+		}
+		waitUntil(t, "no session is in flight", func() bool { return h.handler.Concurrency.InFlight() == 0 })
+	})
+}
+
+func TestConcurrencyFairQueue(t *testing.T) {
+	cfg := config.Defaults()
+	cfg.ConcurrencyMaxInFlight = 1
+	cfg.ConcurrencyTenantWeights = []string{"a=2"}
+	limiter := handlers.NewConcurrencyLimiter()
+	limiter.SetConfig(cfg)
+
+	release, err := limiter.Acquire(context.Background(), "a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	started := make(chan string, 5)
+	for i, tenant := range []string{"a", "a", "a", "b", "b"} {
+		go func(tenant string) {
+			release, err := limiter.Acquire(context.Background(), tenant)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			started <- tenant
+			release()
+		}(tenant)
+		for limiter.Queued() <= i {
+			time.Sleep(time.Millisecond)
+		}
+	}
+
+	release()
+	var order string
+	for i := 0; i < 5; i++ {
+		order += <-started
+	}
+	if order != "aabab" {
+		t.Errorf("tenants served in order %s, want aabab", order)
+	}
+}
+
+func TestShutdownDrain(t *testing.T) {
+	h := newHarness(t, nil)
+
+	// A stream stalled mid-answer is still running when draining starts.
+	url := h.proxy.URL + "/stall/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(requestBody(t)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	first, err := reader.ReadString('\n')
+	if err != nil || first != text("Starting the answer, ")+"\n" {
+		t.Fatalf("first line = %q, %v", first, err)
+	}
+
+	h.handler.Drainer.Start()
+	if got := h.handler.Drainer.Active(); got != 1 {
+		t.Fatalf("active streams = %d, want 1", got)
+	}
+
+	rejected, body := h.stream(t, "type-1")
+	if rejected.StatusCode != http.StatusServiceUnavailable || !strings.Contains(body, `"UNAVAILABLE"`) {
+		t.Errorf("request while draining: status %d, body %s", rejected.StatusCode, body)
+	}
+
+	ready := httptest.NewRecorder()
+	handlers.NewReadinessHandler(handlers.DrainCheck(h.handler.Drainer))(ready, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	if ready.Code != http.StatusServiceUnavailable || !strings.Contains(ready.Body.String(), `"status":"draining"`) {
+		t.Errorf("readiness while draining: status %d, body %s", ready.Code, ready.Body.String())
+	}
+
+	h.handler.Drainer.Abort()
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading rest of stream: %v", err)
+	}
+	if !strings.HasPrefix(string(rest), "\nevent: error\ndata: ") || !strings.Contains(string(rest), `"status":"UNAVAILABLE"`) {
+		t.Errorf("stream after abort = %q, want an UNAVAILABLE error event", rest)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := h.handler.Drainer.Wait(ctx); err != nil {
+		t.Errorf("Wait: %v", err)
+	}
+}
+
+func TestAdminSessions(t *testing.T) {
+	h := newHarness(t, nil)
+	adminServer := httptest.NewServer(admin.Handler("admin-token", h.handler.Sessions, http.NotFoundHandler()))
+	t.Cleanup(adminServer.Close)
+
+	adminRequest := func(method, path, token string) (int, string) {
+		t.Helper()
+		req, _ := http.NewRequest(method, adminServer.URL+path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, string(body)
+	}
+
+	if status, _ := adminRequest(http.MethodGet, "/admin/sessions", ""); status != http.StatusUnauthorized {
+		t.Errorf("without token: status %d, want 401", status)
+	}
+	if status, _ := adminRequest(http.MethodGet, "/admin/sessions", "wrong"); status != http.StatusUnauthorized {
+		t.Errorf("with wrong token: status %d, want 401", status)
+	}
+	noScheme, _ := http.NewRequest(http.MethodGet, adminServer.URL+"/admin/sessions", nil)
+	noScheme.Header.Set("Authorization", "admin-token")
+	noSchemeResp, err := http.DefaultClient.Do(noScheme)
+	if err != nil {
+		t.Fatal(err)
+	}
+	noSchemeResp.Body.Close()
+	if noSchemeResp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("token without the Bearer scheme: status %d, want 401", noSchemeResp.StatusCode)
+	}
+
+	url := h.proxy.URL + "/stall/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+	req, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(requestBody(t)))
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	reader := bufio.NewReader(resp.Body)
+	if first, err := reader.ReadString('\n'); err != nil || first != text("Starting the answer, ")+"\n" {
+		t.Fatalf("first line = %q, %v", first, err)
+	}
+
+	status, body := adminRequest(http.MethodGet, "/admin/sessions", "admin-token")
+	var list struct {
+		Count    int                    `json:"count"`
+		Sessions []handlers.SessionInfo `json:"sessions"`
+	}
+	if err := json.Unmarshal([]byte(body), &list); status != http.StatusOK || err != nil {
+		t.Fatalf("list: status %d, body %s, %v", status, body, err)
+	}
+	if list.Count != 1 {
+		t.Fatalf("listed %d sessions, want 1: %s", list.Count, body)
+	}
+	session := list.Sessions[0]
+	if session.State != "streaming" || session.Attempt != 1 || session.Model != "gemini-pro" ||
+		session.AccumulatedChars != len("Starting the answer, ") || session.SwallowMode {
+		t.Errorf("session = %+v", session)
+	}
+
+	if status, _ := adminRequest(http.MethodPost, "/admin/sessions/unknown/cancel", "admin-token"); status != http.StatusNotFound {
+		t.Errorf("cancel unknown session: status %d, want 404", status)
+	}
+	if status, body := adminRequest(http.MethodPost, "/admin/sessions/"+session.ID+"/cancel", "admin-token"); status != http.StatusAccepted {
+		t.Fatalf("cancel: status %d, body %s", status, body)
+	}
+
+	rest, err := io.ReadAll(reader)
+	if err != nil {
+		t.Fatalf("reading rest of stream: %v", err)
+	}
+	if !strings.HasPrefix(string(rest), "\nevent: error\ndata: ") || !strings.Contains(string(rest), `"status":"CANCELLED"`) {
+		t.Errorf("stream after cancel = %q, want a CANCELLED error event", rest)
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for h.handler.Sessions.Len() > 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if n := h.handler.Sessions.Len(); n != 0 {
+		t.Errorf("%d sessions still registered after cancel", n)
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	upstreamStatus := http.StatusOK
+	probes := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		probes++
+		if r.URL.Path != "/v1beta/models" || r.Header.Get("X-Goog-Api-Key") != "probe-key" {
+			t.Errorf("unexpected probe %s %s", r.URL.Path, r.Header.Get("X-Goog-Api-Key"))
+		}
+		w.WriteHeader(upstreamStatus)
+	}))
+	defer upstream.Close()
+
+	probe := handlers.NewUpstreamProbe(upstream.URL, "probe-key", http.DefaultClient, time.Hour, time.Second)
+	drainer := handlers.NewDrainer()
+	ready := handlers.NewReadinessHandler(probe.ReadinessCheck(), handlers.BreakerCheck(nil), handlers.DrainCheck(drainer))
+	check := func() (int, handlers.ReadinessResponse) {
+		rec := httptest.NewRecorder()
+		ready(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		var response handlers.ReadinessResponse
+		if err := json.Unmarshal(rec.Body.Bytes(), &response); err != nil {
+			t.Fatalf("decoding %q: %v", rec.Body.String(), err)
+		}
+		return rec.Code, response
+	}
+
+	code, response := check()
+	if code != http.StatusOK || response.Status != "ready" {
+		t.Fatalf("ready: status %d, %+v", code, response)
+	}
+	if got := response.Checks["circuit_breaker"].Status; got != handlers.CheckSkipped {
+		t.Errorf("circuit_breaker check = %q, want skipped", got)
+	}
+
+	// The probe result is cached, so an upstream failure is not seen yet.
+	upstreamStatus = http.StatusServiceUnavailable
+	if code, _ := check(); code != http.StatusOK || probes != 1 {
+		t.Errorf("cached: status %d after %d probes, want 200 after 1", code, probes)
+	}
+
+	probe = handlers.NewUpstreamProbe(upstream.URL, "probe-key", http.DefaultClient, 0, time.Second)
+	ready = handlers.NewReadinessHandler(probe.ReadinessCheck(), handlers.DrainCheck(drainer))
+	code, response = check()
+	if code != http.StatusServiceUnavailable || response.Status != "not_ready" || response.Checks["upstream"].Status != handlers.CheckFailed {
+		t.Errorf("upstream down: status %d, %+v", code, response)
+	}
+
+	upstreamStatus = http.StatusForbidden
+	if code, response = check(); code != http.StatusServiceUnavailable || !strings.Contains(response.Checks["upstream"].Detail, "rejected") {
+		t.Errorf("probe key rejected: status %d, %+v", code, response)
+	}
+
+	upstreamStatus = http.StatusOK
+	drainer.Start()
+	if code, response = check(); code != http.StatusServiceUnavailable || response.Status != "draining" {
+		t.Errorf("draining: status %d, %+v", code, response)
+	}
+}
+
+func TestReadinessProbeIsShared(t *testing.T) {
+	release := make(chan struct{})
+	var mu sync.Mutex
+	probes := 0
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		probes++
+		mu.Unlock()
+		<-release
+	}))
+	defer upstream.Close()
+	probe := handlers.NewUpstreamProbe(upstream.URL, "", http.DefaultClient, time.Hour, 5*time.Second)
+
+	// A caller that gives up does not wait for the slow probe.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if result := probe.Check(ctx); result.Status != handlers.CheckFailed {
+		t.Errorf("abandoned check = %+v, want failed", result)
+	}
+
+	results := make(chan handlers.CheckResult)
+	for i := 0; i < 5; i++ {
+		go func() { results <- probe.Check(context.Background()) }()
+	}
+	close(release)
+	for i := 0; i < 5; i++ {
+		if result := <-results; result.Status != handlers.CheckOK {
+			t.Errorf("check %d = %+v, want ok", i+1, result)
+		}
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if probes != 1 {
+		t.Errorf("upstream probed %d times, want once", probes)
+	}
+}
+
+func TestKeyPoolReadiness(t *testing.T) {
+	rejected := &scenario.Scenario{
+		Name:     "rejected-key",
+		Attempts: []scenario.Attempt{{Status: http.StatusForbidden, Message: "API key not valid."}},
+	}
+	keyPool := func(h *harness) handlers.CheckResult {
+		return h.handler.Keys.ReadinessCheck().Check(context.Background())
+	}
+
+	t.Run("clients send their own keys", func(t *testing.T) {
+		h := newHarness(t, nil)
+		if result := keyPool(h); result.Status != handlers.CheckSkipped {
+			t.Errorf("key_pool = %+v, want skipped", result)
+		}
+	})
+
+	t.Run("no usable key configured", func(t *testing.T) {
+		h := newHarness(t, func(cfg *config.Config) { cfg.InjectHeaders = []string{"X-Goog-Api-Key: "} })
+		if result := keyPool(h); result.Status != handlers.CheckFailed {
+			t.Errorf("key_pool = %+v, want failed", result)
+		}
+	})
+
+	t.Run("key rejected and replaced", func(t *testing.T) {
+		h := newHarness(t, func(cfg *config.Config) { cfg.InjectHeaders = []string{"X-Goog-Api-Key: pooled-key"} }, rejected)
+		if result := keyPool(h); result.Status != handlers.CheckOK {
+			t.Fatalf("before use: key_pool = %+v, want ok", result)
+		}
+		if resp, _ := h.stream(t, "rejected-key"); resp.StatusCode != http.StatusForbidden {
+			t.Fatalf("status = %d, want the upstream's 403", resp.StatusCode)
+		}
+		result := keyPool(h)
+		if result.Status != handlers.CheckFailed || result.Detail != "0 of 1 upstream keys usable" {
+			t.Errorf("after rejection: key_pool = %+v, want failed with no keys left", result)
+		}
+		if strings.Contains(result.Detail, "pooled-key") {
+			t.Errorf("key_pool detail leaks the key: %s", result.Detail)
+		}
+
+		cfg := *h.handler.Config()
+		cfg.InjectHeaders = []string{"X-Goog-Api-Key: new-key"}
+		h.handler.SetConfig(&cfg)
+		if result := keyPool(h); result.Status != handlers.CheckOK {
+			t.Errorf("after reload: key_pool = %+v, want ok", result)
+		}
+	})
+}
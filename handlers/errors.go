@@ -45,7 +45,6 @@ func StatusToGoogleStatus(code int) string {
 // JSONError creates a standardized JSON error response
 func JSONError(w http.ResponseWriter, status int, message string, details interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 	w.WriteHeader(status)
 
 	errorResp := ErrorResponse{
@@ -59,11 +58,3 @@ func JSONError(w http.ResponseWriter, status int, message string, details interf
 
 	json.NewEncoder(w).Encode(errorResp)
 }
-
-// HandleCORS handles CORS preflight requests
-func HandleCORS(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.Header().Set("Access-Control-Allow-Methods", "GET, POST, OPTIONS")
-	w.Header().Set("Access-Control-Allow-Headers", "Content-Type, Authorization, X-Goog-Api-Key")
-	w.WriteHeader(http.StatusOK)
-}
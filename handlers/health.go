@@ -5,37 +5,55 @@ import (
 	"net/http"
 	"time"
 
+	"gemini-antiblock/breaker"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/version"
 )
 
 // HealthResponse represents the health check response
 type HealthResponse struct {
-	Status    string    `json:"status"`
-	Timestamp time.Time `json:"timestamp"`
-	Service   string    `json:"service"`
-	Version   string    `json:"version,omitempty"`
+	Status          string                      `json:"status"`
+	Timestamp       time.Time                   `json:"timestamp"`
+	Service         string                      `json:"service"`
+	Version         string                      `json:"version,omitempty"`
+	Commit          string                      `json:"commit,omitempty"`
+	BuildTime       string                      `json:"build_time,omitempty"`
+	CircuitBreakers map[string]breaker.Snapshot `json:"circuit_breakers,omitempty"`
 }
 
-// HealthHandler handles health check requests
-func HealthHandler(w http.ResponseWriter, r *http.Request) {
-	logger.LogDebug("Health check endpoint accessed")
-
-	response := HealthResponse{
-		Status:    "healthy",
-		Timestamp: time.Now().UTC(),
-		Service:   "gemini-antiblock-proxy",
-		Version:   "0.2.0",
+// NewHealthHandler creates the liveness handler. The breaker group may be
+// nil when circuit breaking is disabled. An open breaker reports the service
+// as "degraded" but still answers 200, since the process itself is alive;
+// whether it should receive traffic is up to the readiness handler.
+func NewHealthHandler(breakers *breaker.Group) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		logger.LogDebug("Health check endpoint accessed")
+
+		response := HealthResponse{
+			Status:    "healthy",
+			Timestamp: time.Now().UTC(),
+			Service:   "gemini-antiblock-proxy",
+			Version:   version.Version,
+			Commit:    version.Commit,
+			BuildTime: version.BuildTime,
+		}
+
+		if breakers != nil {
+			response.CircuitBreakers = breakers.Snapshots()
+			if breakers.AnyOpen() {
+				response.Status = "degraded"
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.LogError("Failed to encode health response:", err)
+			http.Error(w, "Internal Server Error", http.StatusInternalServerError)
+			return
+		}
+
+		logger.LogDebug("Health check response sent successfully")
 	}
-
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
-	w.WriteHeader(http.StatusOK)
-
-	if err := json.NewEncoder(w).Encode(response); err != nil {
-		logger.LogError("Failed to encode health response:", err)
-		http.Error(w, "Internal Server Error", http.StatusInternalServerError)
-		return
-	}
-
-	logger.LogDebug("Health check response sent successfully")
 }
@@ -19,7 +19,7 @@ type SystemPromptInjector struct {
 // NewSystemPromptInjector creates a new injector. It reads the original
 // request to memory, injects the prompt, and then creates a new reader
 // from the modified body.
-func NewSystemPromptInjector(reader io.ReadCloser) (*SystemPromptInjector, map[string]interface{}, error) {
+func NewSystemPromptInjector(reader io.ReadCloser, prompt string) (*SystemPromptInjector, map[string]interface{}, error) {
 	bodyBytes, err := io.ReadAll(reader)
 	if err != nil {
 		return nil, nil, err
@@ -38,7 +38,7 @@ func NewSystemPromptInjector(reader io.ReadCloser) (*SystemPromptInjector, map[s
 
 	// Create a dummy handler to reuse the InjectSystemPrompt logic
 	dummyHandler := &ProxyHandler{}
-	dummyHandler.InjectSystemPrompt(requestBody)
+	dummyHandler.InjectSystemPrompt(requestBody, prompt)
 
 	modifiedBodyBytes, err := json.Marshal(requestBody)
 	if err != nil {
@@ -0,0 +1,136 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+// keyHeaders are the request headers that carry upstream credentials.
+var keyHeaders = []string{"X-Goog-Api-Key", "Authorization"}
+
+// KeyPool tracks the upstream API keys the proxy adds to requests itself,
+// through INJECT_HEADERS, and which of them the upstream has rejected. Keys
+// that clients send are theirs to manage and are not pooled.
+type KeyPool struct {
+	mu sync.Mutex
+	// keys maps each pooled key to whether the upstream rejected it last
+	// time it was used.
+	keys map[string]bool
+	// configured counts the key headers set in INJECT_HEADERS, including
+	// ones with no usable value.
+	configured int
+}
+
+// NewKeyPool creates an empty key pool.
+func NewKeyPool() *KeyPool {
+	return &KeyPool{keys: make(map[string]bool)}
+}
+
+// SetConfig replaces the pooled keys with the ones in cfg. Keys that stay
+// keep their rejected state.
+func (p *KeyPool) SetConfig(cfg *config.Config) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	keys := make(map[string]bool)
+	p.configured = 0
+	for _, item := range cfg.InjectHeaders {
+		name, value, ok := strings.Cut(item, ":")
+		if !ok || !isKeyHeader(strings.TrimSpace(name)) {
+			continue
+		}
+		p.configured++
+		if key := strings.TrimSpace(value); key != "" {
+			keys[key] = p.keys[key]
+		}
+	}
+	p.keys = keys
+}
+
+func isKeyHeader(name string) bool {
+	for _, header := range keyHeaders {
+		if strings.EqualFold(name, header) {
+			return true
+		}
+	}
+	return false
+}
+
+// observe records the upstream's answer to a request sent with key. A 401
+// or 403 marks a pooled key as rejected, and any other answer below 500
+// marks it usable again.
+func (p *KeyPool) observe(key string, status int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	rejected, ok := p.keys[key]
+	if !ok || status >= 500 {
+		return
+	}
+	nowRejected := status == http.StatusUnauthorized || status == http.StatusForbidden
+	if nowRejected && !rejected {
+		logger.LogWarn(fmt.Sprintf("Upstream rejected API key %s with status %d", logger.MaskSecret(key), status))
+	}
+	p.keys[key] = nowRejected
+}
+
+// Transport wraps next so that every upstream response is observed for the
+// pooled key its request carried.
+func (p *KeyPool) Transport(next http.RoundTripper) http.RoundTripper {
+	return keyPoolTransport{pool: p, next: next}
+}
+
+type keyPoolTransport struct {
+	pool *KeyPool
+	next http.RoundTripper
+}
+
+func (t keyPoolTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	for _, header := range keyHeaders {
+		if key := req.Header.Get(header); key != "" {
+			t.pool.observe(key, resp.StatusCode)
+		}
+	}
+	return resp, nil
+}
+
+// ReadinessCheck returns a check that fails when key headers are configured
+// but none of them holds a key the upstream still accepts. Without pooled
+// keys, clients authenticate with their own and the check is skipped.
+func (p *KeyPool) ReadinessCheck() ReadinessCheck {
+	return ReadinessCheck{
+		Name: "key_pool",
+		Check: func(context.Context) CheckResult {
+			p.mu.Lock()
+			defer p.mu.Unlock()
+
+			if p.configured == 0 {
+				return CheckResult{Status: CheckSkipped, Detail: "no upstream keys configured, clients send their own"}
+			}
+			if len(p.keys) == 0 {
+				return CheckResult{Status: CheckFailed, Detail: "no usable upstream keys configured"}
+			}
+			usable := 0
+			for _, rejected := range p.keys {
+				if !rejected {
+					usable++
+				}
+			}
+			detail := fmt.Sprintf("%d of %d upstream keys usable", usable, len(p.keys))
+			if usable == 0 {
+				return CheckResult{Status: CheckFailed, Detail: detail}
+			}
+			return CheckResult{Status: CheckOK, Detail: detail}
+		},
+	}
+}
@@ -0,0 +1,305 @@
+package handlers
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/ratelimit"
+	"gemini-antiblock/streaming"
+)
+
+// RateLimits enforces the configured limit rules. Every rule keeps a
+// request bucket and a token bucket for each combination of its dimensions'
+// values, e.g. one per tenant and model.
+type RateLimits struct {
+	mu      sync.Mutex
+	cfg     *config.Config
+	store   ratelimit.LimiterStore
+	rules   []*limitRule
+	trusted []*net.IPNet
+}
+
+type limitRule struct {
+	config.LimitRule
+	id       string
+	ipMatch  *net.IPNet
+	requests *RateLimiter // nil without a request budget
+	tokens   *RateLimiter // nil without a token budget
+	// keylessByIP keys requests without an API key by their client IP
+	// instead of skipping them.
+	keylessByIP bool
+}
+
+// defaultRuleID identifies the per-tenant rule built from RATE_LIMIT_COUNT
+// and RATE_LIMIT_WINDOW_SECONDS, used when no rules are configured. Clients
+// without an API key are counted per IP address.
+const defaultRuleID = "default"
+
+// SetConfig rebuilds the rules from cfg. Rules that did not change keep
+// their buckets.
+func (l *RateLimits) SetConfig(cfg *config.Config) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.cfg = cfg
+	l.build()
+}
+
+// SetStore keeps the buckets of all rules in store from then on. Buckets
+// already in use are dropped. Without a store, buckets are kept in process.
+func (l *RateLimits) SetStore(store ratelimit.LimiterStore) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.store = store
+	l.rules = nil
+	if l.cfg != nil {
+		l.build()
+	}
+}
+
+// build creates the rules for l.cfg, reusing the current ones that did not
+// change. The caller must hold the mutex.
+func (l *RateLimits) build() {
+	cfg := l.cfg
+	if l.store == nil {
+		l.store = ratelimit.NewMemoryStore()
+	}
+
+	previous := make(map[string]*limitRule, len(l.rules))
+	for _, rule := range l.rules {
+		previous[rule.id] = rule
+	}
+
+	l.rules = nil
+	if !cfg.EnableRateLimit {
+		return
+	}
+	if len(cfg.RateLimitRules) == 0 {
+		rule := previous[defaultRuleID]
+		window := time.Duration(cfg.RateLimitWindowSeconds) * time.Second
+		if rule == nil {
+			rule = &limitRule{
+				LimitRule:   config.LimitRule{Dimensions: []config.LimitDimension{{Name: "tenant"}}},
+				id:          defaultRuleID,
+				requests:    NewRateLimiter(l.store, defaultRuleID, cfg.RateLimitCount, window, cfg.RateLimitBurst),
+				keylessByIP: true,
+			}
+		} else {
+			rule.requests.SetLimit(cfg.RateLimitCount, window, cfg.RateLimitBurst)
+		}
+		l.rules = []*limitRule{rule}
+	}
+	for _, spec := range cfg.RateLimitRules {
+		id := spec.String()
+		if rule, ok := previous[id]; ok {
+			l.rules = append(l.rules, rule)
+			continue
+		}
+		rule := &limitRule{LimitRule: spec, id: id}
+		for _, d := range spec.Dimensions {
+			if d.Name == "ip" && d.Match != "" {
+				rule.ipMatch, _ = config.ParseCIDR(d.Match)
+			}
+		}
+		if spec.RequestsPerMinute > 0 {
+			rule.requests = NewRateLimiter(l.store, id+":requests", spec.RequestsPerMinute, time.Minute, 0)
+		}
+		if spec.TokensPerMinute > 0 {
+			rule.tokens = NewRateLimiter(l.store, id+":tokens", spec.TokensPerMinute, time.Minute, 0)
+		}
+		l.rules = append(l.rules, rule)
+	}
+
+	l.trusted = nil
+	for _, proxy := range cfg.RateLimitTrustedProxies {
+		if ipNet, err := config.ParseCIDR(proxy); err == nil {
+			l.trusted = append(l.trusted, ipNet)
+		}
+	}
+}
+
+// limitAttributes returns the values of the request attributes rules are
+// keyed by. Attributes that are unknown are left empty, and rules keyed by
+// them do not apply.
+func (l *RateLimits) limitAttributes(r *http.Request) map[string]string {
+	return map[string]string{
+		"tenant": requestAPIKey(r),
+		"ip":     l.clientIP(r),
+		"model":  streaming.ModelFromURL(r.URL.Path),
+	}
+}
+
+// clientIP returns the address the request came from. If the connection
+// comes from a trusted proxy, X-Forwarded-For is followed from the right
+// past every trusted hop.
+func (l *RateLimits) clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return host
+	}
+	if l.trusts(ip) {
+		hops := strings.Split(strings.Join(r.Header.Values("X-Forwarded-For"), ","), ",")
+		for i := len(hops) - 1; i >= 0; i-- {
+			hop := net.ParseIP(strings.TrimSpace(hops[i]))
+			if hop == nil {
+				break
+			}
+			ip = hop
+			if !l.trusts(hop) {
+				break
+			}
+		}
+	}
+	return ip.String()
+}
+
+func (l *RateLimits) trusts(ip net.IP) bool {
+	for _, ipNet := range l.trusted {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// key returns the bucket key for a request with the given attributes, or
+// false if the rule does not apply to it.
+func (r *limitRule) key(attrs map[string]string) (string, bool) {
+	values := make([]string, len(r.Dimensions))
+	for i, d := range r.Dimensions {
+		value := attrs[d.Name]
+		if value == "" && d.Name == "tenant" && r.keylessByIP && attrs["ip"] != "" {
+			value = "ip:" + attrs["ip"]
+		}
+		if value == "" {
+			return "", false
+		}
+		switch {
+		case d.Match == "":
+		case r.ipMatch != nil:
+			if ip := net.ParseIP(value); ip == nil || !r.ipMatch.Contains(ip) {
+				return "", false
+			}
+		case value != d.Match:
+			return "", false
+		}
+		values[i] = value
+	}
+	return strings.Join(values, "|"), true
+}
+
+// Admit takes a request token and a token-budget token from every rule that
+// applies to r. With wait set it waits up to maxWait in total for them,
+// otherwise it does not wait. If any rule has no budget left, the tokens
+// already taken are given back and the denying decision is returned.
+// Otherwise the decision is that of the request budget with the fewest
+// requests remaining, and the admission is what retries and token usage are
+// charged to.
+func (l *RateLimits) Admit(ctx context.Context, r *http.Request, wait bool, maxWait time.Duration) (*admission, RateLimitDecision, error) {
+	l.mu.Lock()
+	rules := l.rules
+	attrs := l.limitAttributes(r)
+	l.mu.Unlock()
+
+	start := time.Now()
+	if wait {
+		defer func() {
+			metrics.RateLimitWait.Observe(time.Since(start).Seconds())
+		}()
+	}
+
+	a := &admission{}
+	var shown RateLimitDecision
+	for _, rule := range rules {
+		key, ok := rule.key(attrs)
+		if !ok {
+			continue
+		}
+		for _, limiter := range []*RateLimiter{rule.requests, rule.tokens} {
+			if limiter == nil {
+				continue
+			}
+			var d RateLimitDecision
+			var err error
+			if wait {
+				d, err = limiter.Wait(ctx, key, max(0, maxWait-time.Since(start)))
+			} else {
+				d = limiter.Allow(ctx, key)
+			}
+			if err != nil || !d.Allowed {
+				a.refund()
+				return nil, d, err
+			}
+			ref := bucketRef{limiter, key}
+			if limiter == rule.tokens {
+				a.tokens = append(a.tokens, ref)
+				continue
+			}
+			a.requests = append(a.requests, ref)
+			if len(a.requests) == 1 || d.Remaining < shown.Remaining {
+				shown = d
+			}
+		}
+	}
+	return a, shown, nil
+}
+
+// admission records the buckets a request was admitted against. It
+// implements streaming.Budget.
+type admission struct {
+	requests []bucketRef
+	tokens   []bucketRef
+}
+
+type bucketRef struct {
+	limiter *RateLimiter
+	key     string
+}
+
+// ChargeRetry takes another request from every request budget, without
+// waiting. A retry may leave a budget overdrawn.
+func (a *admission) ChargeRetry() {
+	for _, b := range a.requests {
+		b.limiter.Charge(b.key, 1)
+	}
+}
+
+// ChargeTokens debits the tokens a request used from every token budget.
+// Admission already took one.
+func (a *admission) ChargeTokens(tokens int) {
+	if tokens <= 1 {
+		return
+	}
+	for _, b := range a.tokens {
+		b.limiter.Charge(b.key, tokens-1)
+	}
+}
+
+// chargesTokens reports whether the request counts against a token budget.
+func (a *admission) chargesTokens() bool {
+	return a != nil && len(a.tokens) > 0
+}
+
+func (a *admission) refund() {
+	for _, b := range append(a.requests, a.tokens...) {
+		b.limiter.Charge(b.key, -1)
+	}
+}
+
+type admissionKey struct{}
+
+// admissionFromContext returns the admission ServeHTTP made for the request,
+// or nil if rate limiting is disabled.
+func admissionFromContext(ctx context.Context) *admission {
+	a, _ := ctx.Value(admissionKey{}).(*admission)
+	return a
+}
@@ -1,79 +1,189 @@
 package handlers
 
 import (
+	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
+	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"gemini-antiblock/breaker"
 	"gemini-antiblock/config"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/recorder"
 	"gemini-antiblock/streaming"
+	"gemini-antiblock/tracing"
 )
 
 // ProxyHandler handles proxy requests to Gemini API
 type ProxyHandler struct {
-	Config      *config.Config
-	RateLimiter *RateLimiter
+	RateLimits  *RateLimits
+	Concurrency *ConcurrencyLimiter
 	HTTPClient  *http.Client
+	Breakers    *breaker.Group
+	Recorder    *recorder.Recorder
+	Drainer     *Drainer
+	Sessions    *SessionRegistry
+	Keys        *KeyPool
+
+	state atomic.Pointer[proxyState]
+}
+
+// proxyState is the configuration a request runs with, together with the
+// policies built from it. It is replaced as a whole on reload and never
+// modified, so a request and its streaming session keep a consistent
+// snapshot.
+type proxyState struct {
+	cfg       *config.Config
+	fallbacks *streaming.FallbackPolicy
+	hedger    *streaming.Hedger
+	headers   *streaming.HeaderPolicy
+	cors      *CORSPolicy
+	// models are the models with their own series in the request metrics.
+	models map[string]bool
+}
+
+// newMetricModels collects the configured metric models and every model
+// in the fallback chains.
+func newMetricModels(cfg *config.Config) map[string]bool {
+	models := make(map[string]bool)
+	for _, model := range cfg.MetricsModels {
+		models[model] = true
+	}
+	for from, to := range cfg.ModelFallbacks {
+		models[from] = true
+		models[to] = true
+	}
+	return models
+}
+
+// metricModel returns the model label for a request path: the model if it
+// is a known one, "other" if not, and "" if the path names no model.
+func (s *proxyState) metricModel(path string) string {
+	model := streaming.ModelFromURL(path)
+	if model == "" || s.models[model] {
+		return model
+	}
+	return "other"
 }
 
-// NewProxyHandler creates a new proxy handler
-func NewProxyHandler(cfg *config.Config, rateLimiter *RateLimiter) *ProxyHandler {
-	// --- Performance Optimization: Network Tuning ---
-	// The original MaxIdleConnsPerHost was too low for the concurrent load,
-	// creating a connection pool bottleneck. We are increasing it to match
-	// the expected concurrency level.
-	transport := &http.Transport{
-		MaxIdleConns:        200, // Increased global pool size
-		MaxIdleConnsPerHost: 60,  // Increased per-host pool size to handle 50 concurrent users
-		IdleConnTimeout:     90 * time.Second,
+// NewProxyHandler creates a new proxy handler. It fails if the upstream
+// client cannot be configured, for example because the CA file is missing.
+func NewProxyHandler(cfg *config.Config) (*ProxyHandler, error) {
+	client, err := NewUpstreamClient(cfg)
+	if err != nil {
+		return nil, err
 	}
 
-	// Create a shared HTTP client to be reused across requests
-	client := &http.Client{
-		Transport: transport,
-		Timeout:   600 * time.Second, // Generous timeout for streaming APIs
+	var breakers *breaker.Group
+	if cfg.EnableCircuitBreaker {
+		breakers = breaker.NewGroup(breaker.Options{
+			Window:                  time.Duration(cfg.CircuitBreakerWindowSeconds) * time.Second,
+			MinRequests:             cfg.CircuitBreakerMinRequests,
+			ErrorRatePercent:        cfg.CircuitBreakerErrorRatePercent,
+			InterruptionRatePercent: cfg.CircuitBreakerInterruptionRatePercent,
+			OpenDuration:            time.Duration(cfg.CircuitBreakerOpenSeconds) * time.Second,
+			HalfOpenRequests:        cfg.CircuitBreakerHalfOpenRequests,
+		})
 	}
 
-	return &ProxyHandler{
-		Config:      cfg,
-		RateLimiter: rateLimiter,
+	keys := NewKeyPool()
+	client.Transport = keys.Transport(client.Transport)
+
+	h := &ProxyHandler{
+		RateLimits:  &RateLimits{},
+		Concurrency: NewConcurrencyLimiter(),
 		HTTPClient:  client,
+		Breakers:    breakers,
+		Drainer:     NewDrainer(),
+		Sessions:    NewSessionRegistry(),
+		Keys:        keys,
 	}
+	h.SetConfig(cfg)
+	return h, nil
 }
 
-// BuildUpstreamHeaders builds headers for upstream requests
-func (h *ProxyHandler) BuildUpstreamHeaders(reqHeaders http.Header) http.Header {
-	headers := make(http.Header)
+// Config returns the configuration new requests run with.
+func (h *ProxyHandler) Config() *config.Config {
+	return h.state.Load().cfg
+}
 
-	// Copy specific headers
-	if auth := reqHeaders.Get("Authorization"); auth != "" {
-		headers.Set("Authorization", auth)
+// SetConfig swaps in a new configuration for new requests. Requests already
+// in progress keep the configuration they started with. The hedge budget
+// carries over unless the hedging settings changed. cfg must not be
+// modified afterwards.
+func (h *ProxyHandler) SetConfig(cfg *config.Config) {
+	state := &proxyState{
+		cfg:       cfg,
+		fallbacks: streaming.NewFallbackPolicy(cfg),
+		headers:   streaming.NewHeaderPolicy(cfg),
+		cors:      NewCORSPolicy(cfg),
+		models:    newMetricModels(cfg),
+	}
+	if cfg.EnableHedging {
+		previous := h.state.Load()
+		if previous != nil && previous.hedger != nil &&
+			previous.cfg.HedgeDelayMs == cfg.HedgeDelayMs && previous.cfg.HedgeBudgetPerMinute == cfg.HedgeBudgetPerMinute {
+			state.hedger = previous.hedger
+		} else {
+			state.hedger = streaming.NewHedger(cfg.HedgeDelayMs, cfg.HedgeBudgetPerMinute)
+		}
 	}
-	if apiKey := reqHeaders.Get("X-Goog-Api-Key"); apiKey != "" {
-		headers.Set("X-Goog-Api-Key", apiKey)
+	h.RateLimits.SetConfig(cfg)
+	h.Concurrency.SetConfig(cfg)
+	h.Keys.SetConfig(cfg)
+	h.state.Store(state)
+}
+
+// CORSPolicy returns the CORS policy of the current configuration, for
+// CORSMiddleware.
+func (h *ProxyHandler) CORSPolicy() *CORSPolicy {
+	return h.state.Load().cors
+}
+
+// circuitBreaker returns the breaker guarding the configured upstream, or nil
+// if circuit breaking is disabled.
+func (h *ProxyHandler) circuitBreaker(cfg *config.Config) *breaker.Breaker {
+	if h.Breakers == nil {
+		return nil
 	}
-	if contentType := reqHeaders.Get("Content-Type"); contentType != "" {
-		headers.Set("Content-Type", contentType)
+	return h.Breakers.Get(cfg.UpstreamURLBase)
+}
+
+// recordUpstreamStatus records a non-streamed upstream response on the breaker.
+func recordUpstreamStatus(cb *breaker.Breaker, statusCode int) {
+	if cb == nil {
+		return
 	}
-	if accept := reqHeaders.Get("Accept"); accept != "" {
-		headers.Set("Accept", accept)
+	if breaker.IsFailureStatus(statusCode) {
+		cb.RecordFailure()
+	} else {
+		cb.RecordSuccess()
 	}
+}
 
-	return headers
+// BuildUpstreamHeaders builds the headers for an upstream request from the
+// client's headers, following the header policy of the current
+// configuration.
+func (h *ProxyHandler) BuildUpstreamHeaders(reqHeaders http.Header) http.Header {
+	return h.state.Load().headers.UpstreamHeaders(reqHeaders)
 }
 
 // InjectSystemPrompt injects a system prompt to ensure the [done] token is present.
 // It intelligently handles both system_instruction (snake_case) and systemInstruction (camelCase)
 // by merging the content of system_instruction into systemInstruction before processing.
 // systemInstruction is the officially recommended format.
-func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
+func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}, prompt string) {
 	newSystemPromptPart := map[string]interface{}{
-		"text": "IMPORTANT: At the very end of your entire response, you must write the token [done] to signal completion. This is a mandatory technical requirement.",
+		"text": prompt,
 	}
 
 	// --- From this point on, we only need to deal with systemInstruction ---
@@ -108,55 +218,146 @@ func (h *ProxyHandler) InjectSystemPrompt(body map[string]interface{}) {
 
 // HandleStreamingPost handles streaming POST requests
 func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Request) {
+	requestStart := time.Now()
+	state := h.state.Load()
+	log := logger.FromContext(r.Context())
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
+	upstreamURL := state.cfg.UpstreamURLBase + urlObj.Path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
 	}
 
-	logger.LogInfo("=== NEW STREAMING REQUEST ===")
-	logger.LogInfo("Upstream URL:", upstreamURL)
-	logger.LogInfo("Request method:", r.Method)
-	logger.LogInfo("Content-Type:", r.Header.Get("Content-Type"))
+	release, ok := h.acquireSlot(w, r, state.cfg)
+	if !ok {
+		return
+	}
+	// The slot is held across retries, so they never queue again.
+	defer release()
 
-	// --- Bug Fix: Pre-emptive Injection for Stateful Retry ---
-	injector, requestBodyForRetry, err := NewSystemPromptInjector(r.Body)
-	if err != nil {
-		logger.LogError("Failed to create system prompt injector:", err)
-		JSONError(w, 500, "Internal server error", "Failed to process request body")
+	done, ok := h.Drainer.Track()
+	if !ok {
+		log.Warn("Rejecting streaming request: proxy is shutting down")
+		JSONError(w, 503, "Service is shutting down", "The proxy is draining active streams and not accepting new ones")
 		return
 	}
+	defer done()
 
-	logger.LogInfo("=== MAKING INITIAL REQUEST (WITH PRE-EMPTIVE INJECTION) ===")
-	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
+	log.Info("=== NEW STREAMING REQUEST ===")
+	log.Info("Upstream URL:", upstreamURL)
+	log.Info("Request method:", r.Method)
+	log.Info("Content-Type:", r.Header.Get("Content-Type"))
 
-	upstreamReq, err := http.NewRequest("POST", upstreamURL, injector)
+	// --- Bug Fix: Pre-emptive Injection for Stateful Retry ---
+	var transcript *recorder.Transcript
+	var originalBody bytes.Buffer
+	body := r.Body
+	recording := h.Recorder.Sample()
+	if recording {
+		body = io.NopCloser(io.TeeReader(r.Body, &originalBody))
+		defer func() {
+			if err := h.Recorder.Write(transcript); err != nil {
+				log.Error("Failed to record transcript:", err)
+			}
+		}()
+	}
+
+	_, injectSpan := tracing.Start(r.Context(), "request.inject_system_prompt", tracing.SpanKindInternal)
+	prompt := state.cfg.InjectedPrompt
+	if prompt == "" {
+		prompt = config.DefaultInjectedPrompt
+	}
+	injector, requestBodyForRetry, err := NewSystemPromptInjector(body, prompt)
+	injectSpan.SetError(err)
+	injectSpan.End()
 	if err != nil {
-		logger.LogError("Failed to create upstream request:", err)
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+		log.Error("Failed to create system prompt injector:", err)
+		JSONError(w, 500, "Internal server error", "Failed to process request body")
 		return
 	}
+	if recording {
+		transcript = h.Recorder.NewTranscript(requestIDFromContext(r.Context()), r.Method, r.URL.Path, originalBody.Bytes())
+	}
+
+	cb := h.circuitBreaker(state.cfg)
+	if cb != nil {
+		if err := cb.Allow(); err != nil {
+			log.Error("Upstream circuit breaker is open. Failing fast.")
+			transcript.Finish("circuit_open")
+			JSONError(w, 503, "Upstream is temporarily unavailable", "Circuit breaker is open for the upstream server")
+			return
+		}
+	}
 
-	upstreamReq.Header = upstreamHeaders
+	log.Info("=== MAKING INITIAL REQUEST (WITH PRE-EMPTIVE INJECTION) ===")
+	upstreamHeaders := state.headers.UpstreamHeaders(r.Header)
+
+	upstreamCtx, upstreamSpan := tracing.Start(r.Context(), "upstream.initial", tracing.SpanKindClient,
+		"gemini.model", streaming.ModelFromURL(upstreamURL))
+	tracing.Inject(upstreamCtx, upstreamHeaders)
+
+	tenant := requestAPIKey(r)
+	transcript.StartAttempt(upstreamURL, nil)
+	upstreamStart := time.Now()
+	var initialResponse *http.Response
+	if state.hedger != nil {
+		// Hedged attempts each need their own copy of the body.
+		initialResponse, err = state.hedger.Do(r.Context(), log, h.HTTPClient, tenant, func(ctx context.Context) (*http.Request, error) {
+			req, err := http.NewRequestWithContext(ctx, "POST", upstreamURL, injector.GetFullBodyReader())
+			if err != nil {
+				return nil, err
+			}
+			req.Header = upstreamHeaders.Clone()
+			return req, nil
+		})
+	} else {
+		reqCtx, cancel := context.WithCancel(r.Context())
+		var upstreamReq *http.Request
+		upstreamReq, err = http.NewRequestWithContext(reqCtx, "POST", upstreamURL, injector)
+		if err != nil {
+			cancel()
+			log.Error("Failed to create upstream request:", err)
+			JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+			return
+		}
 
-	initialResponse, err := h.HTTPClient.Do(upstreamReq)
+		upstreamReq.Header = upstreamHeaders
+		if initialResponse, err = h.HTTPClient.Do(upstreamReq); err != nil {
+			cancel()
+		} else {
+			initialResponse.Body = streaming.CancelOnClose(initialResponse.Body, cancel)
+		}
+	}
+	metrics.UpstreamLatency.Observe(time.Since(upstreamStart).Seconds(), "initial")
 	if err != nil {
-		logger.LogError("Failed to make initial request:", err)
+		upstreamSpan.SetError(err)
+		upstreamSpan.End()
+		transcript.SetResponse(0, err)
+		transcript.Finish("upstream_error")
+		log.Error("Failed to make initial request:", err)
+		if cb != nil {
+			cb.RecordFailure()
+		}
 		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
 		return
 	}
 
-	logger.LogInfo(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
+	upstreamSpan.SetAttributes("http.status_code", initialResponse.StatusCode)
+	upstreamSpan.End()
+	transcript.SetResponse(initialResponse.StatusCode, nil)
+	log.Info(fmt.Sprintf("Initial response status: %d %s", initialResponse.StatusCode, initialResponse.Status))
 
 	// Initial failure: return standardized error
 	if initialResponse.StatusCode != http.StatusOK {
-		logger.LogError("=== INITIAL REQUEST FAILED ===")
-		logger.LogError("Status:", initialResponse.StatusCode)
-		logger.LogError("Status Text:", initialResponse.Status)
+		log.Error("=== INITIAL REQUEST FAILED ===")
+		log.Error("Status:", initialResponse.StatusCode)
+		log.Error("Status Text:", initialResponse.Status)
+		recordUpstreamStatus(cb, initialResponse.StatusCode)
 
 		// Read error response
 		errorBody, _ := io.ReadAll(initialResponse.Body)
 		initialResponse.Body.Close()
+		transcript.AddLine(string(errorBody))
+		transcript.Finish("upstream_error")
 
 		// Try to parse as JSON error
 		var errorResp map[string]interface{}
@@ -169,7 +370,6 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 				}
 			}
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.WriteHeader(initialResponse.StatusCode)
 			json.NewEncoder(w).Encode(errorResp)
 			return
@@ -184,13 +384,13 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 		return
 	}
 
-	logger.LogInfo("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
+	log.Info("=== INITIAL REQUEST SUCCESSFUL - STARTING STREAM PROCESSING ===")
 
 	// Set up streaming response
+	state.headers.MirrorResponseHeaders(w.Header(), initialResponse.Header)
 	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
 	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
 	w.Header().Set("Connection", "keep-alive")
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
 	// Additional headers to prevent buffering by proxies
 	w.Header().Set("X-Accel-Buffering", "no") // Nginx
@@ -200,56 +400,172 @@ func (h *ProxyHandler) HandleStreamingPost(w http.ResponseWriter, r *http.Reques
 	w.WriteHeader(http.StatusOK)
 
 	// Process stream with retry logic using a new session for each request
-	safeWriter := NewSafeWriter(w)
+	var clientWriter io.Writer = NewSafeWriter(w)
+	if transcript != nil {
+		clientWriter = recorder.NewTeeWriter(clientWriter, transcript)
+	}
 	session := streaming.NewSession(
-		h.Config,
+		state.cfg,
 		initialResponse.Body,
-		safeWriter,
+		clientWriter,
 		requestBodyForRetry,
 		upstreamURL,
 		r.Header,
 		h.HTTPClient,
 	)
+	session.SetStartTime(requestStart)
+	session.SetLogger(log)
+	session.SetContext(r.Context())
+	session.SetTranscript(transcript)
+	session.SetShutdown(h.Drainer.Aborted())
+	defer h.Sessions.Register(requestIDFromContext(r.Context()), r.URL.Path, tenant, session)()
+	session.SetCircuitBreaker(cb)
+	session.SetFallbackPolicy(state.fallbacks)
+	session.SetHeaderPolicy(state.headers)
+	if state.hedger != nil {
+		session.SetHedger(state.hedger, tenant)
+	}
+	if admission := admissionFromContext(r.Context()); admission != nil {
+		session.SetBudget(admission)
+	}
 	err = session.Process()
 
-	if err != nil {
-		logger.LogError("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
-		logger.LogError("Exception:", err)
+	if errors.Is(err, streaming.ErrShutdown) {
+		log.Info("Stream ended early for shutdown")
+	} else if errors.Is(err, context.Canceled) {
+		log.Info("Stream ended early because the client disconnected")
+	} else if err != nil {
+		log.Error("=== UNHANDLED EXCEPTION IN STREAM PROCESSOR ===")
+		log.Error("Exception:", err)
 	}
 
 	initialResponse.Body.Close()
-	logger.LogInfo("Streaming response completed")
+	log.Info("Streaming response completed")
 }
 
 // HandleNonStreaming handles non-streaming requests
 func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request) {
+	state := h.state.Load()
+	log := logger.FromContext(r.Context())
 	urlObj, _ := url.Parse(r.URL.String())
-	upstreamURL := h.Config.UpstreamURLBase + urlObj.Path
+	upstreamURL := state.cfg.UpstreamURLBase + urlObj.Path
 	if urlObj.RawQuery != "" {
 		upstreamURL += "?" + urlObj.RawQuery
 	}
 
-	upstreamHeaders := h.BuildUpstreamHeaders(r.Header)
+	cb := h.circuitBreaker(state.cfg)
+	if cb != nil {
+		if err := cb.Allow(); err != nil {
+			JSONError(w, 503, "Upstream is temporarily unavailable", "Circuit breaker is open for the upstream server")
+			return
+		}
+	}
+
+	upstreamHeaders := state.headers.UpstreamHeaders(r.Header)
 
 	var body io.Reader
 	if r.Method != "GET" && r.Method != "HEAD" {
 		body = r.Body
 	}
 
-	upstreamReq, err := http.NewRequest(r.Method, upstreamURL, body)
-	if err != nil {
-		JSONError(w, 500, "Internal server error", "Failed to create upstream request")
-		return
+	// Only generateContent answers can be judged interrupted; countTokens
+	// and embedding responses have no candidates and are never retried.
+	var tracker *streaming.FallbackTracker
+	var requestBody []byte
+	model := streaming.ModelFromURL(upstreamURL)
+	if state.fallbacks != nil && r.Method == "POST" && model != "" && strings.HasSuffix(urlObj.Path, ":generateContent") {
+		var err error
+		if requestBody, err = io.ReadAll(r.Body); err != nil {
+			JSONError(w, 400, "Bad request", "Failed to read request body")
+			return
+		}
+		tracker = streaming.NewFallbackTracker(state.fallbacks, model)
 	}
 
-	upstreamReq.Header = upstreamHeaders
+	// Fallback attempts after the first count as retries, and the tokens
+	// every attempt used are charged once the response is sent.
+	admission := admissionFromContext(r.Context())
+	tokensUsed := 0
+	if admission != nil {
+		defer func() { admission.ChargeTokens(tokensUsed) }()
+	}
 
-	resp, err := h.HTTPClient.Do(upstreamReq)
-	if err != nil {
-		JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
-		return
+	var resp *http.Response
+	var responseBody []byte
+	// Only the last response is still open once the loop ends; every
+	// earlier one is closed before the next attempt is sent.
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		if attempt > 0 {
+			resp.Body.Close()
+			if admission != nil {
+				admission.ChargeRetry()
+			}
+		}
+		if tracker != nil {
+			body = bytes.NewReader(requestBody)
+		}
+
+		upstreamReq, err := http.NewRequestWithContext(r.Context(), r.Method, upstreamURL, body)
+		if err != nil {
+			JSONError(w, 500, "Internal server error", "Failed to create upstream request")
+			return
+		}
+
+		upstreamReq.Header = upstreamHeaders.Clone()
+		upstreamCtx, upstreamSpan := tracing.Start(r.Context(), "upstream.non_streaming", tracing.SpanKindClient,
+			"gemini.model", streaming.ModelFromURL(upstreamURL))
+		tracing.Inject(upstreamCtx, upstreamReq.Header)
+
+		upstreamStart := time.Now()
+		resp, err = h.HTTPClient.Do(upstreamReq)
+		metrics.UpstreamLatency.Observe(time.Since(upstreamStart).Seconds(), "non_streaming")
+		if err == nil {
+			upstreamSpan.SetAttributes("http.status_code", resp.StatusCode)
+		}
+		upstreamSpan.SetError(err)
+		upstreamSpan.End()
+		if err != nil {
+			if cb != nil {
+				cb.RecordFailure()
+			}
+			JSONError(w, 502, "Bad Gateway", "Failed to connect to upstream server")
+			return
+		}
+		recordUpstreamStatus(cb, resp.StatusCode)
+
+		if tracker == nil || resp.StatusCode != http.StatusOK {
+			break
+		}
+
+		// With fallback enabled the response is buffered so it can be
+		// inspected for blocks and truncation before it reaches the client.
+		responseBody, err = io.ReadAll(resp.Body)
+		if err != nil {
+			JSONError(w, 502, "Bad Gateway", "Failed to read upstream response")
+			return
+		}
+		tokensUsed += streaming.ResponseTotalTokens(responseBody)
+
+		reason := streaming.ClassifyResponse(responseBody)
+		if !state.fallbacks.Counts(reason) {
+			break
+		}
+		log.Error(fmt.Sprintf("Non-streaming response from model %s interrupted: %s", tracker.Current(), reason))
+		if next, ok := tracker.Observe(reason); ok {
+			log.Info(fmt.Sprintf("Falling back to model %s for non-streaming request", next))
+			upstreamURL = streaming.ReplaceModelInURL(upstreamURL, next)
+			continue
+		}
+		if _, hasNext := state.fallbacks.NextModel(tracker.Current()); !hasNext {
+			break
+		}
+		// Below the threshold: try the same model again.
 	}
-	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
 		// Handle error response
@@ -265,7 +581,6 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 				}
 			}
 			w.Header().Set("Content-Type", "application/json; charset=utf-8")
-			w.Header().Set("Access-Control-Allow-Origin", "*")
 			w.WriteHeader(resp.StatusCode)
 			json.NewEncoder(w).Encode(errorResp)
 			return
@@ -275,57 +590,199 @@ func (h *ProxyHandler) HandleNonStreaming(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	// Copy response headers
+	// Copy response headers, except CORS headers: the proxy's own policy
+	// has set those.
 	for name, values := range resp.Header {
+		if strings.HasPrefix(name, "Access-Control-") {
+			continue
+		}
 		for _, value := range values {
 			w.Header().Add(name, value)
 		}
 	}
-	w.Header().Set("Access-Control-Allow-Origin", "*")
 
+	if tracker == nil {
+		w.WriteHeader(resp.StatusCode)
+		if !admission.chargesTokens() {
+			io.Copy(w, resp.Body)
+			return
+		}
+		var copied bytes.Buffer
+		io.Copy(w, io.TeeReader(resp.Body, &copied))
+		tokensUsed += streaming.ResponseTotalTokens(copied.Bytes())
+		return
+	}
+
+	if tracker.Switched() {
+		w.Header().Set(streaming.FallbackHeader, tracker.Chain())
+	}
+	w.Header().Del("Content-Length")
 	w.WriteHeader(resp.StatusCode)
-	io.Copy(w, resp.Body)
+	w.Write(responseBody)
+}
+
+type requestIDKey struct{}
+
+// requestIDFromContext returns the ID assigned to the request by ServeHTTP.
+func requestIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// requestAPIKey returns the API key a client authenticated with, taken from
+// X-Goog-Api-Key or a bearer token, or "" if there is none.
+func requestAPIKey(r *http.Request) string {
+	if apiKey := r.Header.Get("X-Goog-Api-Key"); apiKey != "" {
+		return apiKey
+	}
+	authHeader := r.Header.Get("Authorization")
+	if strings.HasPrefix(authHeader, "Bearer ") {
+		return strings.TrimPrefix(authHeader, "Bearer ")
+	}
+	return ""
+}
+
+// enforceRateLimit admits the request against the rate limit rules that
+// apply to it, waiting for budget in wait mode. It reports whether the
+// request may proceed; if not, the response has been written, or the client
+// has gone away.
+func (h *ProxyHandler) enforceRateLimit(w http.ResponseWriter, r *http.Request, cfg *config.Config) (*admission, bool) {
+	log := logger.FromContext(r.Context())
+
+	wait := cfg.RateLimitMode != "reject"
+	waitCtx, waitSpan := tracing.Start(r.Context(), "ratelimit.wait", tracing.SpanKindInternal)
+	admission, decision, err := h.RateLimits.Admit(waitCtx, r, wait, cfg.RateLimitMaxWaitMs)
+	waitSpan.End()
+	if err != nil {
+		log.Info("Client went away while waiting for the rate limit:", err)
+		return nil, false
+	}
+
+	if decision.Limit > 0 {
+		w.Header().Set("X-RateLimit-Limit", strconv.Itoa(decision.Limit))
+		w.Header().Set("X-RateLimit-Remaining", strconv.Itoa(decision.Remaining))
+		w.Header().Set("X-RateLimit-Reset", strconv.Itoa(ceilSeconds(decision.Reset)))
+	}
+	if admission != nil {
+		return admission, true
+	}
+
+	metrics.RateLimitRejections.Inc()
+	retryAfter := ceilSeconds(decision.RetryAfter)
+	log.Warn(fmt.Sprintf("Rate limit exceeded, retry after %ds", retryAfter))
+	w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+	JSONError(w, http.StatusTooManyRequests, "Rate limit exceeded",
+		fmt.Sprintf("Retry after %d seconds", retryAfter))
+	return nil, false
+}
+
+// acquireSlot takes a concurrency slot for a streaming session, queueing
+// for one if all are taken. It reports whether the session may proceed; if
+// not, the response has been written, or the client has gone away.
+func (h *ProxyHandler) acquireSlot(w http.ResponseWriter, r *http.Request, cfg *config.Config) (func(), bool) {
+	log := logger.FromContext(r.Context())
+
+	waitCtx, waitSpan := tracing.Start(r.Context(), "concurrency.queue", tracing.SpanKindInternal)
+	release, err := h.Concurrency.Acquire(waitCtx, requestAPIKey(r))
+	waitSpan.SetError(err)
+	waitSpan.End()
+
+	switch {
+	case err == nil:
+		return release, true
+	case errors.Is(err, ErrQueueFull):
+		metrics.ConcurrencyRejections.Inc("queue_full")
+		log.Warn("Rejecting streaming request: concurrency queue is full")
+		w.Header().Set("Retry-After", "1")
+		JSONError(w, 503, "Too many concurrent requests", "All streaming slots are taken and the wait queue is full")
+	case errors.Is(err, ErrQueueTimeout):
+		metrics.ConcurrencyRejections.Inc("timeout")
+		log.Warn("Rejecting streaming request: timed out waiting for a concurrency slot")
+		w.Header().Set("Retry-After", "1")
+		JSONError(w, 503, "Too many concurrent requests",
+			fmt.Sprintf("No streaming slot became free within %d ms", cfg.ConcurrencyQueueTimeoutMs.Milliseconds()))
+	default:
+		log.Info("Client went away while waiting for a concurrency slot:", err)
+	}
+	return nil, false
+}
+
+// ceilSeconds rounds d up to whole seconds.
+func ceilSeconds(d time.Duration) int {
+	return int((d + time.Second - 1) / time.Second)
 }
 
 // ServeHTTP implements the http.Handler interface
 func (h *ProxyHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	// First, enforce rate limiting if enabled and a key is present.
-	if h.Config.EnableRateLimit {
-		apiKey := r.Header.Get("X-Goog-Api-Key")
-		if apiKey == "" {
-			authHeader := r.Header.Get("Authorization")
-			if strings.HasPrefix(authHeader, "Bearer ") {
-				apiKey = strings.TrimPrefix(authHeader, "Bearer ")
-			}
-		}
-
-		if apiKey != "" {
-			logger.LogDebug("Enforcing rate limit for key ending with: ...", apiKey[len(apiKey)-4:])
-			h.RateLimiter.Wait(apiKey)
-			logger.LogDebug("Rate limit check passed for key.")
-		}
+	recorder := newStatusRecorder(w)
+	w = recorder
+	route := "non_streaming"
+	state := h.state.Load()
+	defer func() {
+		metrics.RequestsTotal.Inc(route, state.metricModel(r.URL.Path), strconv.Itoa(recorder.status))
+	}()
+
+	requestID := r.Header.Get("X-Request-Id")
+	if requestID == "" || len(requestID) > 64 {
+		requestID = logger.NewRequestID()
+	}
+	w.Header().Set("X-Request-Id", requestID)
+	log := logger.Default().With("request_id", requestID)
+
+	ctx := tracing.Extract(r.Context(), r.Header)
+	ctx, span := tracing.Start(ctx, "proxy.request", tracing.SpanKindServer,
+		"http.method", r.Method,
+		"url.path", r.URL.Path,
+		"request_id", requestID)
+	defer func() {
+		span.SetAttributes("http.route", route, "http.status_code", recorder.status)
+		span.End()
+	}()
+	if span != nil {
+		log = log.With("trace_id", span.SpanContext().TraceID.String())
 	}
+	ctx = context.WithValue(ctx, requestIDKey{}, requestID)
+	r = r.WithContext(logger.WithContext(ctx, log))
 
-	logger.LogInfo("=== WORKER REQUEST ===")
-	logger.LogInfo("Method:", r.Method)
-	logger.LogInfo("URL:", r.URL.String())
-	logger.LogInfo("User-Agent:", r.Header.Get("User-Agent"))
-	logger.LogInfo("X-Forwarded-For:", r.Header.Get("X-Forwarded-For"))
+	log.Info("=== WORKER REQUEST ===")
+	log.Info("Method:", r.Method)
+	log.Info("URL:", r.URL.String())
+	log.Info("User-Agent:", r.Header.Get("User-Agent"))
+	log.Info("X-Forwarded-For:", r.Header.Get("X-Forwarded-For"))
 
 	if r.Method == "OPTIONS" {
-		logger.LogDebug("Handling CORS preflight request")
-		HandleCORS(w, r)
+		// CORSMiddleware answers preflight requests; other OPTIONS
+		// requests only learn the allowed methods.
+		route = "options"
+		w.Header().Set("Allow", "GET, POST, OPTIONS")
+		w.WriteHeader(http.StatusNoContent)
 		return
 	}
 
+	if h.Drainer.Draining() {
+		log.Warn("Rejecting request: proxy is shutting down")
+		JSONError(w, 503, "Service is shutting down", "The proxy is draining active streams and not accepting new requests")
+		return
+	}
+
+	if cfg := h.Config(); cfg.EnableRateLimit {
+		admission, ok := h.enforceRateLimit(w, r, cfg)
+		if !ok {
+			return
+		}
+		log.Debug("Rate limit check passed.")
+		r = r.WithContext(context.WithValue(r.Context(), admissionKey{}, admission))
+	}
+
 	// Determine if this is a streaming request
 	isStream := strings.Contains(strings.ToLower(r.URL.Path), "stream") ||
 		strings.Contains(strings.ToLower(r.URL.Path), "sse") ||
 		r.URL.Query().Get("alt") == "sse"
 
-	logger.LogInfo("Detected streaming request:", isStream)
+	log.Info("Detected streaming request:", isStream)
 
 	if r.Method == "POST" && isStream {
+		route = "streaming"
 		h.HandleStreamingPost(w, r)
 		return
 	}
@@ -1,68 +1,133 @@
 package handlers
 
 import (
+	"context"
+	"math"
 	"sync"
 	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/ratelimit"
 )
 
-// RateLimiter controls request rates on a per-key basis.
+// RateLimiter controls request rates on a per-key basis with a token bucket
+// per key. Buckets refill at limit tokens per window and hold up to burst
+// tokens. They live in a LimiterStore, which may be shared by several
+// proxy replicas.
 type RateLimiter struct {
-	mutex   sync.Mutex
-	clients map[string][]time.Time // Map from API key to its request timestamps
-	limit   int
-	window  time.Duration
+	store ratelimit.LimiterStore
+	name  string
+	mutex sync.Mutex
+	limit ratelimit.Limit
+}
+
+// RateLimitDecision describes the outcome of a rate limit check.
+type RateLimitDecision struct {
+	Allowed bool
+	// Limit is the bucket capacity.
+	Limit int
+	// Remaining is the number of whole tokens left after the check.
+	Remaining int
+	// Reset is the time until the bucket is full again.
+	Reset time.Duration
+	// RetryAfter is the time until a token is available, set when the
+	// request was not allowed.
+	RetryAfter time.Duration
+}
+
+// NewRateLimiter creates a RateLimiter allowing limit requests per window
+// per key, in bursts of up to burst requests. A burst of zero means limit.
+// Its buckets are kept in store under keys starting with name.
+func NewRateLimiter(store ratelimit.LimiterStore, name string, limit int, window time.Duration, burst int) *RateLimiter {
+	l := &RateLimiter{store: store, name: name}
+	l.SetLimit(limit, window, burst)
+	return l
 }
 
-// NewRateLimiter creates a new RateLimiter.
-func NewRateLimiter(limit int, window time.Duration) *RateLimiter {
-	return &RateLimiter{
-		clients: make(map[string][]time.Time),
-		limit:   limit,
-		window:  window,
+// SetLimit changes the limit, window and burst. Existing buckets keep their
+// tokens, capped at the new burst.
+func (l *RateLimiter) SetLimit(limit int, window time.Duration, burst int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if burst <= 0 {
+		burst = limit
 	}
+	l.limit = ratelimit.Limit{Rate: float64(limit) / window.Seconds(), Burst: float64(burst)}
 }
 
-// Wait enforces the rate limit for a given key, waiting if necessary.
-func (l *RateLimiter) Wait(apiKey string) {
-	// Loop to handle the case where we wake up but another goroutine gets the slot.
-	for {
-		l.mutex.Lock()
+// Allow takes a token for key if one is available. It never waits.
+func (l *RateLimiter) Allow(ctx context.Context, key string) RateLimitDecision {
+	d, _ := l.take(ctx, key, 0)
+	return d
+}
 
-		now := time.Now()
-		cutoff := now.Add(-l.window)
+// Wait takes a token for key, waiting until one is available. If that would
+// take longer than maxWait, it returns at once without taking a token. If ctx
+// is done while waiting, the token is given back and ctx's error returned.
+func (l *RateLimiter) Wait(ctx context.Context, key string, maxWait time.Duration) (RateLimitDecision, error) {
+	// The token is reserved before waiting so that later callers queue
+	// behind this one.
+	d, wait := l.take(ctx, key, maxWait)
+	if !d.Allowed || wait <= 0 {
+		return d, nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return d, nil
+	case <-ctx.Done():
+		l.Charge(key, -1)
+		return RateLimitDecision{}, ctx.Err()
+	}
+}
 
-		// Get timestamps for the current key, cleaning up old ones.
-		timestamps := l.clients[apiKey]
-		firstValidIndex := 0
-		for i, ts := range timestamps {
-			if !ts.Before(cutoff) {
-				firstValidIndex = i
-				break
-			}
-			if i == len(timestamps)-1 {
-				firstValidIndex = i + 1
-			}
-		}
-		timestamps = timestamps[firstValidIndex:]
+// Charge takes tokens from key's bucket without waiting, which may leave it
+// overdrawn until it refills. A negative count gives tokens back.
+func (l *RateLimiter) Charge(key string, tokens int) {
+	l.mutex.Lock()
+	limit := l.limit
+	l.mutex.Unlock()
+	if _, _, err := l.store.Take(context.Background(), l.storeKey(key), limit, float64(tokens), ratelimit.NoMaxWait); err != nil {
+		logger.LogError("Failed to charge rate limit:", err)
+	}
+}
 
-		// If the limit is not reached, allow the request and record it.
-		if len(timestamps) < l.limit {
-			l.clients[apiKey] = append(timestamps, now)
-			l.mutex.Unlock()
-			return // Allowed, exit.
-		}
+// take takes one token if the bucket holds one within maxWait, returning
+// the decision and how long to wait before the token may be used. If the
+// store fails, the request is allowed.
+func (l *RateLimiter) take(ctx context.Context, key string, maxWait time.Duration) (RateLimitDecision, time.Duration) {
+	l.mutex.Lock()
+	limit := l.limit
+	l.mutex.Unlock()
 
-		// If the limit is reached, calculate the necessary wait time.
-		oldestTimestamp := timestamps[0]
-		waitUntil := oldestTimestamp.Add(l.window)
-		waitTime := time.Until(waitUntil)
+	level, taken, err := l.store.Take(ctx, l.storeKey(key), limit, 1, maxWait)
+	if err != nil {
+		logger.LogError("Rate limit store failed, allowing request:", err)
+		return RateLimitDecision{Allowed: true}, 0
+	}
+	d := RateLimitDecision{
+		Allowed:   taken,
+		Limit:     int(limit.Burst),
+		Remaining: int(math.Max(0, math.Floor(level))),
+		Reset:     until(limit, level, limit.Burst),
+	}
+	if !taken {
+		d.RetryAfter = until(limit, level, 1)
+		return d, 0
+	}
+	return d, until(limit, level, 0)
+}
 
-		// Unlock the mutex while waiting to not block other keys.
-		l.mutex.Unlock()
+func (l *RateLimiter) storeKey(key string) string {
+	return l.name + ":" + key
+}
 
-		if waitTime > 0 {
-			time.Sleep(waitTime)
-		}
-		// After waiting, loop again to re-check the conditions.
+// until returns how long a bucket at level needs to hold the given number
+// of tokens.
+func until(limit ratelimit.Limit, level, tokens float64) time.Duration {
+	if level >= tokens {
+		return 0
 	}
+	return time.Duration((tokens - level) / limit.Rate * float64(time.Second))
 }
@@ -0,0 +1,246 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/breaker"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/version"
+)
+
+// Readiness check statuses.
+const (
+	CheckOK      = "ok"
+	CheckFailed  = "failed"
+	CheckSkipped = "skipped"
+)
+
+// CheckResult is the outcome of one readiness check.
+type CheckResult struct {
+	Status    string     `json:"status"`
+	Detail    string     `json:"detail,omitempty"`
+	CheckedAt *time.Time `json:"checked_at,omitempty"`
+}
+
+// ReadinessCheck is a named check run by the readiness endpoint.
+type ReadinessCheck struct {
+	Name  string
+	Check func(ctx context.Context) CheckResult
+}
+
+// ReadinessResponse represents the readiness check response.
+type ReadinessResponse struct {
+	Status    string                 `json:"status"`
+	Timestamp time.Time              `json:"timestamp"`
+	Service   string                 `json:"service"`
+	Version   string                 `json:"version"`
+	Commit    string                 `json:"commit"`
+	BuildTime string                 `json:"build_time"`
+	Checks    map[string]CheckResult `json:"checks"`
+}
+
+// NewReadinessHandler creates a readiness handler. It answers 200 with
+// status "ready" when every check passes, and 503 with per-check details
+// otherwise. The status is "draining" while a drain check fails.
+func NewReadinessHandler(checks ...ReadinessCheck) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		response := ReadinessResponse{
+			Status:    "ready",
+			Timestamp: time.Now().UTC(),
+			Service:   "gemini-antiblock-proxy",
+			Version:   version.Version,
+			Commit:    version.Commit,
+			BuildTime: version.BuildTime,
+			Checks:    make(map[string]CheckResult, len(checks)),
+		}
+
+		var failed []string
+		for _, c := range checks {
+			result := c.Check(r.Context())
+			response.Checks[c.Name] = result
+			if result.Status == CheckFailed {
+				failed = append(failed, c.Name)
+			}
+		}
+
+		status := http.StatusOK
+		if len(failed) > 0 {
+			sort.Strings(failed)
+			status = http.StatusServiceUnavailable
+			response.Status = "not_ready"
+			if response.Checks[drainCheckName].Status == CheckFailed {
+				response.Status = "draining"
+			}
+			logger.LogDebug(fmt.Sprintf("Readiness check failed: %s", strings.Join(failed, ", ")))
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Cache-Control", "no-store")
+		w.WriteHeader(status)
+		if err := json.NewEncoder(w).Encode(response); err != nil {
+			logger.LogError("Failed to encode readiness response:", err)
+		}
+	}
+}
+
+const drainCheckName = "draining"
+
+// DrainCheck fails once the drainer starts draining, so load balancers stop
+// routing new requests to a proxy that is shutting down.
+func DrainCheck(d *Drainer) ReadinessCheck {
+	return ReadinessCheck{
+		Name: drainCheckName,
+		Check: func(context.Context) CheckResult {
+			if d.Draining() {
+				return CheckResult{Status: CheckFailed, Detail: fmt.Sprintf("shutting down, %d active streams", d.Active())}
+			}
+			return CheckResult{Status: CheckOK}
+		},
+	}
+}
+
+// BreakerCheck fails while any upstream circuit breaker is open. The group
+// may be nil when circuit breaking is disabled.
+func BreakerCheck(breakers *breaker.Group) ReadinessCheck {
+	return ReadinessCheck{
+		Name: "circuit_breaker",
+		Check: func(context.Context) CheckResult {
+			if breakers == nil {
+				return CheckResult{Status: CheckSkipped, Detail: "circuit breaker disabled"}
+			}
+			var open, halfOpen []string
+			for upstream, snapshot := range breakers.Snapshots() {
+				switch snapshot.State {
+				case breaker.StateOpen.String():
+					open = append(open, upstream)
+				case breaker.StateHalfOpen.String():
+					halfOpen = append(halfOpen, upstream)
+				}
+			}
+			sort.Strings(open)
+			sort.Strings(halfOpen)
+			if len(open) > 0 {
+				return CheckResult{Status: CheckFailed, Detail: "open for " + strings.Join(open, ", ")}
+			}
+			if len(halfOpen) > 0 {
+				return CheckResult{Status: CheckOK, Detail: "half-open for " + strings.Join(halfOpen, ", ")}
+			}
+			return CheckResult{Status: CheckOK}
+		},
+	}
+}
+
+// UpstreamProbe checks that the upstream API answers, using a lightweight
+// models.list call. Results are cached so frequent readiness polling does
+// not turn into upstream traffic.
+type UpstreamProbe struct {
+	url     string
+	apiKey  string
+	client  *http.Client
+	ttl     time.Duration
+	timeout time.Duration
+
+	mu     sync.Mutex
+	result CheckResult
+	at     time.Time
+	// running is closed when the probe in flight finishes, and nil while
+	// none is.
+	running chan struct{}
+}
+
+// NewUpstreamProbe creates a probe against baseURL. Without an API key the
+// upstream rejects the call, but any answer below 500 still shows it is
+// reachable; with a key, a rejected key fails the check.
+func NewUpstreamProbe(baseURL, apiKey string, client *http.Client, ttl, timeout time.Duration) *UpstreamProbe {
+	return &UpstreamProbe{
+		url:     strings.TrimRight(baseURL, "/") + "/v1beta/models?pageSize=1",
+		apiKey:  apiKey,
+		client:  client,
+		ttl:     ttl,
+		timeout: timeout,
+	}
+}
+
+// ReadinessCheck returns the probe as a readiness check.
+func (p *UpstreamProbe) ReadinessCheck() ReadinessCheck {
+	return ReadinessCheck{Name: "upstream", Check: p.Check}
+}
+
+// Check returns the cached result, probing the upstream if it has expired.
+// Concurrent callers share a single probe, which runs without the lock
+// held, and stop waiting for it when ctx is done.
+func (p *UpstreamProbe) Check(ctx context.Context) CheckResult {
+	p.mu.Lock()
+	if !p.at.IsZero() && time.Since(p.at) < p.ttl {
+		result := p.result
+		p.mu.Unlock()
+		return result
+	}
+	if p.running == nil {
+		p.running = make(chan struct{})
+		go p.run(p.running)
+	}
+	running := p.running
+	p.mu.Unlock()
+
+	select {
+	case <-running:
+	case <-ctx.Done():
+		return CheckResult{Status: CheckFailed, Detail: "gave up waiting for the upstream probe"}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.result
+}
+
+// run probes the upstream, caches the result and closes done. The probe is
+// not tied to the request that started it, since other callers share it.
+func (p *UpstreamProbe) run(done chan struct{}) {
+	result := p.probe()
+	checkedAt := time.Now().UTC()
+	result.CheckedAt = &checkedAt
+
+	p.mu.Lock()
+	p.result = result
+	p.at = checkedAt
+	p.running = nil
+	p.mu.Unlock()
+	close(done)
+}
+
+func (p *UpstreamProbe) probe() CheckResult {
+	ctx, cancel := context.WithTimeout(context.Background(), p.timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.url, nil)
+	if err != nil {
+		return CheckResult{Status: CheckFailed, Detail: err.Error()}
+	}
+	if p.apiKey != "" {
+		req.Header.Set("X-Goog-Api-Key", p.apiKey)
+	}
+
+	start := time.Now()
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return CheckResult{Status: CheckFailed, Detail: logger.Redact(err.Error())}
+	}
+	resp.Body.Close()
+	latency := time.Since(start).Round(time.Millisecond)
+
+	switch {
+	case resp.StatusCode >= 500:
+		return CheckResult{Status: CheckFailed, Detail: fmt.Sprintf("models.list returned %d in %v", resp.StatusCode, latency)}
+	case p.apiKey != "" && (resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden):
+		return CheckResult{Status: CheckFailed, Detail: fmt.Sprintf("probe API key rejected with %d", resp.StatusCode)}
+	default:
+		return CheckResult{Status: CheckOK, Detail: fmt.Sprintf("models.list returned %d in %v", resp.StatusCode, latency)}
+	}
+}
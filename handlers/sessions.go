@@ -0,0 +1,133 @@
+package handlers
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/streaming"
+)
+
+// SessionRegistry tracks the streaming sessions in progress so they can be
+// inspected and cancelled from the admin server.
+type SessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*registeredSession
+}
+
+type registeredSession struct {
+	requestID string
+	path      string
+	tenant    string
+	startedAt time.Time
+	session   *streaming.Session
+}
+
+func (e *registeredSession) info(id string) SessionInfo {
+	info := SessionInfo{
+		ID:            id,
+		RequestID:     e.requestID,
+		Path:          e.path,
+		Tenant:        e.tenant,
+		SessionStatus: e.session.Status(),
+	}
+	if info.StartedAt.IsZero() {
+		info.StartedAt = e.startedAt
+	}
+	return info
+}
+
+// SessionInfo describes an active session.
+type SessionInfo struct {
+	ID        string `json:"id"`
+	RequestID string `json:"request_id"`
+	Path      string `json:"path"`
+	Tenant    string `json:"tenant,omitempty"`
+	streaming.SessionStatus
+}
+
+// NewSessionRegistry creates an empty registry.
+func NewSessionRegistry() *SessionRegistry {
+	return &SessionRegistry{sessions: make(map[string]*registeredSession)}
+}
+
+// Register adds a session and returns a function that removes it. The
+// tenant's API key is stored masked.
+func (r *SessionRegistry) Register(requestID, path, tenant string, session *streaming.Session) (unregister func()) {
+	id := logger.NewRequestID()
+	entry := &registeredSession{
+		requestID: requestID,
+		path:      path,
+		startedAt: time.Now().UTC(),
+		session:   session,
+	}
+	if tenant != "" {
+		entry.tenant = logger.MaskSecret(tenant)
+	}
+
+	r.mu.Lock()
+	r.sessions[id] = entry
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		delete(r.sessions, id)
+		r.mu.Unlock()
+	}
+}
+
+// List returns the active sessions, oldest first.
+func (r *SessionRegistry) List() []SessionInfo {
+	r.mu.Lock()
+	entries := make(map[string]*registeredSession, len(r.sessions))
+	for id, entry := range r.sessions {
+		entries[id] = entry
+	}
+	r.mu.Unlock()
+
+	infos := make([]SessionInfo, 0, len(entries))
+	for id, entry := range entries {
+		infos = append(infos, entry.info(id))
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		if !infos[i].StartedAt.Equal(infos[j].StartedAt) {
+			return infos[i].StartedAt.Before(infos[j].StartedAt)
+		}
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// Get returns the session with the given ID.
+func (r *SessionRegistry) Get(id string) (SessionInfo, bool) {
+	entry := r.get(id)
+	if entry == nil {
+		return SessionInfo{}, false
+	}
+	return entry.info(id), true
+}
+
+// Cancel cancels the session with the given ID. The session ends its stream
+// with an error event; it stays listed until its handler returns.
+func (r *SessionRegistry) Cancel(id string) bool {
+	entry := r.get(id)
+	if entry == nil {
+		return false
+	}
+	entry.session.Cancel()
+	return true
+}
+
+// Len returns the number of active sessions.
+func (r *SessionRegistry) Len() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return len(r.sessions)
+}
+
+func (r *SessionRegistry) get(id string) *registeredSession {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.sessions[id]
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"gemini-antiblock/config"
+)
+
+// NewUpstreamClient creates the HTTP client shared by all upstream
+// requests: initial requests, retries, hedges and readiness probes.
+//
+// The dial, TLS handshake and response-header timeouts only cover getting a
+// response started, so that an unreachable upstream fails fast. The
+// client's overall timeout is the stream timeout, which also covers reading
+// the streamed body. Without one, a stream lasts until it ends or its
+// client request is cancelled.
+func NewUpstreamClient(cfg *config.Config) (*http.Client, error) {
+	dialer := &net.Dialer{
+		Timeout:   cfg.UpstreamDialTimeoutMs,
+		KeepAlive: 30 * time.Second,
+	}
+	transport := &http.Transport{
+		DialContext:           dialer.DialContext,
+		TLSHandshakeTimeout:   cfg.UpstreamTLSHandshakeTimeoutMs,
+		ResponseHeaderTimeout: cfg.UpstreamResponseHeaderTimeoutMs,
+		MaxIdleConns:          cfg.UpstreamMaxIdleConns,
+		MaxIdleConnsPerHost:   cfg.UpstreamMaxIdleConnsPerHost,
+		MaxConnsPerHost:       cfg.UpstreamMaxConnsPerHost,
+		IdleConnTimeout:       cfg.UpstreamIdleConnTimeoutMs,
+	}
+
+	// With HTTP/2, streams share connections and the per-host pool sizes
+	// only bound the connections opened beyond that.
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	protocols.SetHTTP2(cfg.UpstreamHTTP2)
+	transport.Protocols = protocols
+
+	if cfg.UpstreamProxy != "" {
+		proxyURL, err := url.Parse(cfg.UpstreamProxy)
+		if err != nil {
+			return nil, fmt.Errorf("parsing upstream proxy URL: %w", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if cfg.UpstreamCAFile != "" {
+		pem, err := os.ReadFile(cfg.UpstreamCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("reading upstream CA file: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in %s", cfg.UpstreamCAFile)
+		}
+		transport.TLSClientConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			RootCAs:    pool,
+		}
+	}
+
+	return &http.Client{
+		Transport: transport,
+		Timeout:   cfg.UpstreamStreamTimeoutMs,
+	}, nil
+}
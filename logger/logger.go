@@ -1,31 +1,178 @@
 package logger
 
 import (
+	"context"
 	"fmt"
-	"log"
-	"time"
+	"io"
+	"log/slog"
+	"os"
+	"strings"
+	"sync/atomic"
 )
 
-var debugMode bool
+// Options configures the process-wide logger.
+type Options struct {
+	// Level is one of "debug", "info", "warn" or "error".
+	Level string
+	// Format is "text" or "json".
+	Format string
+	// LogContent enables logging of user prompts and model output. It is
+	// independent of the level so debug logs can be shared safely.
+	LogContent bool
+	// Output defaults to stderr.
+	Output io.Writer
+}
+
+var (
+	level          = new(slog.LevelVar)
+	contentEnabled atomic.Bool
+	defaultLogger  atomic.Pointer[Logger]
+)
+
+func init() {
+	Configure(Options{Level: "info", Format: "text"})
+}
+
+// Configure replaces the process-wide logger.
+func Configure(opts Options) {
+	level.Set(ParseLevel(opts.Level))
+	contentEnabled.Store(opts.LogContent)
+
+	out := opts.Output
+	if out == nil {
+		out = os.Stderr
+	}
+	handlerOpts := &slog.HandlerOptions{
+		Level:       level,
+		ReplaceAttr: redactAttr,
+	}
+
+	var handler slog.Handler
+	if strings.EqualFold(opts.Format, "json") {
+		handler = slog.NewJSONHandler(out, handlerOpts)
+	} else {
+		handler = slog.NewTextHandler(out, handlerOpts)
+	}
+	defaultLogger.Store(&Logger{l: slog.New(handler)})
+}
+
+// ParseLevel converts a level name to a slog level, defaulting to info.
+func ParseLevel(name string) slog.Level {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "debug":
+		return slog.LevelDebug
+	case "warn", "warning":
+		return slog.LevelWarn
+	case "error":
+		return slog.LevelError
+	default:
+		return slog.LevelInfo
+	}
+}
 
 // SetDebugMode sets whether debug logging is enabled
 func SetDebugMode(enabled bool) {
-	debugMode = enabled
+	if enabled {
+		level.Set(slog.LevelDebug)
+	} else if level.Level() == slog.LevelDebug {
+		level.Set(slog.LevelInfo)
+	}
+}
+
+// ContentEnabled reports whether user content may be logged.
+func ContentEnabled() bool {
+	return contentEnabled.Load()
+}
+
+// Logger is a leveled logger that can carry request-scoped attributes such
+// as the request ID and the session attempt number.
+type Logger struct {
+	l *slog.Logger
+}
+
+// Default returns the process-wide logger.
+func Default() *Logger {
+	return defaultLogger.Load()
+}
+
+// With returns a logger that adds the given key/value pairs to every record.
+func (l *Logger) With(args ...interface{}) *Logger {
+	return &Logger{l: l.l.With(args...)}
+}
+
+// Debug logs debug messages (only if the debug level is enabled)
+func (l *Logger) Debug(args ...interface{}) {
+	l.log(slog.LevelDebug, args)
+}
+
+// Info logs info messages
+func (l *Logger) Info(args ...interface{}) {
+	l.log(slog.LevelInfo, args)
+}
+
+// Warn logs warning messages
+func (l *Logger) Warn(args ...interface{}) {
+	l.log(slog.LevelWarn, args)
+}
+
+// Error logs error messages
+func (l *Logger) Error(args ...interface{}) {
+	l.log(slog.LevelError, args)
+}
+
+// Content logs user prompts or model output at debug level, and only when
+// content logging has been switched on.
+func (l *Logger) Content(args ...interface{}) {
+	if ContentEnabled() {
+		l.log(slog.LevelDebug, args)
+	}
+}
+
+func (l *Logger) log(lvl slog.Level, args []interface{}) {
+	ctx := context.Background()
+	if !l.l.Enabled(ctx, lvl) {
+		return
+	}
+	l.l.Log(ctx, lvl, fmt.Sprint(args...))
 }
 
 // LogDebug logs debug messages (only if debug mode is enabled)
 func LogDebug(args ...interface{}) {
-	if debugMode {
-		log.Printf("[DEBUG %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
-	}
+	Default().log(slog.LevelDebug, args)
 }
 
 // LogInfo logs info messages
 func LogInfo(args ...interface{}) {
-	log.Printf("[INFO %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
+	Default().log(slog.LevelInfo, args)
+}
+
+// LogWarn logs warning messages
+func LogWarn(args ...interface{}) {
+	Default().log(slog.LevelWarn, args)
 }
 
 // LogError logs error messages
 func LogError(args ...interface{}) {
-	log.Printf("[ERROR %s] %s", time.Now().Format(time.RFC3339), fmt.Sprint(args...))
+	Default().log(slog.LevelError, args)
+}
+
+// LogContent logs user content, only when content logging is enabled
+func LogContent(args ...interface{}) {
+	Default().Content(args...)
+}
+
+type contextKey struct{}
+
+// WithContext returns a context carrying the request-scoped logger.
+func WithContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, contextKey{}, l)
+}
+
+// FromContext returns the request-scoped logger, or the default logger if
+// the context has none.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(contextKey{}).(*Logger); ok {
+		return l
+	}
+	return Default()
 }
@@ -0,0 +1,76 @@
+package logger
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"log/slog"
+	"regexp"
+	"strings"
+)
+
+// sensitiveKeys are attribute names whose values are never logged.
+var sensitiveKeys = map[string]bool{
+	"api_key":        true,
+	"apikey":         true,
+	"key":            true,
+	"authorization":  true,
+	"x-goog-api-key": true,
+	"token":          true,
+	"secret":         true,
+	"password":       true,
+}
+
+// secretPatterns match secrets embedded in free-form messages.
+var secretPatterns = []struct {
+	pattern     *regexp.Regexp
+	replacement string
+}{
+	// Google API keys.
+	{regexp.MustCompile(`AIza[0-9A-Za-z_\-]{35}`), "[REDACTED]"},
+	// Bearer tokens in header dumps.
+	{regexp.MustCompile(`(?i)(bearer\s+)[^\s",]+`), "${1}[REDACTED]"},
+	// API key and Authorization values in header dumps, whatever their
+	// format or scheme.
+	{regexp.MustCompile(`(?i)(x-goog-api-key["']?\s*[:=]\s*["']?)[^\s"',&]+`), "${1}[REDACTED]"},
+	{regexp.MustCompile(`(?i)(authorization["']?\s*[:=]\s*["']?(?:[a-z]+\s+)?)[^\s"',]+`), "${1}[REDACTED]"},
+	// key=... query parameters in URLs.
+	{regexp.MustCompile(`(?i)([?&](?:key|api_key|access_token)=)[^&\s"]+`), "${1}[REDACTED]"},
+}
+
+// Redact removes known secret formats from a string.
+func Redact(s string) string {
+	for _, p := range secretPatterns {
+		s = p.pattern.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
+
+// MaskSecret returns a form of a secret that is safe to log: only the last
+// four characters, and nothing at all for short values.
+func MaskSecret(secret string) string {
+	if len(secret) <= 8 {
+		return "[REDACTED]"
+	}
+	return "..." + secret[len(secret)-4:]
+}
+
+// redactAttr is installed as the slog ReplaceAttr hook so every record,
+// including its message, passes through redaction.
+func redactAttr(groups []string, a slog.Attr) slog.Attr {
+	if sensitiveKeys[strings.ToLower(a.Key)] {
+		return slog.String(a.Key, "[REDACTED]")
+	}
+	if a.Value.Kind() == slog.KindString {
+		return slog.String(a.Key, Redact(a.Value.String()))
+	}
+	return a
+}
+
+// NewRequestID generates a random request identifier.
+func NewRequestID() string {
+	var b [8]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b[:])
+}
@@ -1,19 +1,31 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net/http"
-	_ "net/http/pprof" // Import for performance profiling
+	"net/url"
 	"os"
+	"os/signal"
+	"syscall"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/joho/godotenv"
 
+	"gemini-antiblock/admin"
 	"gemini-antiblock/config"
 	"gemini-antiblock/handlers"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/ratelimit"
+	"gemini-antiblock/recorder"
+	"gemini-antiblock/server"
+	"gemini-antiblock/tracing"
+	"gemini-antiblock/version"
 )
 
 func main() {
@@ -22,27 +34,65 @@ func main() {
 		log.Println("No .env file found, using environment variables")
 	}
 
-	// Load configuration
-	cfg := config.LoadConfig()
+	if len(os.Args) > 1 && os.Args[1] == "replay" {
+		os.Exit(runReplay(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "bench" {
+		os.Exit(runBench(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "config" {
+		os.Exit(runConfig(os.Args[2:]))
+	}
+
+	// Load configuration: defaults < config file < environment < flags
+	cfg, err := config.Load(os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
 
 	// Set up logging
-	logger.SetDebugMode(cfg.DebugMode)
+	logger.Configure(logger.Options{
+		Level:      cfg.LogLevel,
+		Format:     cfg.LogFormat,
+		LogContent: cfg.LogContent,
+	})
 
 	logger.LogInfo("=== GEMINI ANTIBLOCK PROXY STARTING ===")
+	logger.LogInfo(fmt.Sprintf("Version: %s (commit %s, built %s)", version.Version, version.Commit, version.BuildTime))
+	if cfg.File != "" {
+		logger.LogInfo(fmt.Sprintf("Config file: %s", cfg.File))
+	}
 	logger.LogInfo(fmt.Sprintf("Upstream URL: %s", cfg.UpstreamURLBase))
 	logger.LogInfo(fmt.Sprintf("Max retries: %d", cfg.MaxConsecutiveRetries))
-	logger.LogInfo(fmt.Sprintf("Debug mode: %t", cfg.DebugMode))
+	logger.LogInfo(fmt.Sprintf("Log level: %s (format: %s, content logging: %t)", cfg.LogLevel, cfg.LogFormat, cfg.LogContent))
 	logger.LogInfo(fmt.Sprintf("Retry delay: %v", cfg.RetryDelayMs))
 	logger.LogInfo(fmt.Sprintf("Swallow thoughts after retry: %t", cfg.SwallowThoughtsAfterRetry))
 	logger.LogInfo(fmt.Sprintf("Server port: %s", cfg.Port))
 
-	// Create rate limiter from config
-	rateLimitWindow := time.Duration(cfg.RateLimitWindowSeconds) * time.Second
-	rateLimiter := handlers.NewRateLimiter(cfg.RateLimitCount, rateLimitWindow)
-	if cfg.EnableRateLimit {
-		logger.LogInfo(fmt.Sprintf("Rate limiting enabled: %d requests per %v per key", cfg.RateLimitCount, rateLimitWindow))
-	} else {
+	// Display rate limit configuration
+	switch {
+	case !cfg.EnableRateLimit:
 		logger.LogInfo("Rate limiting disabled")
+	case len(cfg.RateLimitRules) == 0:
+		logger.LogInfo(fmt.Sprintf("Rate limiting enabled: %d requests per %ds per key (burst %d, mode %s, max wait %v)",
+			cfg.RateLimitCount, cfg.RateLimitWindowSeconds, cfg.RateLimitBurst, cfg.RateLimitMode, cfg.RateLimitMaxWaitMs))
+	default:
+		for _, rule := range cfg.RateLimitRules {
+			logger.LogInfo(fmt.Sprintf("Rate limit rule: %s", rule.Masked()))
+		}
+		logger.LogInfo(fmt.Sprintf("Rate limiting enabled with %d rules (mode %s, max wait %v)",
+			len(cfg.RateLimitRules), cfg.RateLimitMode, cfg.RateLimitMaxWaitMs))
+	}
+
+	if cfg.ConcurrencyMaxInFlight > 0 {
+		logger.LogInfo(fmt.Sprintf("Concurrency limit: %d streaming sessions in flight (queue %d, timeout %v, %d tenant weights)",
+			cfg.ConcurrencyMaxInFlight, cfg.ConcurrencyMaxQueue, cfg.ConcurrencyQueueTimeoutMs, len(cfg.ConcurrencyTenantWeights)))
+	} else {
+		logger.LogInfo("Concurrency limit disabled")
 	}
 
 	// Display punctuation heuristic configuration
@@ -52,33 +102,235 @@ func main() {
 		logger.LogInfo("Punctuation heuristic disabled")
 	}
 
+	if cfg.EnableCircuitBreaker {
+		logger.LogInfo(fmt.Sprintf("Circuit breaker enabled: opens at %d%% errors or %d%% interruptions over %ds (min %d requests)",
+			cfg.CircuitBreakerErrorRatePercent, cfg.CircuitBreakerInterruptionRatePercent, cfg.CircuitBreakerWindowSeconds, cfg.CircuitBreakerMinRequests))
+	} else {
+		logger.LogInfo("Circuit breaker disabled")
+	}
+
+	var exporter *tracing.Exporter
+	if cfg.EnableTracing {
+		exporter = tracing.NewExporter(tracing.ExporterOptions{
+			Endpoint:    cfg.OTLPEndpoint,
+			ServiceName: cfg.TracingServiceName,
+		})
+		tracing.SetTracer(tracing.NewTracer(exporter))
+		logger.LogInfo(fmt.Sprintf("Tracing enabled: exporting OTLP/HTTP to %s", cfg.OTLPEndpoint))
+	} else {
+		logger.LogInfo("Tracing disabled")
+	}
+
 	// Create proxy handler
-	proxyHandler := handlers.NewProxyHandler(cfg, rateLimiter)
+	proxyHandler, err := handlers.NewProxyHandler(cfg)
+	if err != nil {
+		logger.LogError("Failed to configure upstream client:", err)
+		os.Exit(1)
+	}
+	logUpstreamTransport(cfg)
+
+	if cfg.RateLimitStore == "redis" {
+		redisStore := ratelimit.NewRedisStore(ratelimit.RedisOptions{
+			Addr:     cfg.RateLimitRedisAddr,
+			Password: cfg.RateLimitRedisPassword,
+			DB:       cfg.RateLimitRedisDB,
+			Timeout:  cfg.RateLimitRedisTimeoutMs,
+		})
+		defer redisStore.Close()
+		store := ratelimit.NewFallbackStore(redisStore, ratelimit.NewMemoryStore())
+		store.RegisterMetrics(metrics.Default)
+		proxyHandler.RateLimits.SetStore(store)
+		if err := redisStore.Ping(context.Background()); err != nil {
+			logger.LogWarn(fmt.Sprintf("Rate limit store %s unreachable, using local limits until it is: %v", cfg.RateLimitRedisAddr, err))
+		} else {
+			logger.LogInfo(fmt.Sprintf("Rate limit buckets shared through Redis at %s (db %d)", cfg.RateLimitRedisAddr, cfg.RateLimitRedisDB))
+		}
+	}
+
+	if cfg.EnableRecorder {
+		rec, err := recorder.New(recorder.Options{
+			Path:          cfg.RecorderPath,
+			MaxBytes:      int64(cfg.RecorderMaxMB) * 1024 * 1024,
+			MaxBackups:    cfg.RecorderMaxBackups,
+			SamplePercent: cfg.RecorderSamplePercent,
+			RedactFields:  cfg.RecorderRedactFields,
+		})
+		if err != nil {
+			logger.LogError("Failed to start transcript recorder:", err)
+			os.Exit(1)
+		}
+		defer rec.Close()
+		proxyHandler.Recorder = rec
+		logger.LogInfo(fmt.Sprintf("Transcript recorder enabled: %s (%d%% of sessions)", cfg.RecorderPath, cfg.RecorderSamplePercent))
+	}
 
 	// Set up routes
 	router := mux.NewRouter()
 
 	// Health check endpoint
-	router.HandleFunc("/health", handlers.HealthHandler).Methods("GET")
-	router.HandleFunc("/healthz", handlers.HealthHandler).Methods("GET")
+	healthHandler := handlers.NewHealthHandler(proxyHandler.Breakers)
+	router.HandleFunc("/health", healthHandler).Methods("GET")
+	router.HandleFunc("/healthz", healthHandler).Methods("GET")
+
+	// Readiness endpoint
+	upstreamProbe := handlers.NewUpstreamProbe(cfg.UpstreamURLBase, cfg.ReadinessProbeAPIKey, proxyHandler.HTTPClient,
+		time.Duration(cfg.ReadinessProbeTTLSeconds)*time.Second, time.Duration(cfg.ReadinessProbeTimeoutSeconds)*time.Second)
+	router.HandleFunc("/readyz", handlers.NewReadinessHandler(
+		upstreamProbe.ReadinessCheck(),
+		handlers.BreakerCheck(proxyHandler.Breakers),
+		proxyHandler.Keys.ReadinessCheck(),
+		handlers.DrainCheck(proxyHandler.Drainer),
+	)).Methods("GET")
+
+	proxyHandler.Concurrency.RegisterMetrics(metrics.Default)
+	if proxyHandler.Breakers != nil {
+		proxyHandler.Breakers.RegisterMetrics(metrics.Default)
+	}
 
 	// Handle all requests with the proxy handler
 	router.PathPrefix("/").Handler(proxyHandler)
 
-	// Start pprof server for profiling
-	go func() {
-		logger.LogInfo("Starting pprof server on port 6060")
-		if err := http.ListenAndServe(":6060", nil); err != nil {
-			logger.LogError("Pprof server failed to start:", err)
+	// Admin server for metrics, pprof and session management
+	var adminServer *admin.Server
+	if cfg.EnableAdmin {
+		adminServer, err = admin.NewServer(admin.Options{
+			Addr:         cfg.AdminAddr,
+			Token:        cfg.AdminToken,
+			TLSCertFile:  cfg.AdminTLSCert,
+			TLSKeyFile:   cfg.AdminTLSKey,
+			ClientCAFile: cfg.AdminClientCA,
+		}, proxyHandler.Sessions, metrics.Default.Handler())
+		if err != nil {
+			logger.LogError("Failed to configure admin server:", err)
+			os.Exit(1)
 		}
-	}()
+		go func() {
+			if err := adminServer.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				logger.LogError("Admin server failed:", err)
+			}
+		}()
+		logger.LogInfo(fmt.Sprintf("Admin server enabled on %s (token auth: %t, mTLS: %t)",
+			cfg.AdminAddr, cfg.AdminToken != "", cfg.AdminClientCA != ""))
+	} else {
+		logger.LogInfo("Admin server disabled")
+	}
 
 	// Start server
-	logger.LogInfo(fmt.Sprintf("Starting server on port %s", cfg.Port))
+	proxyServer, err := server.New(server.Options{
+		Addr:              ":" + cfg.Port,
+		UnixSocket:        cfg.UnixSocket,
+		TLSCertFile:       cfg.TLSCert,
+		TLSKeyFile:        cfg.TLSKey,
+		HTTP2:             cfg.EnableHTTP2,
+		H2C:               cfg.EnableH2C,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeoutMs,
+		IdleTimeout:       cfg.IdleTimeoutMs,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}, handlers.CORSMiddleware(proxyHandler.CORSPolicy)(router))
+	if err != nil {
+		logger.LogError("Failed to configure server:", err)
+		os.Exit(1)
+	}
+	listener, err := proxyServer.Listen()
+	if err != nil {
+		logger.LogError("Server failed to start:", err)
+		os.Exit(1)
+	}
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- proxyServer.Serve(listener)
+	}()
+	logger.LogInfo(fmt.Sprintf("Starting server on %s (HTTP/2 over TLS: %t, h2c: %t)",
+		proxyServer.Address(), cfg.TLSCert != "" && cfg.EnableHTTP2, cfg.TLSCert == "" && cfg.EnableH2C))
 	logger.LogInfo("Server ready to accept requests")
 
-	if err := http.ListenAndServe(":"+cfg.Port, router); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stop()
+
+	go proxyServer.WatchCertificate(ctx, certWatchInterval)
+
+	// Reload the configuration on SIGHUP and when the config file changes
+	reloads := &reloader{args: os.Args[1:], handler: proxyHandler}
+	reloads.watch(ctx, cfg.File)
+
+	select {
+	case err := <-serverErr:
 		logger.LogError("Server failed to start:", err)
 		os.Exit(1)
+	case <-ctx.Done():
+		stop()
+	}
+
+	shutdown(proxyServer.Server, proxyHandler.Drainer, time.Duration(proxyHandler.Config().DrainTimeoutSeconds)*time.Second)
+	// The admin server stays up while draining so stuck sessions can still
+	// be inspected and cancelled.
+	if adminServer != nil {
+		adminServer.Close()
+	}
+
+	// Export the spans of the drained sessions before exiting.
+	if exporter != nil {
+		exportCtx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+		exporter.Shutdown(exportCtx)
+		cancel()
+	}
+}
+
+// logUpstreamTransport logs how the proxy connects to the upstream.
+func logUpstreamTransport(cfg *config.Config) {
+	if cfg.UpstreamProxy != "" {
+		proxy := "(invalid URL)"
+		if u, err := url.Parse(cfg.UpstreamProxy); err == nil {
+			proxy = u.Redacted()
+		}
+		logger.LogInfo(fmt.Sprintf("Upstream proxy: %s", proxy))
+	}
+	if cfg.UpstreamCAFile != "" {
+		logger.LogInfo(fmt.Sprintf("Upstream CA file: %s", cfg.UpstreamCAFile))
+	}
+	logger.LogInfo(fmt.Sprintf("Upstream transport: HTTP/2 %t, dial timeout %v, TLS handshake timeout %v, response header timeout %v, stream timeout %v",
+		cfg.UpstreamHTTP2, cfg.UpstreamDialTimeoutMs, cfg.UpstreamTLSHandshakeTimeoutMs, cfg.UpstreamResponseHeaderTimeoutMs, cfg.UpstreamStreamTimeoutMs))
+	logger.LogInfo(fmt.Sprintf("Upstream connection pool: %d idle, %d idle per host, %d per host (0 = unlimited)",
+		cfg.UpstreamMaxIdleConns, cfg.UpstreamMaxIdleConnsPerHost, cfg.UpstreamMaxConnsPerHost))
+}
+
+// certWatchInterval is how often the TLS certificate files are checked for
+// changes.
+const certWatchInterval = 10 * time.Second
+
+// traceExportTimeout is how long the spans still buffered at exit get to
+// reach the collector.
+const traceExportTimeout = 10 * time.Second
+
+// shutdownGrace is how long sessions get to send their error event and
+// return after the drain deadline.
+const shutdownGrace = 5 * time.Second
+
+// shutdown stops accepting connections and lets in-flight requests finish
+// until the drain deadline. Streaming sessions still running at the deadline
+// are told to end with an SSE error event before the server closes.
+func shutdown(server *http.Server, drainer *handlers.Drainer, timeout time.Duration) {
+	drainer.Start()
+	logger.LogInfo(fmt.Sprintf("=== SHUTTING DOWN: draining %d active streams (deadline %v) ===", drainer.Active(), timeout))
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if err == nil {
+		logger.LogInfo("All requests finished. Server stopped.")
+		return
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		logger.LogError("Error during shutdown:", err)
+	}
+
+	logger.LogWarn(fmt.Sprintf("Drain deadline reached. Ending %d remaining streams with an error event.", drainer.Active()))
+	drainer.Abort()
+	graceCtx, graceCancel := context.WithTimeout(context.Background(), shutdownGrace)
+	defer graceCancel()
+	if err := drainer.Wait(graceCtx); err != nil {
+		logger.LogError(fmt.Sprintf("%d streams did not end in time", drainer.Active()))
 	}
+	server.Close()
+	logger.LogInfo("Server stopped.")
 }
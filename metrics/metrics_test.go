@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"bytes"
+	"math"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func render(r *Registry) string {
+	var buf bytes.Buffer
+	r.Render(&buf)
+	return buf.String()
+}
+
+func TestRenderGolden(t *testing.T) {
+	r := NewRegistry()
+	requests := NewCounterVec(r, "test_requests_total", "Requests by route\nand status.", "route", "status")
+	latency := NewHistogramVec(r, "test_latency_seconds", `Latency in C:\seconds.`, []float64{1, 0.5}, "kind")
+	NewGaugeFunc(r, "test_state", "Current state.", func(emit func(float64, ...string)) {
+		emit(1, "b")
+		emit(0, "a")
+		emit(math.Inf(1), "c")
+		emit(2) // wrong label count, dropped
+	}, "name")
+	NewCounterVec(r, "test_unlabelled_total", "No labels.").Add(2.5)
+
+	requests.Inc("/v1beta", "200")
+	requests.Add(2, "/v1beta", "200")
+	requests.Inc(`quote"back\slash`+"\nnewline", "500")
+	latency.Observe(0.25, "initial")
+	latency.Observe(0.75, "initial")
+	latency.Observe(3, "initial")
+
+	want := `# HELP test_latency_seconds Latency in C:\\seconds.
+# TYPE test_latency_seconds histogram
+test_latency_seconds_bucket{kind="initial",le="0.5"} 1
+test_latency_seconds_bucket{kind="initial",le="1"} 2
+test_latency_seconds_bucket{kind="initial",le="+Inf"} 3
+test_latency_seconds_sum{kind="initial"} 4
+test_latency_seconds_count{kind="initial"} 3
+# HELP test_requests_total Requests by route\nand status.
+# TYPE test_requests_total counter
+test_requests_total{route="/v1beta",status="200"} 3
+test_requests_total{route="quote\"back\\slash\nnewline",status="500"} 1
+# HELP test_state Current state.
+# TYPE test_state gauge
+test_state{name="a"} 0
+test_state{name="b"} 1
+test_state{name="c"} +Inf
+# HELP test_unlabelled_total No labels.
+# TYPE test_unlabelled_total counter
+test_unlabelled_total 2.5
+`
+	if got := render(r); got != want {
+		t.Errorf("Render =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestHistogramWithoutLabels(t *testing.T) {
+	r := NewRegistry()
+	h := NewHistogramVec(r, "test_retries", "Retries.", []float64{0, 1})
+	h.Observe(0)
+	h.Observe(5)
+
+	want := `# HELP test_retries Retries.
+# TYPE test_retries histogram
+test_retries_bucket{le="0"} 1
+test_retries_bucket{le="1"} 1
+test_retries_bucket{le="+Inf"} 2
+test_retries_sum 5
+test_retries_count 2
+`
+	if got := render(r); got != want {
+		t.Errorf("Render =\n%s\nwant\n%s", got, want)
+	}
+	if n := h.Count(); n != 2 {
+		t.Errorf("Count = %d, want 2", n)
+	}
+}
+
+func TestLabelCountMismatchPanics(t *testing.T) {
+	r := NewRegistry()
+	counter := NewCounterVec(r, "test_total", "Test.", "a", "b")
+	histogram := NewHistogramVec(r, "test_seconds", "Test.", []float64{1}, "a")
+
+	for name, call := range map[string]func(){
+		"counter with too few":     func() { counter.Inc("x") },
+		"counter with too many":    func() { counter.Add(1, "x", "y", "z") },
+		"histogram with none":      func() { histogram.Observe(1) },
+		"counter value with none":  func() { counter.Value() },
+		"histogram count with two": func() { histogram.Count("x", "y") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: did not panic", name)
+				}
+			}()
+			call()
+		}()
+	}
+}
+
+func TestHandler(t *testing.T) {
+	r := NewRegistry()
+	NewCounterVec(r, "test_total", "Test.").Inc()
+
+	rec := httptest.NewRecorder()
+	r.Handler().ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Header().Get("Content-Type"); ct != "text/plain; version=0.0.4; charset=utf-8" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+	if !strings.HasSuffix(rec.Body.String(), "test_total 1\n") {
+		t.Errorf("body =\n%s", rec.Body.String())
+	}
+}
+
+// TestProxyMetrics checks that the proxy's metrics render with one header
+// each and no duplicate names.
+func TestProxyMetrics(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, line := range strings.Split(render(Default), "\n") {
+		if !strings.HasPrefix(line, "# TYPE ") {
+			continue
+		}
+		name := strings.Fields(line)[2]
+		if seen[name] {
+			t.Errorf("metric %s is registered twice", name)
+		}
+		seen[name] = true
+	}
+	for _, name := range []string{"gemini_antiblock_requests_total", "gemini_antiblock_upstream_latency_seconds"} {
+		if !seen[name] {
+			t.Errorf("metric %s is not rendered", name)
+		}
+	}
+}
@@ -0,0 +1,75 @@
+package metrics
+
+// Default is the registry exposed on /metrics.
+var Default = NewRegistry()
+
+var (
+	latencyBuckets  = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60}
+	durationBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 120, 300, 600}
+	retryBuckets    = []float64{0, 1, 2, 3, 5, 10, 20, 50, 100}
+)
+
+var (
+	// RequestsTotal counts client requests by route, model and response status.
+	RequestsTotal = NewCounterVec(Default, "gemini_antiblock_requests_total",
+		"Client requests handled by the proxy.", "route", "model", "status")
+
+	// StreamSessions counts finished streaming sessions by outcome.
+	StreamSessions = NewCounterVec(Default, "gemini_antiblock_stream_sessions_total",
+		"Streaming sessions by outcome (clean, retry_limit, cancelled, circuit_open).", "outcome")
+
+	// StreamInterruptions counts interrupted stream attempts by reason.
+	StreamInterruptions = NewCounterVec(Default, "gemini_antiblock_stream_interruptions_total",
+		"Interrupted upstream stream attempts by reason.", "reason")
+
+	// SessionRetries records the number of retries each session needed.
+	SessionRetries = NewHistogramVec(Default, "gemini_antiblock_session_retries",
+		"Retries per streaming session.", retryBuckets)
+
+	// TimeToFirstToken records the time until the first formal text chunk
+	// reached the client.
+	TimeToFirstToken = NewHistogramVec(Default, "gemini_antiblock_time_to_first_token_seconds",
+		"Time from request start to the first formal text chunk sent to the client.", latencyBuckets)
+
+	// SessionDuration records the total duration of streaming sessions.
+	SessionDuration = NewHistogramVec(Default, "gemini_antiblock_session_duration_seconds",
+		"Duration of streaming sessions.", durationBuckets)
+
+	// SwallowedThoughts counts thought chunks dropped after a retry.
+	SwallowedThoughts = NewCounterVec(Default, "gemini_antiblock_swallowed_thought_chunks_total",
+		"Thought chunks swallowed after a retry.")
+
+	// RateLimitWait records how long requests waited in the rate limiter.
+	RateLimitWait = NewHistogramVec(Default, "gemini_antiblock_rate_limit_wait_seconds",
+		"Time requests spent waiting in the rate limiter.", latencyBuckets)
+
+	// RateLimitRejections counts requests answered with 429 by the rate
+	// limiter.
+	RateLimitRejections = NewCounterVec(Default, "gemini_antiblock_rate_limit_rejections_total",
+		"Requests rejected by the rate limiter.")
+
+	// RateLimitStoreErrors counts failed calls to the shared rate limit
+	// store.
+	RateLimitStoreErrors = NewCounterVec(Default, "gemini_antiblock_rate_limit_store_errors_total",
+		"Failed calls to the shared rate limit store.")
+
+	// ConcurrencyQueueWait records how long streaming sessions waited for a
+	// concurrency slot.
+	ConcurrencyQueueWait = NewHistogramVec(Default, "gemini_antiblock_concurrency_queue_wait_seconds",
+		"Time streaming sessions spent waiting for a concurrency slot.", latencyBuckets)
+
+	// ConcurrencyRejections counts streaming sessions answered with 503
+	// because no concurrency slot was free, by reason (queue_full, timeout).
+	ConcurrencyRejections = NewCounterVec(Default, "gemini_antiblock_concurrency_rejections_total",
+		"Streaming sessions rejected for lack of a concurrency slot, by reason (queue_full, timeout).", "reason")
+
+	// ConfigReloads counts configuration reloads by result (applied,
+	// unchanged, rejected).
+	ConfigReloads = NewCounterVec(Default, "gemini_antiblock_config_reloads_total",
+		"Configuration reloads by result (applied, unchanged, rejected).", "result")
+
+	// UpstreamLatency records the time until upstream response headers
+	// arrived, by kind of call (initial, retry, non_streaming).
+	UpstreamLatency = NewHistogramVec(Default, "gemini_antiblock_upstream_latency_seconds",
+		"Time until upstream response headers were received.", latencyBuckets, "kind")
+)
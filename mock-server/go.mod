@@ -1,5 +0,0 @@
-module mock-server
-
-go 1.21
-
-require github.com/gorilla/mux v1.8.1
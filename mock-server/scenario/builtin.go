@@ -0,0 +1,16 @@
+package scenario
+
+import "embed"
+
+//go:embed builtin/*.json
+var builtinFS embed.FS
+
+// Builtin returns the scenarios shipped with the mock server, including the
+// original type-1, type-2 and type-3 test cases.
+func Builtin() Set {
+	set := Set{}
+	if err := set.LoadFS(builtinFS, "builtin"); err != nil {
+		panic("invalid builtin scenario: " + err.Error())
+	}
+	return set
+}
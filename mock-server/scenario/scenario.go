@@ -0,0 +1,232 @@
+// Package scenario describes scripted upstream behavior for the mock server.
+//
+// A scenario lists, per attempt number, what the mock Gemini API does: which
+// chunks it streams, which HTTP status it returns, where it stalls or drops
+// the connection. Attempts are counted per conversation, so a scenario such
+// as "drop twice, then block, then succeed" plays out across the retries the
+// proxy makes for one client request.
+package scenario
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// Scenario is one scripted upstream behavior.
+type Scenario struct {
+	// Name selects the scenario, as the first path segment of a request
+	// (e.g. /drop-then-succeed/v1beta/models/...) or via the X-Mock-Scenario
+	// header.
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+	// DelayMs is the pause after every chunk, plus a random JitterMs.
+	DelayMs  int `json:"delayMs,omitempty"`
+	JitterMs int `json:"jitterMs,omitempty"`
+	// Attempts are played in order, one per upstream request of the same
+	// conversation. Requests beyond the last attempt repeat the last one.
+	Attempts []Attempt `json:"attempts"`
+}
+
+// Attempt is the response to one upstream request.
+type Attempt struct {
+	// Status is the HTTP status code. Anything other than 200 is answered
+	// with a Gemini-style JSON error and no stream. Defaults to 200.
+	Status int `json:"status,omitempty"`
+	// Message overrides the error message for non-200 statuses.
+	Message string `json:"message,omitempty"`
+	// HeaderDelayMs delays the response headers.
+	HeaderDelayMs int `json:"headerDelayMs,omitempty"`
+	// Headers are added to the response headers.
+	Headers map[string]string `json:"headers,omitempty"`
+	// Steps are streamed in order.
+	Steps []Step `json:"steps,omitempty"`
+}
+
+// Step is one event in an attempt. Chunk fields (Text, Thought,
+// FunctionCall, FinishReason, BlockReason, OversizedBytes) combine into a
+// single SSE data line; the remaining fields are actions and must appear
+// on their own.
+type Step struct {
+	Text         string        `json:"text,omitempty"`
+	Thought      bool          `json:"thought,omitempty"`
+	FunctionCall *FunctionCall `json:"functionCall,omitempty"`
+	FinishReason string        `json:"finishReason,omitempty"`
+	BlockReason  string        `json:"blockReason,omitempty"`
+	// TotalTokens adds usageMetadata reporting this running token total
+	// for the response.
+	TotalTokens int `json:"totalTokens,omitempty"`
+	// OversizedBytes replaces the text with a run of this many bytes, to
+	// exercise line-length limits.
+	OversizedBytes int `json:"oversizedBytes,omitempty"`
+
+	// Raw is written verbatim as a line, e.g. a comment or an event field.
+	Raw string `json:"raw,omitempty"`
+	// Malformed writes a data line whose JSON is truncated.
+	Malformed bool `json:"malformed,omitempty"`
+	// StallSeconds pauses the stream without closing it.
+	StallSeconds float64 `json:"stallSeconds,omitempty"`
+	// Disconnect drops the connection mid-stream without finishing the
+	// response.
+	Disconnect bool `json:"disconnect,omitempty"`
+}
+
+// FunctionCall is a functionCall part.
+type FunctionCall struct {
+	Name string                 `json:"name"`
+	Args map[string]interface{} `json:"args,omitempty"`
+}
+
+// isChunk reports whether the step produces a data line.
+func (s Step) isChunk() bool {
+	return s.Text != "" || s.Thought || s.FunctionCall != nil || s.FinishReason != "" ||
+		s.BlockReason != "" || s.OversizedBytes > 0
+}
+
+var namePattern = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// Validate checks that the scenario is well formed.
+func (sc *Scenario) Validate() error {
+	if !namePattern.MatchString(sc.Name) {
+		return fmt.Errorf("scenario name %q must be lowercase letters, digits, '-' or '_'", sc.Name)
+	}
+	if len(sc.Attempts) == 0 {
+		return fmt.Errorf("scenario %s: at least one attempt is required", sc.Name)
+	}
+	if sc.DelayMs < 0 || sc.JitterMs < 0 {
+		return fmt.Errorf("scenario %s: delays must not be negative", sc.Name)
+	}
+
+	for i, attempt := range sc.Attempts {
+		if attempt.Status != 0 && (attempt.Status < 100 || attempt.Status > 599) {
+			return fmt.Errorf("scenario %s attempt %d: invalid status %d", sc.Name, i+1, attempt.Status)
+		}
+		if attempt.HeaderDelayMs < 0 {
+			return fmt.Errorf("scenario %s attempt %d: headerDelayMs must not be negative", sc.Name, i+1)
+		}
+		for j, step := range attempt.Steps {
+			if err := step.validate(); err != nil {
+				return fmt.Errorf("scenario %s attempt %d step %d: %w", sc.Name, i+1, j+1, err)
+			}
+		}
+	}
+	return nil
+}
+
+func (s Step) validate() error {
+	kinds := 0
+	if s.isChunk() {
+		kinds++
+	}
+	if s.Raw != "" {
+		kinds++
+	}
+	if s.Malformed {
+		kinds++
+	}
+	if s.StallSeconds != 0 {
+		kinds++
+	}
+	if s.Disconnect {
+		kinds++
+	}
+
+	switch {
+	case kinds == 0:
+		return errors.New("empty step")
+	case kinds > 1:
+		return errors.New("raw, malformed, stallSeconds and disconnect must each be a separate step")
+	case s.StallSeconds < 0:
+		return errors.New("stallSeconds must not be negative")
+	case s.OversizedBytes < 0:
+		return errors.New("oversizedBytes must not be negative")
+	case s.OversizedBytes > 0 && s.Text != "":
+		return errors.New("oversizedBytes and text are mutually exclusive")
+	case s.FunctionCall != nil && s.FunctionCall.Name == "":
+		return errors.New("functionCall needs a name")
+	}
+	return nil
+}
+
+// AttemptFor returns the attempt played for the n-th request (1-based).
+func (sc *Scenario) AttemptFor(n int) Attempt {
+	if n < 1 {
+		n = 1
+	}
+	if n > len(sc.Attempts) {
+		n = len(sc.Attempts)
+	}
+	return sc.Attempts[n-1]
+}
+
+// Parse decodes and validates one scenario. Unknown fields are rejected so
+// typos do not silently change a test.
+func Parse(data []byte) (*Scenario, error) {
+	decoder := json.NewDecoder(strings.NewReader(string(data)))
+	decoder.DisallowUnknownFields()
+
+	sc := &Scenario{}
+	if err := decoder.Decode(sc); err != nil {
+		return nil, err
+	}
+	if err := sc.Validate(); err != nil {
+		return nil, err
+	}
+	return sc, nil
+}
+
+// Set is a collection of scenarios keyed by name.
+type Set map[string]*Scenario
+
+// Add validates sc and adds it, replacing any scenario of the same name.
+func (s Set) Add(sc *Scenario) error {
+	if err := sc.Validate(); err != nil {
+		return err
+	}
+	s[sc.Name] = sc
+	return nil
+}
+
+// Names returns the scenario names in sorted order.
+func (s Set) Names() []string {
+	names := make([]string, 0, len(s))
+	for name := range s {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// LoadFS reads every *.json file in dir of fsys into the set.
+func (s Set) LoadFS(fsys fs.FS, dir string) error {
+	entries, err := fs.ReadDir(fsys, dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		data, err := fs.ReadFile(fsys, filepath.ToSlash(filepath.Join(dir, entry.Name())))
+		if err != nil {
+			return err
+		}
+		sc, err := Parse(data)
+		if err != nil {
+			return fmt.Errorf("%s: %w", entry.Name(), err)
+		}
+		s[sc.Name] = sc
+	}
+	return nil
+}
+
+// LoadDir reads every *.json file in a directory on disk into the set.
+func (s Set) LoadDir(dir string) error {
+	return s.LoadFS(os.DirFS(dir), ".")
+}
@@ -0,0 +1,420 @@
+package scenario
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// ScenarioHeader selects a scenario by name, overriding the path.
+	ScenarioHeader = "X-Mock-Scenario"
+	// ConversationHeader names the conversation explicitly. Without it the
+	// conversation is derived from the scenario and the first message of
+	// the request, which the proxy keeps unchanged across retries.
+	ConversationHeader = "X-Mock-Conversation"
+	// AttemptHeader reports the attempt number on every response.
+	AttemptHeader = "X-Mock-Attempt"
+)
+
+// DefaultConversationTTL is how long a conversation is idle before its
+// attempt count starts over.
+const DefaultConversationTTL = 10 * time.Second
+
+// Server plays scenarios as a mock Gemini API.
+type Server struct {
+	scenarios Set
+	fallback  string
+	ttl       time.Duration
+
+	mu            sync.Mutex
+	conversations map[string]*conversation
+}
+
+type conversation struct {
+	attempts int
+	lastSeen time.Time
+}
+
+// NewServer creates a server for the given scenarios. Requests that do not
+// select a scenario play fallback.
+func NewServer(scenarios Set, fallback string) *Server {
+	return &Server{
+		scenarios:     scenarios,
+		fallback:      fallback,
+		ttl:           DefaultConversationTTL,
+		conversations: make(map[string]*conversation),
+	}
+}
+
+// SetConversationTTL changes how long an idle conversation is remembered.
+func (s *Server) SetConversationTTL(ttl time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ttl = ttl
+}
+
+// Reset forgets all attempt counts.
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.conversations = make(map[string]*conversation)
+}
+
+// Attempts returns how many requests the conversation has made so far.
+func (s *Server) Attempts(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conversations[key]; ok {
+		return c.attempts
+	}
+	return 0
+}
+
+// nextAttempt increments and returns the conversation's attempt number.
+func (s *Server) nextAttempt(key string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for k, c := range s.conversations {
+		if now.Sub(c.lastSeen) > s.ttl {
+			delete(s.conversations, k)
+		}
+	}
+
+	c, ok := s.conversations[key]
+	if !ok {
+		c = &conversation{}
+		s.conversations[key] = c
+	}
+	c.attempts++
+	c.lastSeen = now
+	return c.attempts
+}
+
+// touch keeps a conversation alive while a long attempt is streaming.
+func (s *Server) touch(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if c, ok := s.conversations[key]; ok {
+		c.lastSeen = time.Now()
+	}
+}
+
+// Select returns the scenario for a request: the X-Mock-Scenario header,
+// else a first path segment naming a scenario (/type-1/v1beta/...), else
+// the fallback.
+func (s *Server) Select(r *http.Request) (*Scenario, bool) {
+	if name := r.Header.Get(ScenarioHeader); name != "" {
+		sc, ok := s.scenarios[name]
+		return sc, ok
+	}
+	segment := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)[0]
+	if sc, ok := s.scenarios[segment]; ok {
+		return sc, true
+	}
+	sc, ok := s.scenarios[s.fallback]
+	return sc, ok
+}
+
+// ConversationKey identifies the conversation a request belongs to.
+func ConversationKey(scenarioName string, header http.Header, body []byte) string {
+	if key := header.Get(ConversationHeader); key != "" {
+		return scenarioName + ":" + key
+	}
+
+	var request struct {
+		Contents []interface{} `json:"contents"`
+	}
+	if err := json.Unmarshal(body, &request); err != nil || len(request.Contents) == 0 {
+		return scenarioName
+	}
+	// Re-encoding sorts object keys, so the key does not depend on how the
+	// proxy happened to serialize the message.
+	first, _ := json.Marshal(request.Contents[0])
+	sum := sha256.Sum256(first)
+	return scenarioName + ":" + hex.EncodeToString(sum[:8])
+}
+
+// ServeHTTP implements http.Handler.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost && r.URL.Path == "/_mock/reset" {
+		s.Reset()
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	if r.Method != http.MethodPost {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	sc, ok := s.Select(r)
+	if !ok {
+		writeError(w, http.StatusNotFound, "unknown mock scenario")
+		return
+	}
+
+	body, _ := io.ReadAll(r.Body)
+	key := ConversationKey(sc.Name, r.Header, body)
+	n := s.nextAttempt(key)
+	attempt := sc.AttemptFor(n)
+	defer s.touch(key)
+
+	streaming := strings.Contains(r.URL.Path, "stream") ||
+		r.URL.Query().Get("alt") == "sse" ||
+		r.URL.Query().Get("stream") == "true"
+	log.Printf("Scenario %s, conversation %s, attempt %d (streaming=%t)", sc.Name, key, n, streaming)
+
+	w.Header().Set(AttemptHeader, strconv.Itoa(n))
+	for name, value := range attempt.Headers {
+		w.Header().Set(name, value)
+	}
+	if !sleep(r.Context(), time.Duration(attempt.HeaderDelayMs)*time.Millisecond) {
+		return
+	}
+
+	status := attempt.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	if status != http.StatusOK {
+		message := attempt.Message
+		if message == "" {
+			message = fmt.Sprintf("Mock scenario %s attempt %d returned %d", sc.Name, n, status)
+		}
+		writeError(w, status, message)
+		return
+	}
+
+	if streaming {
+		s.stream(w, r, sc, attempt, key)
+	} else {
+		s.respond(w, r, sc, attempt)
+	}
+}
+
+// stream plays an attempt as an SSE response.
+func (s *Server) stream(w http.ResponseWriter, r *http.Request, sc *Scenario, attempt Attempt, key string) {
+	w.Header().Set("Content-Type", "text/event-stream; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+	w.Header().Set("Connection", "keep-alive")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+	flush(w)
+
+	for _, step := range attempt.Steps {
+		switch {
+		case step.Disconnect:
+			log.Printf("Scenario %s: dropping connection", sc.Name)
+			// Aborting the handler closes the connection without the
+			// terminating chunk, so the client sees an unexpected EOF.
+			panic(http.ErrAbortHandler)
+		case step.StallSeconds > 0:
+			if !sleep(r.Context(), time.Duration(step.StallSeconds*float64(time.Second))) {
+				return
+			}
+			s.touch(key)
+			continue
+		case step.Raw != "":
+			fmt.Fprintf(w, "%s\n\n", step.Raw)
+		case step.Malformed:
+			fmt.Fprint(w, "data: {\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"trunc\n\n")
+		default:
+			data, _ := json.Marshal(chunk(step))
+			fmt.Fprintf(w, "data: %s\n\n", data)
+		}
+		flush(w)
+		if !sleep(r.Context(), sc.delay()) {
+			return
+		}
+	}
+}
+
+// respond plays an attempt as a single generateContent response.
+func (s *Server) respond(w http.ResponseWriter, r *http.Request, sc *Scenario, attempt Attempt) {
+	var parts []map[string]interface{}
+	var text strings.Builder
+	finishReason, blockReason := "", ""
+	totalTokens := 0
+	malformed := false
+
+	for _, step := range attempt.Steps {
+		switch {
+		case step.Disconnect:
+			panic(http.ErrAbortHandler)
+		case step.StallSeconds > 0:
+			if !sleep(r.Context(), time.Duration(step.StallSeconds*float64(time.Second))) {
+				return
+			}
+		case step.Malformed:
+			malformed = true
+		case step.Raw != "":
+		default:
+			if step.Thought || step.FunctionCall != nil {
+				parts = append(parts, part(step))
+			} else {
+				text.WriteString(step.Text)
+				if step.OversizedBytes > 0 {
+					text.WriteString(strings.Repeat("x", step.OversizedBytes))
+				}
+			}
+			if step.FinishReason != "" {
+				finishReason = step.FinishReason
+			}
+			if step.BlockReason != "" {
+				blockReason = step.BlockReason
+			}
+			if step.TotalTokens > 0 {
+				totalTokens = step.TotalTokens
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	if malformed {
+		fmt.Fprint(w, "{\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"trunc")
+		return
+	}
+
+	if text.Len() > 0 || len(parts) == 0 {
+		parts = append(parts, map[string]interface{}{"text": text.String()})
+	}
+	response := map[string]interface{}{}
+	if blockReason != "" {
+		response["promptFeedback"] = map[string]interface{}{"blockReason": blockReason}
+	} else {
+		candidate := map[string]interface{}{
+			"content": map[string]interface{}{"parts": parts, "role": "model"},
+		}
+		if finishReason != "" {
+			candidate["finishReason"] = finishReason
+		}
+		response["candidates"] = []interface{}{candidate}
+	}
+	if totalTokens > 0 {
+		response["usageMetadata"] = usage(totalTokens)
+	}
+	json.NewEncoder(w).Encode(response)
+}
+
+// chunk builds the streamGenerateContent payload for a step.
+func chunk(step Step) map[string]interface{} {
+	data := map[string]interface{}{}
+	if step.BlockReason != "" {
+		data["promptFeedback"] = map[string]interface{}{"blockReason": step.BlockReason}
+		if step.Text == "" && !step.Thought && step.FunctionCall == nil && step.FinishReason == "" {
+			return data
+		}
+	}
+
+	candidate := map[string]interface{}{
+		"content": map[string]interface{}{
+			"parts": []interface{}{part(step)},
+			"role":  "model",
+		},
+	}
+	if step.FinishReason != "" {
+		candidate["finishReason"] = step.FinishReason
+	}
+	data["candidates"] = []interface{}{candidate}
+	if step.TotalTokens > 0 {
+		data["usageMetadata"] = usage(step.TotalTokens)
+	}
+	return data
+}
+
+func usage(totalTokens int) map[string]interface{} {
+	return map[string]interface{}{"totalTokenCount": totalTokens}
+}
+
+func part(step Step) map[string]interface{} {
+	if step.FunctionCall != nil {
+		call := map[string]interface{}{"name": step.FunctionCall.Name}
+		if step.FunctionCall.Args != nil {
+			call["args"] = step.FunctionCall.Args
+		}
+		return map[string]interface{}{"functionCall": call}
+	}
+
+	text := step.Text
+	if step.OversizedBytes > 0 {
+		text = strings.Repeat("x", step.OversizedBytes)
+	}
+	p := map[string]interface{}{"text": text}
+	if step.Thought {
+		p["thought"] = true
+	}
+	return p
+}
+
+var errorStatuses = map[int]string{
+	400: "INVALID_ARGUMENT",
+	401: "UNAUTHENTICATED",
+	403: "PERMISSION_DENIED",
+	404: "NOT_FOUND",
+	429: "RESOURCE_EXHAUSTED",
+	500: "INTERNAL",
+	503: "UNAVAILABLE",
+	504: "DEADLINE_EXCEEDED",
+}
+
+// writeError writes a Gemini-style JSON error.
+func writeError(w http.ResponseWriter, status int, message string) {
+	name, ok := errorStatuses[status]
+	if !ok {
+		name = "UNKNOWN"
+	}
+	var body bytes.Buffer
+	json.NewEncoder(&body).Encode(map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    status,
+			"message": message,
+			"status":  name,
+		},
+	})
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	w.WriteHeader(status)
+	w.Write(body.Bytes())
+}
+
+func (sc *Scenario) delay() time.Duration {
+	d := time.Duration(sc.DelayMs) * time.Millisecond
+	if sc.JitterMs > 0 {
+		d += time.Duration(rand.Intn(sc.JitterMs)) * time.Millisecond
+	}
+	return d
+}
+
+// sleep waits for d, returning false if the client went away first.
+func sleep(ctx context.Context, d time.Duration) bool {
+	if d <= 0 {
+		return ctx.Err() == nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func flush(w http.ResponseWriter) {
+	if f, ok := w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
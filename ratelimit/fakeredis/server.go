@@ -0,0 +1,193 @@
+// Package fakeredis is an in-process stand-in for a Redis server, for tests.
+// It speaks RESP and understands the commands ratelimit.RedisStore sends,
+// running ratelimit.TakeScript natively on a ratelimit.MemoryStore instead
+// of interpreting Lua.
+package fakeredis
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/ratelimit"
+)
+
+// Server is a RESP server listening on a loopback port.
+type Server struct {
+	ln       net.Listener
+	password string
+	store    *ratelimit.MemoryStore
+
+	mu       sync.Mutex
+	scripts  map[string]bool
+	conns    map[net.Conn]bool
+	commands []string
+	down     bool
+}
+
+// NewServer starts a server. If password is set, clients must AUTH.
+func NewServer(password string) (*Server, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+	s := &Server{
+		ln:       ln,
+		password: password,
+		store:    ratelimit.NewMemoryStore(),
+		scripts:  make(map[string]bool),
+		conns:    make(map[net.Conn]bool),
+	}
+	go s.serve()
+	return s, nil
+}
+
+// Addr returns the address the server listens on.
+func (s *Server) Addr() string {
+	return s.ln.Addr().String()
+}
+
+// Close stops the server and drops every connection.
+func (s *Server) Close() {
+	s.ln.Close()
+	s.SetDown(true)
+}
+
+// SetDown makes the server drop every connection, existing and new, until
+// it is set up again, as if it were unreachable.
+func (s *Server) SetDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.down = down
+	if down {
+		for conn := range s.conns {
+			conn.Close()
+		}
+	}
+}
+
+// Commands returns the names of the commands received so far.
+func (s *Server) Commands() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string(nil), s.commands...)
+}
+
+func (s *Server) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		if s.down {
+			conn.Close()
+		} else {
+			s.conns[conn] = true
+			go s.handle(conn)
+		}
+		s.mu.Unlock()
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	authenticated := s.password == ""
+	for {
+		request, err := ratelimit.ReadReply(r)
+		if err != nil {
+			return
+		}
+		items, ok := request.([]interface{})
+		if !ok || len(items) == 0 {
+			conn.Write([]byte("-ERR expected a command array\r\n"))
+			continue
+		}
+		args := make([]string, len(items))
+		for i, item := range items {
+			args[i], _ = item.(string)
+		}
+		name := strings.ToUpper(args[0])
+		s.mu.Lock()
+		s.commands = append(s.commands, name)
+		s.mu.Unlock()
+
+		if !authenticated && name != "AUTH" {
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+			continue
+		}
+		switch name {
+		case "AUTH":
+			if len(args) != 2 || args[1] != s.password {
+				conn.Write([]byte("-WRONGPASS invalid username-password pair\r\n"))
+				continue
+			}
+			authenticated = true
+			conn.Write([]byte("+OK\r\n"))
+		case "PING":
+			conn.Write([]byte("+PONG\r\n"))
+		case "SELECT":
+			conn.Write([]byte("+OK\r\n"))
+		case "EVALSHA", "EVAL":
+			conn.Write(s.eval(name, args[1:]))
+		default:
+			fmt.Fprintf(conn, "-ERR unknown command '%s'\r\n", args[0])
+		}
+	}
+}
+
+// eval runs ratelimit.TakeScript, given as a script or by SHA.
+func (s *Server) eval(name string, args []string) []byte {
+	if len(args) < 2 {
+		return []byte("-ERR wrong number of arguments\r\n")
+	}
+	s.mu.Lock()
+	if name == "EVAL" {
+		if args[0] != ratelimit.TakeScript {
+			s.mu.Unlock()
+			return []byte("-ERR fakeredis only runs ratelimit.TakeScript\r\n")
+		}
+		s.scripts[ratelimit.TakeScriptSHA] = true
+	} else if !s.scripts[args[0]] {
+		s.mu.Unlock()
+		return []byte("-NOSCRIPT No matching script. Please use EVAL.\r\n")
+	}
+	s.mu.Unlock()
+
+	if len(args) != 7 || args[1] != "1" {
+		return []byte("-ERR wrong number of arguments for the rate limit script\r\n")
+	}
+	var values [4]float64
+	for i, arg := range args[3:] {
+		v, err := strconv.ParseFloat(arg, 64)
+		if err != nil {
+			return []byte("-ERR value is not a number\r\n")
+		}
+		values[i] = v
+	}
+	maxWait := ratelimit.NoMaxWait
+	if values[3] >= 0 {
+		maxWait = time.Duration(values[3] * float64(time.Second))
+	}
+	limit := ratelimit.Limit{Rate: values[0], Burst: values[1]}
+	level, taken, _ := s.store.Take(context.Background(), args[2], limit, values[2], maxWait)
+
+	levelText := strconv.FormatFloat(level, 'g', 14, 64)
+	takenFlag := 0
+	if taken {
+		takenFlag = 1
+	}
+	return []byte(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n:%d\r\n", len(levelText), levelText, takenFlag))
+}
@@ -0,0 +1,93 @@
+package ratelimit
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// fallbackRetryInterval is how long FallbackStore uses local buckets after
+// the shared store failed, before trying it again.
+const fallbackRetryInterval = 5 * time.Second
+
+// FallbackStore uses a shared store while it works and local buckets while
+// it does not, so that an unreachable store degrades limits to per-replica
+// ones instead of failing or blocking requests.
+type FallbackStore struct {
+	shared LimiterStore
+	local  LimiterStore
+
+	mu       sync.Mutex
+	retryAt  time.Time
+	degraded bool
+}
+
+// NewFallbackStore creates a store that falls back from shared to local.
+func NewFallbackStore(shared, local LimiterStore) *FallbackStore {
+	return &FallbackStore{shared: shared, local: local}
+}
+
+// Take implements LimiterStore. It only fails if the local store does.
+func (s *FallbackStore) Take(ctx context.Context, key string, limit Limit, tokens float64, maxWait time.Duration) (float64, bool, error) {
+	if s.useShared() {
+		level, taken, err := s.shared.Take(ctx, key, limit, tokens, maxWait)
+		if err == nil {
+			s.recovered()
+			return level, taken, nil
+		}
+		s.failed(err)
+	}
+	return s.local.Take(ctx, key, limit, tokens, maxWait)
+}
+
+// Degraded reports whether local buckets are in use because the shared
+// store failed.
+func (s *FallbackStore) Degraded() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.degraded
+}
+
+func (s *FallbackStore) useShared() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return !s.degraded || !time.Now().Before(s.retryAt)
+}
+
+func (s *FallbackStore) failed(err error) {
+	metrics.RateLimitStoreErrors.Inc()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.degraded {
+		logger.LogWarn(fmt.Sprintf("Rate limit store unavailable, falling back to local limits: %v", err))
+	}
+	s.degraded = true
+	s.retryAt = time.Now().Add(fallbackRetryInterval)
+}
+
+func (s *FallbackStore) recovered() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.degraded {
+		logger.LogInfo("Rate limit store reachable again, using shared limits")
+	}
+	s.degraded = false
+}
+
+// RegisterMetrics exposes whether the store has fallen back to local
+// limits as a gauge.
+func (s *FallbackStore) RegisterMetrics(reg *metrics.Registry) {
+	metrics.NewGaugeFunc(reg, "gemini_antiblock_rate_limit_store_degraded",
+		"1 while rate limits fall back to local buckets because the shared store is unavailable.",
+		func(emit func(value float64, labelValues ...string)) {
+			value := 0.0
+			if s.Degraded() {
+				value = 1
+			}
+			emit(value)
+		})
+}
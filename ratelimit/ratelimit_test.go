@@ -0,0 +1,132 @@
+package ratelimit_test
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"gemini-antiblock/ratelimit"
+	"gemini-antiblock/ratelimit/fakeredis"
+)
+
+// perMinute is a bucket of three tokens refilling too slowly to matter
+// within a test.
+var perMinute = ratelimit.Limit{Rate: 3.0 / 60, Burst: 3}
+
+func newRedis(t *testing.T, password string) (*fakeredis.Server, *ratelimit.RedisStore) {
+	t.Helper()
+	server, err := fakeredis.NewServer(password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+	store := ratelimit.NewRedisStore(ratelimit.RedisOptions{Addr: server.Addr(), Password: password, Timeout: time.Second})
+	t.Cleanup(func() { store.Close() })
+	return server, store
+}
+
+type takeCase struct {
+	tokens    float64
+	maxWait   time.Duration
+	wantLevel float64
+	wantTaken bool
+}
+
+func runTakes(t *testing.T, store ratelimit.LimiterStore, key string, cases []takeCase) {
+	t.Helper()
+	for i, c := range cases {
+		level, taken, err := store.Take(context.Background(), key, perMinute, c.tokens, c.maxWait)
+		if err != nil {
+			t.Fatalf("take %d: %v", i+1, err)
+		}
+		// The bucket refills a little between takes.
+		if taken != c.wantTaken || level < c.wantLevel || level > c.wantLevel+0.01 {
+			t.Errorf("take %d of %v: got level %.3f, taken %t; want %.0f, %t", i+1, c.tokens, level, taken, c.wantLevel, c.wantTaken)
+		}
+	}
+}
+
+func TestTake(t *testing.T) {
+	cases := []takeCase{
+		{tokens: 1, maxWait: 0, wantLevel: 2, wantTaken: true},
+		{tokens: 2, maxWait: 0, wantLevel: 0, wantTaken: true},
+		{tokens: 1, maxWait: 0, wantLevel: 0, wantTaken: false},
+		// A token 20s away is reserved within a minute's wait.
+		{tokens: 1, maxWait: time.Minute, wantLevel: -1, wantTaken: true},
+		{tokens: 1, maxWait: 30 * time.Second, wantLevel: -1, wantTaken: false},
+		{tokens: 5, maxWait: ratelimit.NoMaxWait, wantLevel: -6, wantTaken: true},
+		{tokens: -10, maxWait: 0, wantLevel: 3, wantTaken: true},
+	}
+
+	t.Run("memory", func(t *testing.T) {
+		runTakes(t, ratelimit.NewMemoryStore(), "tenant", cases)
+	})
+	t.Run("redis", func(t *testing.T) {
+		_, store := newRedis(t, "")
+		runTakes(t, store, "tenant", cases)
+	})
+}
+
+func TestRedisStoreShared(t *testing.T) {
+	server, first := newRedis(t, "secret")
+	second := ratelimit.NewRedisStore(ratelimit.RedisOptions{Addr: server.Addr(), Password: "secret", Timeout: time.Second})
+	defer second.Close()
+
+	runTakes(t, first, "tenant", []takeCase{{tokens: 2, wantLevel: 1, wantTaken: true}})
+	runTakes(t, second, "tenant", []takeCase{
+		{tokens: 1, wantLevel: 0, wantTaken: true},
+		{tokens: 1, wantLevel: 0, wantTaken: false},
+	})
+	runTakes(t, second, "other", []takeCase{{tokens: 1, wantLevel: 2, wantTaken: true}})
+
+	// The script is sent once, then referred to by its SHA.
+	var evals, evalSHAs int
+	for _, command := range server.Commands() {
+		switch command {
+		case "EVAL":
+			evals++
+		case "EVALSHA":
+			evalSHAs++
+		}
+	}
+	if evals != 1 || evalSHAs != 4 {
+		t.Errorf("sent EVAL %d times and EVALSHA %d times, want 1 and 4", evals, evalSHAs)
+	}
+}
+
+func TestRedisStoreErrors(t *testing.T) {
+	server, _ := newRedis(t, "secret")
+
+	wrong := ratelimit.NewRedisStore(ratelimit.RedisOptions{Addr: server.Addr(), Password: "wrong", Timeout: time.Second})
+	defer wrong.Close()
+	if err := wrong.Ping(context.Background()); err == nil || !strings.Contains(err.Error(), "WRONGPASS") {
+		t.Errorf("Ping with the wrong password = %v, want WRONGPASS", err)
+	}
+
+	server.Close()
+	down := ratelimit.NewRedisStore(ratelimit.RedisOptions{Addr: server.Addr(), Timeout: 100 * time.Millisecond})
+	defer down.Close()
+	if _, _, err := down.Take(context.Background(), "tenant", perMinute, 1, 0); err == nil {
+		t.Error("Take with the server down succeeded")
+	}
+}
+
+func TestFallbackStore(t *testing.T) {
+	server, shared := newRedis(t, "")
+	store := ratelimit.NewFallbackStore(shared, ratelimit.NewMemoryStore())
+
+	runTakes(t, store, "tenant", []takeCase{{tokens: 3, wantLevel: 0, wantTaken: true}})
+	if store.Degraded() {
+		t.Fatal("degraded while the shared store works")
+	}
+
+	server.SetDown(true)
+	runTakes(t, store, "tenant", []takeCase{{tokens: 1, wantLevel: 2, wantTaken: true}})
+	if !store.Degraded() {
+		t.Error("not degraded after the shared store failed")
+	}
+	// Local buckets are used until the shared store is retried.
+	server.SetDown(false)
+	runTakes(t, store, "tenant", []takeCase{{tokens: 1, wantLevel: 1, wantTaken: true}})
+}
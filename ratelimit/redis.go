@@ -0,0 +1,289 @@
+package ratelimit
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TakeScript is the Lua script RedisStore runs for Take. Buckets are hashes
+// holding the level and the time it was computed, taken from the Redis
+// server so that replicas with skewed clocks agree. They expire once they
+// would have refilled completely.
+//
+// KEYS[1] is the bucket; ARGV holds the rate, burst, tokens and maxWait in
+// seconds (negative for no maximum). It returns the level as a string and
+// 1 if the tokens were taken, 0 otherwise.
+const TakeScript = `
+local rate = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+local tokens = tonumber(ARGV[3])
+local max_wait = tonumber(ARGV[4])
+local time = redis.call('TIME')
+local now = tonumber(time[1]) + tonumber(time[2]) / 1000000
+local state = redis.call('HMGET', KEYS[1], 'level', 'at')
+local level = tonumber(state[1]) or burst
+local at = tonumber(state[2]) or now
+if now > at then
+  level = math.min(burst, level + (now - at) * rate)
+end
+local wait = 0
+if level < tokens then
+  wait = (tokens - level) / rate
+end
+local taken = 0
+if max_wait < 0 or wait <= max_wait then
+  level = math.min(burst, level - tokens)
+  taken = 1
+end
+redis.call('HSET', KEYS[1], 'level', tostring(level), 'at', tostring(now))
+redis.call('PEXPIRE', KEYS[1], math.ceil((burst - level) / rate * 1000) + 1000)
+return {tostring(level), taken}
+`
+
+// TakeScriptSHA is the SHA1 digest EVALSHA refers to TakeScript by.
+var TakeScriptSHA = func() string {
+	sum := sha1.Sum([]byte(TakeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisOptions configures a RedisStore.
+type RedisOptions struct {
+	// Addr is the server address, host:port.
+	Addr     string
+	Password string
+	DB       int
+	// Timeout bounds dialing and each command. Defaults to 100ms.
+	Timeout time.Duration
+	// PoolSize is the number of idle connections kept. Defaults to 16.
+	PoolSize int
+	// KeyPrefix is put in front of every bucket key. Defaults to
+	// "gemini-antiblock:ratelimit:".
+	KeyPrefix string
+}
+
+// RedisStore keeps buckets in Redis, or any server speaking the Redis
+// protocol with Lua scripting, so that every proxy replica shares them.
+// Bucket keys are hashed, so API keys used as limit keys are not stored.
+type RedisStore struct {
+	opts RedisOptions
+	mu   sync.Mutex
+	idle []*respConn
+}
+
+// NewRedisStore creates a store for the server in opts. Connections are
+// made on first use.
+func NewRedisStore(opts RedisOptions) *RedisStore {
+	if opts.Timeout <= 0 {
+		opts.Timeout = 100 * time.Millisecond
+	}
+	if opts.PoolSize <= 0 {
+		opts.PoolSize = 16
+	}
+	if opts.KeyPrefix == "" {
+		opts.KeyPrefix = "gemini-antiblock:ratelimit:"
+	}
+	return &RedisStore{opts: opts}
+}
+
+// Take implements LimiterStore with TakeScript.
+func (s *RedisStore) Take(ctx context.Context, key string, limit Limit, tokens float64, maxWait time.Duration) (float64, bool, error) {
+	sum := sha256.Sum256([]byte(key))
+	args := []string{
+		"1", s.opts.KeyPrefix + hex.EncodeToString(sum[:16]),
+		formatFloat(limit.Rate), formatFloat(limit.Burst), formatFloat(tokens), formatFloat(maxWait.Seconds()),
+	}
+	if maxWait < 0 {
+		args[len(args)-1] = "-1"
+	}
+
+	reply, err := s.do(ctx, append([]string{"EVALSHA", TakeScriptSHA}, args...)...)
+	if err != nil && strings.HasPrefix(err.Error(), "NOSCRIPT") {
+		reply, err = s.do(ctx, append([]string{"EVAL", TakeScript}, args...)...)
+	}
+	if err != nil {
+		return 0, false, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 2 {
+		return 0, false, fmt.Errorf("unexpected reply to rate limit script: %v", reply)
+	}
+	levelText, _ := values[0].(string)
+	level, err := strconv.ParseFloat(levelText, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("unexpected level in rate limit script reply: %q", levelText)
+	}
+	taken, _ := values[1].(int64)
+	return level, taken == 1, nil
+}
+
+// Ping checks that the server is reachable.
+func (s *RedisStore) Ping(ctx context.Context) error {
+	_, err := s.do(ctx, "PING")
+	return err
+}
+
+// Close closes the idle connections.
+func (s *RedisStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, c := range s.idle {
+		c.conn.Close()
+	}
+	s.idle = nil
+	return nil
+}
+
+// do sends one command and reads its reply. Error replies are returned as
+// errors; a connection that saw any other error is discarded.
+func (s *RedisStore) do(ctx context.Context, args ...string) (interface{}, error) {
+	c, err := s.get(ctx)
+	if err != nil {
+		return nil, err
+	}
+	deadline := time.Now().Add(s.opts.Timeout)
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	c.conn.SetDeadline(deadline)
+
+	reply, err := c.command(args...)
+	var replyErr respError
+	if err != nil && !errors.As(err, &replyErr) {
+		c.conn.Close()
+		return nil, err
+	}
+	s.put(c)
+	return reply, err
+}
+
+func (s *RedisStore) get(ctx context.Context) (*respConn, error) {
+	s.mu.Lock()
+	if n := len(s.idle); n > 0 {
+		c := s.idle[n-1]
+		s.idle = s.idle[:n-1]
+		s.mu.Unlock()
+		return c, nil
+	}
+	s.mu.Unlock()
+
+	dialer := net.Dialer{Timeout: s.opts.Timeout}
+	conn, err := dialer.DialContext(ctx, "tcp", s.opts.Addr)
+	if err != nil {
+		return nil, err
+	}
+	c := &respConn{conn: conn, r: bufio.NewReader(conn)}
+	conn.SetDeadline(time.Now().Add(s.opts.Timeout))
+	if s.opts.Password != "" {
+		if _, err := c.command("AUTH", s.opts.Password); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis AUTH: %w", err)
+		}
+	}
+	if s.opts.DB != 0 {
+		if _, err := c.command("SELECT", strconv.Itoa(s.opts.DB)); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("redis SELECT: %w", err)
+		}
+	}
+	return c, nil
+}
+
+func (s *RedisStore) put(c *respConn) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.idle) < s.opts.PoolSize {
+		s.idle = append(s.idle, c)
+		return
+	}
+	c.conn.Close()
+}
+
+func formatFloat(f float64) string {
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+// respConn is a connection speaking RESP, the Redis protocol.
+type respConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// respError is an error reply from the server.
+type respError string
+
+func (e respError) Error() string { return string(e) }
+
+func (c *respConn) command(args ...string) (interface{}, error) {
+	if _, err := c.conn.Write(EncodeCommand(args...)); err != nil {
+		return nil, err
+	}
+	return ReadReply(c.r)
+}
+
+// EncodeCommand encodes a command as a RESP array of bulk strings.
+func EncodeCommand(args ...string) []byte {
+	var b strings.Builder
+	fmt.Fprintf(&b, "*%d\r\n", len(args))
+	for _, arg := range args {
+		fmt.Fprintf(&b, "$%d\r\n%s\r\n", len(arg), arg)
+	}
+	return []byte(b.String())
+}
+
+// ReadReply reads one RESP value. Simple and bulk strings are returned as
+// string, integers as int64, arrays as []interface{} and nil values as
+// nil. Error replies are returned as errors.
+func ReadReply(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, fmt.Errorf("malformed RESP line %q", line)
+	}
+	kind, body := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, respError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		values := make([]interface{}, n)
+		for i := range values {
+			if values[i], err = ReadReply(r); err != nil {
+				return nil, err
+			}
+		}
+		return values, nil
+	default:
+		return nil, fmt.Errorf("unknown RESP type %q", kind)
+	}
+}
@@ -0,0 +1,118 @@
+// Package ratelimit stores token bucket state for the proxy's rate limits,
+// either in process or in Redis so that several replicas share budgets.
+package ratelimit
+
+import (
+	"context"
+	"math"
+	"sync"
+	"time"
+)
+
+// NoMaxWait makes Take take tokens however long the bucket needs to
+// refill, leaving it overdrawn if necessary.
+const NoMaxWait time.Duration = -1
+
+// Limit describes a token bucket: it refills at Rate tokens per second and
+// holds at most Burst tokens. A new bucket starts full.
+type Limit struct {
+	Rate  float64
+	Burst float64
+}
+
+// LimiterStore holds token buckets by key. Take must be atomic, so that
+// concurrent callers never spend the same tokens.
+type LimiterStore interface {
+	// Take refills the bucket at key, then takes the given number of tokens
+	// if the bucket holds them or will within maxWait. A negative count
+	// gives tokens back. It returns the tokens left afterwards, negative
+	// when the bucket was overdrawn, and whether the tokens were taken.
+	Take(ctx context.Context, key string, limit Limit, tokens float64, maxWait time.Duration) (level float64, taken bool, err error)
+}
+
+// take applies a Take to a bucket holding level tokens, refilled up to
+// elapsed seconds ago. Stores implement the same arithmetic.
+func take(level, elapsed float64, limit Limit, tokens float64, maxWait time.Duration) (float64, bool) {
+	if elapsed > 0 {
+		level = math.Min(limit.Burst, level+elapsed*limit.Rate)
+	}
+	wait := 0.0
+	if level < tokens {
+		wait = (tokens - level) / limit.Rate
+	}
+	if maxWait >= 0 && wait > maxWait.Seconds() {
+		return level, false
+	}
+	return math.Min(limit.Burst, level-tokens), true
+}
+
+// refillTime returns how long a bucket at level needs to fill up.
+func refillTime(level float64, limit Limit) time.Duration {
+	if level >= limit.Burst {
+		return 0
+	}
+	return time.Duration((limit.Burst - level) / limit.Rate * float64(time.Second))
+}
+
+// MemoryStore keeps buckets in process. Buckets that have refilled
+// completely are evicted, so memory is bounded by the keys active within
+// one refill period.
+type MemoryStore struct {
+	mu        sync.Mutex
+	buckets   map[string]*memoryBucket
+	lastSweep time.Time
+}
+
+type memoryBucket struct {
+	level float64
+	last  time.Time
+	full  time.Time // when the bucket is full again
+}
+
+// sweepInterval is how often MemoryStore looks for buckets to evict.
+const sweepInterval = time.Minute
+
+// NewMemoryStore creates an empty in-process store.
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{buckets: make(map[string]*memoryBucket)}
+}
+
+// Take implements LimiterStore. It never fails.
+func (s *MemoryStore) Take(ctx context.Context, key string, limit Limit, tokens float64, maxWait time.Duration) (float64, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	s.sweep(now)
+	b, ok := s.buckets[key]
+	if !ok {
+		b = &memoryBucket{level: limit.Burst, last: now}
+		s.buckets[key] = b
+	}
+	level, taken := take(b.level, now.Sub(b.last).Seconds(), limit, tokens, maxWait)
+	b.level, b.last = level, now
+	b.full = now.Add(refillTime(level, limit))
+	return level, taken, nil
+}
+
+// Len returns the number of buckets held.
+func (s *MemoryStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.buckets)
+}
+
+// sweep evicts full buckets, at most once per sweepInterval. An evicted
+// bucket is indistinguishable from a new one. The caller must hold the
+// mutex.
+func (s *MemoryStore) sweep(now time.Time) {
+	if now.Sub(s.lastSweep) < sweepInterval {
+		return
+	}
+	s.lastSweep = now
+	for key, b := range s.buckets {
+		if !now.Before(b.full) {
+			delete(s.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+package recorder
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"os"
+	"sync"
+	"time"
+)
+
+// Options configures a Recorder.
+type Options struct {
+	// Path is the JSONL file transcripts are appended to.
+	Path string
+	// MaxBytes rotates the file once it would grow past this size.
+	MaxBytes int64
+	// MaxBackups is the number of rotated files (Path.1, Path.2, ...) kept.
+	MaxBackups int
+	// SamplePercent is the share of sessions recorded, from 0 to 100.
+	SamplePercent int
+	// RedactFields lists JSON field names whose values are masked in
+	// recorded request bodies, e.g. "text" to drop prompt content.
+	RedactFields []string
+}
+
+// Recorder appends session transcripts to a size-rotated JSONL file.
+type Recorder struct {
+	mu     sync.Mutex
+	opts   Options
+	file   *os.File
+	size   int64
+	fields map[string]bool
+}
+
+// New opens (or creates) the transcript file.
+func New(opts Options) (*Recorder, error) {
+	if opts.MaxBackups < 0 {
+		opts.MaxBackups = 0
+	}
+	fields := make(map[string]bool, len(opts.RedactFields))
+	for _, f := range opts.RedactFields {
+		fields[f] = true
+	}
+
+	r := &Recorder{opts: opts, fields: fields}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *Recorder) open() error {
+	file, err := os.OpenFile(r.opts.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+	if err != nil {
+		return fmt.Errorf("open transcript file: %w", err)
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return fmt.Errorf("stat transcript file: %w", err)
+	}
+	r.file = file
+	r.size = info.Size()
+	return nil
+}
+
+// Sample decides whether the next session should be recorded.
+func (r *Recorder) Sample() bool {
+	if r == nil {
+		return false
+	}
+	if r.opts.SamplePercent >= 100 {
+		return true
+	}
+	return rand.Intn(100) < r.opts.SamplePercent
+}
+
+// NewTranscript starts a transcript for a session. The request body is
+// stored after applying the configured redaction rules.
+func (r *Recorder) NewTranscript(requestID, method, path string, requestBody []byte) *Transcript {
+	return &Transcript{
+		RequestID:    requestID,
+		StartedAt:    time.Now().UTC(),
+		Method:       method,
+		Path:         path,
+		RequestBody:  redactBody(requestBody, r.fields),
+		Attempts:     []*Attempt{},
+		redactFields: r.fields,
+	}
+}
+
+// Write appends one transcript as a JSONL record, rotating first if the
+// record would push the file past MaxBytes.
+func (r *Recorder) Write(t *Transcript) error {
+	if r == nil || t == nil {
+		return nil
+	}
+	record, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("encode transcript: %w", err)
+	}
+	record = append(record, '\n')
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.opts.MaxBytes > 0 && r.size > 0 && r.size+int64(len(record)) > r.opts.MaxBytes {
+		if err := r.rotate(); err != nil {
+			return err
+		}
+	}
+
+	n, err := r.file.Write(record)
+	r.size += int64(n)
+	if err != nil {
+		return fmt.Errorf("write transcript: %w", err)
+	}
+	return nil
+}
+
+// rotate shifts Path.N-1 to Path.N, moves Path to Path.1 and reopens Path.
+// Callers must hold r.mu.
+func (r *Recorder) rotate() error {
+	if err := r.file.Close(); err != nil {
+		return fmt.Errorf("close transcript file: %w", err)
+	}
+
+	if r.opts.MaxBackups == 0 {
+		os.Remove(r.opts.Path)
+	} else {
+		os.Remove(fmt.Sprintf("%s.%d", r.opts.Path, r.opts.MaxBackups))
+		for i := r.opts.MaxBackups - 1; i >= 1; i-- {
+			os.Rename(fmt.Sprintf("%s.%d", r.opts.Path, i), fmt.Sprintf("%s.%d", r.opts.Path, i+1))
+		}
+		if err := os.Rename(r.opts.Path, r.opts.Path+".1"); err != nil {
+			return fmt.Errorf("rotate transcript file: %w", err)
+		}
+	}
+	return r.open()
+}
+
+// Close closes the transcript file.
+func (r *Recorder) Close() error {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.file.Close()
+}
@@ -0,0 +1,200 @@
+package recorder
+
+import (
+	"encoding/json"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Attempt is one upstream call made for a session.
+type Attempt struct {
+	Number             int             `json:"number"`
+	URL                string          `json:"url"`
+	RequestBody        json.RawMessage `json:"request_body,omitempty"`
+	Status             int             `json:"status,omitempty"`
+	Error              string          `json:"error,omitempty"`
+	StartedAt          time.Time       `json:"started_at"`
+	HeadersAfterMs     int64           `json:"headers_after_ms"`
+	DurationMs         int64           `json:"duration_ms"`
+	Lines              []string        `json:"lines"`
+	InterruptionReason string          `json:"interruption_reason,omitempty"`
+}
+
+// Transcript is the full record of one streaming session: what the client
+// sent, every upstream attempt, and the exact bytes the client received.
+type Transcript struct {
+	mu sync.Mutex
+
+	RequestID   string          `json:"request_id"`
+	StartedAt   time.Time       `json:"started_at"`
+	Method      string          `json:"method"`
+	Path        string          `json:"path"`
+	RequestBody json.RawMessage `json:"request_body,omitempty"`
+	Attempts    []*Attempt      `json:"attempts"`
+	Output      string          `json:"output"`
+	Outcome     string          `json:"outcome,omitempty"`
+	DurationMs  int64           `json:"duration_ms"`
+
+	redactFields map[string]bool
+	// output collects what AppendOutput records. It is copied to Output
+	// when the transcript is serialized.
+	output strings.Builder
+}
+
+// StartAttempt opens a new attempt. Retry attempts pass the body that was
+// sent; the initial attempt passes nil since the request body is already
+// recorded on the transcript. A nil transcript returns a nil attempt.
+func (t *Transcript) StartAttempt(url string, body []byte) *Attempt {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempt := &Attempt{
+		Number:      len(t.Attempts) + 1,
+		URL:         logger.Redact(url),
+		RequestBody: redactBody(body, t.redactFields),
+		StartedAt:   time.Now().UTC(),
+		Lines:       []string{},
+	}
+	t.Attempts = append(t.Attempts, attempt)
+	return attempt
+}
+
+// SetResponse records the upstream status (or transport error) of the
+// current attempt once response headers arrived.
+func (t *Transcript) SetResponse(status int, err error) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	attempt := t.current()
+	if attempt == nil {
+		return
+	}
+	attempt.Status = status
+	if err != nil {
+		attempt.Error = logger.Redact(err.Error())
+	}
+	attempt.HeadersAfterMs = time.Since(attempt.StartedAt).Milliseconds()
+	attempt.DurationMs = attempt.HeadersAfterMs
+}
+
+// AddLine records a raw SSE line read from the current attempt.
+func (t *Transcript) AddLine(line string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if attempt := t.current(); attempt != nil {
+		attempt.Lines = append(attempt.Lines, line)
+	}
+}
+
+// EndAttempt closes the current attempt with its interruption reason, or
+// "" if the stream completed cleanly.
+func (t *Transcript) EndAttempt(reason string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if attempt := t.current(); attempt != nil {
+		attempt.InterruptionReason = reason
+		attempt.DurationMs = time.Since(attempt.StartedAt).Milliseconds()
+	}
+}
+
+// AppendOutput records bytes forwarded to the client.
+func (t *Transcript) AppendOutput(p []byte) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.output.Write(p)
+}
+
+// Finish records the session outcome and total duration.
+func (t *Transcript) Finish(outcome string) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.Outcome == "" {
+		t.Outcome = outcome
+	}
+	t.DurationMs = time.Since(t.StartedAt).Milliseconds()
+}
+
+// current returns the latest attempt. Callers must hold t.mu.
+func (t *Transcript) current() *Attempt {
+	if len(t.Attempts) == 0 {
+		return nil
+	}
+	return t.Attempts[len(t.Attempts)-1]
+}
+
+// MarshalJSON serializes the transcript under its lock.
+func (t *Transcript) MarshalJSON() ([]byte, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.output.Len() > 0 {
+		t.Output = t.output.String()
+	}
+
+	type plain Transcript
+	return json.Marshal((*plain)(t))
+}
+
+// redactBody masks configured JSON fields and known secret formats. Bodies
+// that are not JSON are stored as a JSON string.
+func redactBody(body []byte, fields map[string]bool) json.RawMessage {
+	if body == nil {
+		return nil
+	}
+
+	var data interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		encoded, _ := json.Marshal(logger.Redact(string(body)))
+		return encoded
+	}
+	data = redactValue(data, fields)
+	encoded, err := json.Marshal(data)
+	if err != nil {
+		return nil
+	}
+	return json.RawMessage(logger.Redact(string(encoded)))
+}
+
+func redactValue(v interface{}, fields map[string]bool) interface{} {
+	switch value := v.(type) {
+	case map[string]interface{}:
+		for k, child := range value {
+			if fields[k] {
+				value[k] = "[REDACTED]"
+				continue
+			}
+			value[k] = redactValue(child, fields)
+		}
+		return value
+	case []interface{}:
+		for i, child := range value {
+			value[i] = redactValue(child, fields)
+		}
+		return value
+	default:
+		return v
+	}
+}
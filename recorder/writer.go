@@ -0,0 +1,31 @@
+package recorder
+
+import (
+	"io"
+	"net/http"
+)
+
+// teeWriter copies everything written to the client into a transcript.
+type teeWriter struct {
+	w io.Writer
+	t *Transcript
+}
+
+// NewTeeWriter wraps w so that every byte written is also appended to the
+// transcript's output. Flushes are passed through to w.
+func NewTeeWriter(w io.Writer, t *Transcript) io.Writer {
+	return &teeWriter{w: w, t: t}
+}
+
+func (tw *teeWriter) Write(p []byte) (int, error) {
+	n, err := tw.w.Write(p)
+	tw.t.AppendOutput(p[:n])
+	return n, err
+}
+
+// Flush flushes the underlying writer, if it's an http.Flusher.
+func (tw *teeWriter) Flush() {
+	if flusher, ok := tw.w.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
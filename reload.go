@@ -0,0 +1,94 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/handlers"
+	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+)
+
+// configWatchInterval is how often the config file is checked for changes.
+const configWatchInterval = 2 * time.Second
+
+// reloader re-reads the configuration from the same file, environment and
+// flags the proxy started with, and swaps it into the proxy handler.
+type reloader struct {
+	mu      sync.Mutex
+	args    []string
+	handler *handlers.ProxyHandler
+}
+
+// watch reloads on SIGHUP and, if a config file is in use, whenever its
+// content changes, until ctx is done.
+func (r *reloader) watch(ctx context.Context, file string) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(hup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-hup:
+				r.reload("SIGHUP")
+			}
+		}
+	}()
+
+	if file != "" {
+		go config.WatchFile(ctx, file, configWatchInterval, func() {
+			r.reload("file change")
+		})
+	}
+}
+
+// reload loads and validates the configuration and applies it to new
+// requests. An invalid configuration is rejected and the current one keeps
+// running. Settings that are only read at startup are left unchanged and
+// reported.
+func (r *reloader) reload(trigger string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	next, err := config.Load(r.args)
+	if err != nil {
+		metrics.ConfigReloads.Inc("rejected")
+		logger.LogError(fmt.Sprintf("Config reload (%s) rejected, keeping the current configuration:", trigger), err)
+		return
+	}
+
+	current := r.handler.Config()
+	reloadable, restart := config.Changes(current, next)
+	if len(reloadable) == 0 {
+		metrics.ConfigReloads.Inc("unchanged")
+		logger.LogInfo(fmt.Sprintf("Config reload (%s): no changes to apply", trigger))
+		warnRestart(restart)
+		return
+	}
+
+	next.KeepRestartSettings(current)
+	r.handler.SetConfig(next)
+	logger.Configure(logger.Options{
+		Level:      next.LogLevel,
+		Format:     next.LogFormat,
+		LogContent: next.LogContent,
+	})
+	metrics.ConfigReloads.Inc("applied")
+	logger.LogInfo(fmt.Sprintf("Config reload (%s) applied to new requests: %s", trigger, strings.Join(reloadable, ", ")))
+	warnRestart(restart)
+}
+
+func warnRestart(keys []string) {
+	if len(keys) > 0 {
+		logger.LogWarn(fmt.Sprintf("Config changes that need a restart were not applied: %s", strings.Join(keys, ", ")))
+	}
+}
@@ -0,0 +1,216 @@
+// Package replay re-runs recorded streaming sessions through the current
+// session logic without network access. Each recorded upstream attempt is
+// served back by a fake transport, and the output the client would now see
+// is compared with what was originally sent.
+package replay
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/recorder"
+	"gemini-antiblock/streaming"
+)
+
+// ErrNotReplayable is returned for transcripts whose initial attempt never
+// produced a stream, so no session was run when they were recorded, and for
+// sessions cut short by a proxy shutdown, an admin cancel or the client
+// going away, which the recording cannot reproduce.
+var ErrNotReplayable = errors.New("transcript cannot be replayed")
+
+// Load reads every transcript from a JSONL file written by the recorder.
+func Load(path string) ([]*recorder.Transcript, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return Decode(file)
+}
+
+// Decode reads JSONL transcripts from r.
+func Decode(r io.Reader) ([]*recorder.Transcript, error) {
+	var transcripts []*recorder.Transcript
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 0, 64*1024), 64*1024*1024)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := bytes.TrimSpace(scanner.Bytes())
+		if len(line) == 0 {
+			continue
+		}
+		t := &recorder.Transcript{}
+		if err := json.Unmarshal(line, t); err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		transcripts = append(transcripts, t)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return transcripts, nil
+}
+
+// Result is the outcome of replaying one transcript.
+type Result struct {
+	RequestID string
+	// Output is what the client receives from the current code.
+	Output string
+	// AttemptsUsed is the number of recorded attempts the session consumed,
+	// including the initial one.
+	AttemptsUsed int
+	// AttemptsRecorded is the number of attempts in the transcript.
+	AttemptsRecorded int
+	// Diff describes the first difference from the recorded output, or is
+	// empty if the output is unchanged.
+	Diff string
+}
+
+// Changed reports whether the replayed output differs from the recording.
+func (r *Result) Changed() bool {
+	return r.Diff != "" || r.AttemptsUsed != r.AttemptsRecorded
+}
+
+// Run replays t through a streaming.Session built from cfg. Retry delays
+// are skipped and circuit breaking and hedging are left off, since both
+// depend on live traffic rather than on the recorded stream.
+func Run(cfg *config.Config, t *recorder.Transcript) (*Result, error) {
+	if len(t.Attempts) == 0 || t.Attempts[0].Status != http.StatusOK || t.Outcome == "shutdown" || t.Outcome == "admin_cancelled" || t.Outcome == "cancelled" {
+		return nil, ErrNotReplayable
+	}
+
+	sessionCfg := *cfg
+	sessionCfg.RetryDelayMs = 0
+
+	var body map[string]interface{}
+	if len(t.RequestBody) > 0 {
+		if err := json.Unmarshal(t.RequestBody, &body); err != nil {
+			return nil, fmt.Errorf("decode request body: %w", err)
+		}
+	}
+
+	transport := NewTransport(t.Attempts[1:])
+	var output bytes.Buffer
+	session := streaming.NewSession(
+		&sessionCfg,
+		strings.NewReader(StreamBody(t.Attempts[0].Lines)),
+		&output,
+		body,
+		t.Attempts[0].URL,
+		http.Header{"Content-Type": []string{"application/json"}},
+		&http.Client{Transport: transport},
+	)
+	session.SetFallbackPolicy(streaming.NewFallbackPolicy(&sessionCfg))
+	session.Process()
+
+	result := &Result{
+		RequestID:        t.RequestID,
+		Output:           output.String(),
+		AttemptsUsed:     1 + transport.Served(),
+		AttemptsRecorded: len(t.Attempts),
+		Diff:             Diff(t.Output, output.String()),
+	}
+	return result, nil
+}
+
+// StreamBody rebuilds an SSE response body from recorded lines. Blank lines
+// are not recorded, so each line is written back as its own event.
+func StreamBody(lines []string) string {
+	var b strings.Builder
+	for _, line := range lines {
+		b.WriteString(line)
+		b.WriteString("\n\n")
+	}
+	return b.String()
+}
+
+// Transport is an http.RoundTripper that answers each request with the
+// next recorded attempt, in order.
+type Transport struct {
+	mu       sync.Mutex
+	attempts []*recorder.Attempt
+	served   int
+}
+
+// NewTransport creates a transport serving the given attempts.
+func NewTransport(attempts []*recorder.Attempt) *Transport {
+	return &Transport{attempts: attempts}
+}
+
+// RoundTrip implements http.RoundTripper.
+func (t *Transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Body != nil {
+		io.Copy(io.Discard, req.Body)
+		req.Body.Close()
+	}
+
+	t.mu.Lock()
+	if t.served >= len(t.attempts) {
+		t.mu.Unlock()
+		return nil, fmt.Errorf("no recorded attempt left for request %d", t.served+2)
+	}
+	attempt := t.attempts[t.served]
+	t.served++
+	t.mu.Unlock()
+
+	if attempt.Error != "" {
+		return nil, errors.New(attempt.Error)
+	}
+
+	status := attempt.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	return &http.Response{
+		StatusCode: status,
+		Status:     fmt.Sprintf("%d %s", status, http.StatusText(status)),
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     http.Header{"Content-Type": []string{"text/event-stream"}},
+		Body:       io.NopCloser(strings.NewReader(StreamBody(attempt.Lines))),
+		Request:    req,
+	}, nil
+}
+
+// Served returns the number of attempts handed out so far.
+func (t *Transport) Served() int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.served
+}
+
+// Diff compares recorded and replayed output line by line and describes the
+// first difference. It returns "" when both are identical.
+func Diff(want, got string) string {
+	if want == got {
+		return ""
+	}
+
+	wantLines := strings.Split(want, "\n")
+	gotLines := strings.Split(got, "\n")
+	for i := 0; i < len(wantLines) || i < len(gotLines); i++ {
+		var w, g string
+		if i < len(wantLines) {
+			w = wantLines[i]
+		}
+		if i < len(gotLines) {
+			g = gotLines[i]
+		}
+		if i >= len(wantLines) || i >= len(gotLines) || w != g {
+			return fmt.Sprintf("line %d:\n- %s\n+ %s", i+1, w, g)
+		}
+	}
+	return ""
+}
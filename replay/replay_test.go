@@ -0,0 +1,185 @@
+package replay
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/recorder"
+	"gemini-antiblock/streaming"
+)
+
+const upstreamURL = "http://upstream.test/v1beta/models/gemini-pro:streamGenerateContent?alt=sse"
+
+func testConfig() *config.Config {
+	return &config.Config{
+		MaxConsecutiveRetries:     3,
+		SwallowThoughtsAfterRetry: true,
+	}
+}
+
+func textLine(text string, thought bool, finishReason string) string {
+	part := map[string]interface{}{"text": text}
+	if thought {
+		part["thought"] = true
+	}
+	candidate := map[string]interface{}{
+		"content": map[string]interface{}{"parts": []interface{}{part}, "role": "model"},
+	}
+	if finishReason != "" {
+		candidate["finishReason"] = finishReason
+	}
+	data, _ := json.Marshal(map[string]interface{}{"candidates": []interface{}{candidate}})
+	return "data: " + string(data)
+}
+
+// record runs a session against scripted upstream attempts the way the
+// proxy handler does, and returns the transcript round-tripped through JSON.
+func record(t *testing.T, attempts [][]string) *recorder.Transcript {
+	t.Helper()
+
+	rec, err := recorder.New(recorder.Options{Path: filepath.Join(t.TempDir(), "transcripts.jsonl"), SamplePercent: 100})
+	if err != nil {
+		t.Fatalf("recorder.New: %v", err)
+	}
+	defer rec.Close()
+
+	body := []byte(`{"contents":[{"role":"user","parts":[{"text":"hi"}]}]}`)
+	transcript := rec.NewTranscript("req-1", http.MethodPost, "/v1beta/models/gemini-pro:streamGenerateContent", body)
+	transcript.StartAttempt(upstreamURL, nil)
+	transcript.SetResponse(http.StatusOK, nil)
+
+	var retries []*recorder.Attempt
+	for _, lines := range attempts[1:] {
+		retries = append(retries, &recorder.Attempt{Status: http.StatusOK, Lines: lines})
+	}
+
+	var requestBody map[string]interface{}
+	json.Unmarshal(body, &requestBody)
+
+	var output bytes.Buffer
+	session := streaming.NewSession(
+		testConfig(),
+		strings.NewReader(StreamBody(attempts[0])),
+		recorder.NewTeeWriter(&output, transcript),
+		requestBody,
+		upstreamURL,
+		http.Header{},
+		&http.Client{Transport: NewTransport(retries)},
+	)
+	session.SetTranscript(transcript)
+	session.Process()
+
+	encoded, err := json.Marshal(transcript)
+	if err != nil {
+		t.Fatalf("marshal transcript: %v", err)
+	}
+	decoded, err := Decode(bytes.NewReader(append(encoded, '\n')))
+	if err != nil || len(decoded) != 1 {
+		t.Fatalf("Decode: %v (%d transcripts)", err, len(decoded))
+	}
+	return decoded[0]
+}
+
+func TestReplayReproducesRecordedOutput(t *testing.T) {
+	tests := []struct {
+		name     string
+		attempts [][]string
+	}{
+		{
+			name: "clean",
+			attempts: [][]string{{
+				textLine("Hello ", false, ""),
+				textLine("world.", false, "STOP"),
+			}},
+		},
+		{
+			name: "drop then resume",
+			attempts: [][]string{
+				{textLine("Hello ", false, "")},
+				{textLine("world.", false, "STOP")},
+			},
+		},
+		{
+			name: "swallowed thought after retry",
+			attempts: [][]string{
+				{textLine("Hello ", false, ""), textLine("", false, "SAFETY")},
+				{textLine("thinking", true, ""), textLine("world.", false, "STOP")},
+			},
+		},
+		{
+			name: "retry limit",
+			attempts: [][]string{
+				{textLine("", false, "STOP")},
+				{textLine("", false, "STOP")},
+				{textLine("", false, "STOP")},
+				{textLine("", false, "STOP")},
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			transcript := record(t, tt.attempts)
+			if len(transcript.Attempts) != len(tt.attempts) {
+				t.Fatalf("recorded %d attempts, want %d", len(transcript.Attempts), len(tt.attempts))
+			}
+
+			result, err := Run(testConfig(), transcript)
+			if err != nil {
+				t.Fatalf("Run: %v", err)
+			}
+			if result.Changed() {
+				t.Fatalf("replay changed output (attempts %d/%d):\n%s", result.AttemptsUsed, result.AttemptsRecorded, result.Diff)
+			}
+		})
+	}
+}
+
+func TestReplayDetectsChangedBehavior(t *testing.T) {
+	transcript := record(t, [][]string{
+		{textLine("Hello ", false, "")},
+		{textLine("world.", false, "STOP")},
+	})
+
+	// With retries disabled the session stops after the first attempt, so
+	// the client sees an error event instead of the resumed stream.
+	cfg := testConfig()
+	cfg.MaxConsecutiveRetries = 0
+	result, err := Run(cfg, transcript)
+	if err != nil {
+		t.Fatalf("Run: %v", err)
+	}
+	if !result.Changed() {
+		t.Fatal("expected replay to report a change")
+	}
+	if result.AttemptsUsed != 1 || result.AttemptsRecorded != 2 {
+		t.Errorf("attempts = %d/%d, want 1/2", result.AttemptsUsed, result.AttemptsRecorded)
+	}
+	if !strings.Contains(result.Diff, "+ event: error") {
+		t.Errorf("diff does not show the error event:\n%s", result.Diff)
+	}
+}
+
+func TestRunRejectsFailedInitialAttempt(t *testing.T) {
+	transcript := &recorder.Transcript{Attempts: []*recorder.Attempt{{Status: http.StatusTooManyRequests}}}
+	if _, err := Run(testConfig(), transcript); err != ErrNotReplayable {
+		t.Fatalf("Run error = %v, want ErrNotReplayable", err)
+	}
+}
+
+func TestDiff(t *testing.T) {
+	if d := Diff("a\nb\n", "a\nb\n"); d != "" {
+		t.Errorf("Diff of equal output = %q", d)
+	}
+	if d := Diff("a\nb\n", "a\nc\n"); d != "line 2:\n- b\n+ c" {
+		t.Errorf("Diff = %q", d)
+	}
+	if d := Diff("a\n", "a\nb\n"); !strings.HasPrefix(d, "line 2:") {
+		t.Errorf("Diff with extra line = %q", d)
+	}
+}
@@ -0,0 +1,175 @@
+// Package server runs the proxy's public listener: a TCP port or a Unix
+// domain socket, optionally over TLS with certificates that are reloaded
+// when their files change, speaking HTTP/1.1 and HTTP/2.
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// Options configures the server.
+type Options struct {
+	// Addr is the host:port to listen on when UnixSocket is empty.
+	Addr string
+	// UnixSocket is the path of a Unix domain socket to listen on instead
+	// of Addr. A socket left behind by an earlier run is removed.
+	UnixSocket string
+	// TLSCertFile and TLSKeyFile enable HTTPS.
+	TLSCertFile string
+	TLSKeyFile  string
+	// HTTP2 offers HTTP/2 to TLS clients through ALPN.
+	HTTP2 bool
+	// H2C accepts cleartext HTTP/2 from clients that start with the HTTP/2
+	// preface (prior knowledge). It does not apply to TLS.
+	H2C bool
+	// ReadHeaderTimeout, IdleTimeout and MaxHeaderBytes are passed to
+	// http.Server. There is no write timeout, which would cut off streams.
+	ReadHeaderTimeout time.Duration
+	IdleTimeout       time.Duration
+	MaxHeaderBytes    int
+}
+
+// Server is the proxy's HTTP server.
+type Server struct {
+	*http.Server
+	opts Options
+	cert atomic.Pointer[tls.Certificate]
+}
+
+// New creates a server for handler and loads its certificate, if any. It
+// does not start listening.
+func New(opts Options, handler http.Handler) (*Server, error) {
+	if (opts.TLSCertFile == "") != (opts.TLSKeyFile == "") {
+		return nil, errors.New("TLS needs both a certificate and a key")
+	}
+
+	s := &Server{
+		Server: &http.Server{
+			Addr:              opts.Addr,
+			Handler:           handler,
+			ReadHeaderTimeout: opts.ReadHeaderTimeout,
+			IdleTimeout:       opts.IdleTimeout,
+			MaxHeaderBytes:    opts.MaxHeaderBytes,
+		},
+		opts: opts,
+	}
+	protocols := new(http.Protocols)
+	protocols.SetHTTP1(true)
+	if opts.TLSCertFile != "" {
+		protocols.SetHTTP2(opts.HTTP2)
+		if err := s.loadCertificate(); err != nil {
+			return nil, err
+		}
+		s.Server.TLSConfig = &tls.Config{
+			MinVersion: tls.VersionTLS12,
+			GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+				return s.cert.Load(), nil
+			},
+		}
+	} else {
+		protocols.SetUnencryptedHTTP2(opts.H2C)
+	}
+	s.Server.Protocols = protocols
+	return s, nil
+}
+
+// Listen opens the Unix socket or TCP listener the options describe.
+func (s *Server) Listen() (net.Listener, error) {
+	if s.opts.UnixSocket == "" {
+		return net.Listen("tcp", s.opts.Addr)
+	}
+	// Only a stale socket is removed, never a regular file at the path.
+	if info, err := os.Lstat(s.opts.UnixSocket); err == nil {
+		if info.Mode().Type() != fs.ModeSocket {
+			return nil, fmt.Errorf("%s exists and is not a socket", s.opts.UnixSocket)
+		}
+		if err := os.Remove(s.opts.UnixSocket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", s.opts.UnixSocket)
+}
+
+// Serve accepts connections on l, over TLS if a certificate is configured,
+// until the server is shut down.
+func (s *Server) Serve(l net.Listener) error {
+	if s.opts.TLSCertFile != "" {
+		return s.Server.ServeTLS(l, "", "")
+	}
+	return s.Server.Serve(l)
+}
+
+// Address describes where the server listens, for logging.
+func (s *Server) Address() string {
+	scheme := "http"
+	if s.opts.TLSCertFile != "" {
+		scheme = "https"
+	}
+	if s.opts.UnixSocket != "" {
+		return fmt.Sprintf("%s+unix://%s", scheme, s.opts.UnixSocket)
+	}
+	return fmt.Sprintf("%s://%s", scheme, s.opts.Addr)
+}
+
+// WatchCertificate checks the certificate and key files every interval and
+// loads them again when they change, until ctx is done. New connections use
+// the new certificate; if it cannot be loaded, for example because only one
+// of the files has been replaced so far, the current one stays in use.
+func (s *Server) WatchCertificate(ctx context.Context, interval time.Duration) {
+	if s.opts.TLSCertFile == "" {
+		return
+	}
+	last := s.certDigest()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			digest := s.certDigest()
+			if bytes.Equal(digest, last) {
+				continue
+			}
+			last = digest
+			if err := s.loadCertificate(); err != nil {
+				logger.LogError("TLS certificate reload failed, keeping the current certificate:", err)
+				continue
+			}
+			logger.LogInfo(fmt.Sprintf("TLS certificate reloaded from %s", s.opts.TLSCertFile))
+		}
+	}
+}
+
+func (s *Server) loadCertificate() error {
+	cert, err := tls.LoadX509KeyPair(s.opts.TLSCertFile, s.opts.TLSKeyFile)
+	if err != nil {
+		return fmt.Errorf("loading TLS certificate: %w", err)
+	}
+	s.cert.Store(&cert)
+	return nil
+}
+
+// certDigest hashes the certificate and key files together, so that
+// replacing either one counts as a change.
+func (s *Server) certDigest() []byte {
+	h := sha256.New()
+	for _, path := range []string{s.opts.TLSCertFile, s.opts.TLSKeyFile} {
+		data, _ := os.ReadFile(path)
+		h.Write(data)
+	}
+	return h.Sum(nil)
+}
@@ -0,0 +1,202 @@
+package server_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"gemini-antiblock/server"
+)
+
+// hello answers with the protocol the request arrived over.
+var hello = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Proto)
+})
+
+func start(t *testing.T, opts server.Options) (*server.Server, net.Listener) {
+	t.Helper()
+	s, err := server.New(opts, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := s.Listen()
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, l
+}
+
+func get(t *testing.T, client *http.Client, url string) (*http.Response, string) {
+	t.Helper()
+	resp, err := client.Get(url)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	return resp, string(body)
+}
+
+func TestUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+
+	// A socket file left behind by a process that did not shut down.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	start(t, server.Options{UnixSocket: path, H2C: true})
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, "unix", path)
+	}
+	h2c := new(http.Protocols)
+	h2c.SetUnencryptedHTTP2(true)
+	for _, c := range []struct {
+		name      string
+		transport *http.Transport
+		want      string
+	}{
+		{"HTTP/1.1", &http.Transport{DialContext: dial}, "HTTP/1.1"},
+		{"h2c", &http.Transport{DialContext: dial, Protocols: h2c}, "HTTP/2.0"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			defer c.transport.CloseIdleConnections()
+			if _, proto := get(t, &http.Client{Transport: c.transport}, "http://proxy/"); proto != c.want {
+				t.Errorf("request served over %s, want %s", proto, c.want)
+			}
+		})
+	}
+}
+
+func TestUnixSocketKeepsOtherFiles(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "proxy.sock")
+	if err := os.WriteFile(path, []byte("data"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	s, err := server.New(server.Options{UnixSocket: path}, hello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if l, err := s.Listen(); err == nil {
+		l.Close()
+		t.Fatal("listened on a path holding a regular file")
+	}
+	if data, _ := os.ReadFile(path); string(data) != "data" {
+		t.Error("regular file was replaced")
+	}
+}
+
+func TestTLSCertificateReload(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "first")
+
+	s, l := start(t, server.Options{Addr: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile, HTTP2: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go s.WatchCertificate(ctx, 10*time.Millisecond)
+
+	url := "https://" + l.Addr().String() + "/"
+	served := func() (proto, name string) {
+		t.Helper()
+		// A new connection for each request, so the handshake sees the
+		// current certificate.
+		transport := &http.Transport{
+			TLSClientConfig:   &tls.Config{InsecureSkipVerify: true},
+			ForceAttemptHTTP2: true,
+			DisableKeepAlives: true,
+		}
+		resp, proto := get(t, &http.Client{Transport: transport}, url)
+		return proto, resp.TLS.PeerCertificates[0].Subject.CommonName
+	}
+
+	if proto, name := served(); proto != "HTTP/2.0" || name != "first" {
+		t.Fatalf("served over %s with certificate %q, want HTTP/2.0 and first", proto, name)
+	}
+
+	writeCertificate(t, certFile, keyFile, "second")
+	waitFor(t, func() bool { _, name := served(); return name == "second" })
+
+	// A broken certificate is not loaded.
+	if err := os.WriteFile(certFile, []byte("not a certificate"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(50 * time.Millisecond)
+	if _, name := served(); name != "second" {
+		t.Errorf("served certificate %q after a failed reload, want second", name)
+	}
+}
+
+func TestTLSWithoutHTTP2(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile, "proxy")
+
+	_, l := start(t, server.Options{Addr: "127.0.0.1:0", TLSCertFile: certFile, TLSKeyFile: keyFile})
+	transport := &http.Transport{TLSClientConfig: &tls.Config{InsecureSkipVerify: true}, ForceAttemptHTTP2: true}
+	defer transport.CloseIdleConnections()
+	if _, proto := get(t, &http.Client{Transport: transport}, "https://"+l.Addr().String()+"/"); proto != "HTTP/1.1" {
+		t.Errorf("served over %s, want HTTP/1.1", proto)
+	}
+}
+
+// writeCertificate writes a self-signed certificate for commonName and its
+// key.
+func writeCertificate(t *testing.T, certFile, keyFile, commonName string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: commonName},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition not met within 2s")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,186 @@
+package streaming
+
+import (
+	"encoding/json"
+	"regexp"
+	"strings"
+
+	"gemini-antiblock/config"
+)
+
+// FallbackHeader names the response header that reports a model switch.
+const FallbackHeader = "X-Antiblock-Model-Fallback"
+
+var modelSegmentPattern = regexp.MustCompile(`/models/([^/:?]+)`)
+
+// ModelFromURL returns the model name in a Gemini API URL or path, or ""
+// if the URL does not address a model.
+func ModelFromURL(rawURL string) string {
+	match := modelSegmentPattern.FindStringSubmatch(rawURL)
+	if match == nil {
+		return ""
+	}
+	return match[1]
+}
+
+// ReplaceModelInURL rewrites the model segment of a Gemini API URL or path.
+func ReplaceModelInURL(rawURL, model string) string {
+	loc := modelSegmentPattern.FindStringSubmatchIndex(rawURL)
+	if loc == nil {
+		return rawURL
+	}
+	return rawURL[:loc[2]] + model + rawURL[loc[3]:]
+}
+
+// FallbackPolicy decides when a request should move on to the next model
+// in its configured fallback chain.
+type FallbackPolicy struct {
+	next    map[string]string
+	after   int
+	reasons map[string]bool
+}
+
+// NewFallbackPolicy builds the policy from config. It returns nil when no
+// fallback chains are configured.
+func NewFallbackPolicy(cfg *config.Config) *FallbackPolicy {
+	if len(cfg.ModelFallbacks) == 0 {
+		return nil
+	}
+	after := cfg.ModelFallbackAfter
+	if after < 1 {
+		after = 1
+	}
+	reasons := make(map[string]bool, len(cfg.ModelFallbackReasons))
+	for _, reason := range cfg.ModelFallbackReasons {
+		reasons[strings.ToUpper(reason)] = true
+	}
+	return &FallbackPolicy{
+		next:    cfg.ModelFallbacks,
+		after:   after,
+		reasons: reasons,
+	}
+}
+
+// Counts reports whether an interruption reason counts towards a fallback.
+func (p *FallbackPolicy) Counts(reason string) bool {
+	return p != nil && p.reasons[reason]
+}
+
+// Threshold returns the number of counted interruptions that triggers a switch.
+func (p *FallbackPolicy) Threshold() int {
+	return p.after
+}
+
+// NextModel returns the model that follows the given one in its chain.
+func (p *FallbackPolicy) NextModel(model string) (string, bool) {
+	if p == nil {
+		return "", false
+	}
+	next, ok := p.next[model]
+	return next, ok
+}
+
+// FallbackTracker counts interruptions per reason for the current model and
+// tells the caller when to switch.
+type FallbackTracker struct {
+	policy *FallbackPolicy
+	counts map[string]int
+	chain  []string
+}
+
+// NewFallbackTracker creates a tracker for a request that starts on model.
+func NewFallbackTracker(policy *FallbackPolicy, model string) *FallbackTracker {
+	return &FallbackTracker{
+		policy: policy,
+		counts: make(map[string]int),
+		chain:  []string{model},
+	}
+}
+
+// Observe records an interruption. When the reason has been seen often
+// enough on the current model and a fallback exists, it returns the next
+// model and true; the counters then restart for that model.
+func (t *FallbackTracker) Observe(reason string) (string, bool) {
+	if t == nil || !t.policy.Counts(reason) {
+		return "", false
+	}
+	t.counts[reason]++
+	if t.counts[reason] < t.policy.Threshold() {
+		return "", false
+	}
+	next, ok := t.policy.NextModel(t.Current())
+	if !ok {
+		return "", false
+	}
+	t.counts = make(map[string]int)
+	t.chain = append(t.chain, next)
+	return next, true
+}
+
+// Current returns the model currently in use.
+func (t *FallbackTracker) Current() string {
+	return t.chain[len(t.chain)-1]
+}
+
+// Switched reports whether at least one fallback happened.
+func (t *FallbackTracker) Switched() bool {
+	return t != nil && len(t.chain) > 1
+}
+
+// Chain returns the models used so far, joined for use in a header value.
+func (t *FallbackTracker) Chain() string {
+	return strings.Join(t.chain, ">")
+}
+
+// ClassifyResponse inspects a complete (non-streaming) generateContent
+// response and returns the interruption reason it represents, or "" if the
+// response is a usable answer. It uses the same reason names as Session.
+func ClassifyResponse(body []byte) string {
+	var data map[string]interface{}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return ""
+	}
+
+	if feedback, ok := data["promptFeedback"].(map[string]interface{}); ok {
+		if _, blocked := feedback["blockReason"]; blocked {
+			return "BLOCK"
+		}
+	}
+
+	candidates, ok := data["candidates"].([]interface{})
+	if !ok || len(candidates) == 0 {
+		return "FINISH_EMPTY_RESPONSE"
+	}
+	candidate, ok := candidates[0].(map[string]interface{})
+	if !ok {
+		return ""
+	}
+
+	finishReason, _ := candidate["finishReason"].(string)
+	if finishReason != "" && finishReason != "STOP" && finishReason != "MAX_TOKENS" {
+		return "FINISH_ABNORMAL"
+	}
+
+	text := ""
+	if content, ok := candidate["content"].(map[string]interface{}); ok {
+		if parts, ok := content["parts"].([]interface{}); ok {
+			for _, p := range parts {
+				if part, ok := p.(map[string]interface{}); ok {
+					if thought, _ := part["thought"].(bool); thought {
+						continue
+					}
+					if t, ok := part["text"].(string); ok {
+						text += t
+					}
+					if _, ok := part["functionCall"]; ok {
+						text += "functionCall"
+					}
+				}
+			}
+		}
+	}
+	if finishReason == "STOP" && strings.TrimSpace(text) == "" {
+		return "FINISH_EMPTY_RESPONSE"
+	}
+	return ""
+}
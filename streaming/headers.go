@@ -0,0 +1,121 @@
+package streaming
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"gemini-antiblock/config"
+)
+
+// hopByHopHeaders describe a single connection, or are set by the proxy
+// itself, and are never forwarded in either direction. Accept-Encoding is
+// left to the transport so that responses arrive decompressed.
+var hopByHopHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Host":                true,
+	"Content-Length":      true,
+	"Accept-Encoding":     true,
+}
+
+// HeaderPolicy decides which client request headers reach the upstream,
+// which headers are added to upstream requests, and which upstream response
+// headers reach the client.
+type HeaderPolicy struct {
+	forward  headerMatcher
+	deny     headerMatcher
+	inject   http.Header
+	response headerMatcher
+}
+
+// headerMatcher matches canonical header names against exact names and
+// prefixes.
+type headerMatcher struct {
+	all      bool
+	names    map[string]bool
+	prefixes []string
+}
+
+func newHeaderMatcher(patterns []string) headerMatcher {
+	m := headerMatcher{names: make(map[string]bool)}
+	for _, pattern := range patterns {
+		switch {
+		case pattern == "*":
+			m.all = true
+		case strings.HasSuffix(pattern, "*"):
+			m.prefixes = append(m.prefixes, strings.ToLower(strings.TrimSuffix(pattern, "*")))
+		default:
+			m.names[textproto.CanonicalMIMEHeaderKey(pattern)] = true
+		}
+	}
+	return m
+}
+
+func (m headerMatcher) matches(name string) bool {
+	if m.all || m.names[name] {
+		return true
+	}
+	lower := strings.ToLower(name)
+	for _, prefix := range m.prefixes {
+		if strings.HasPrefix(lower, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// NewHeaderPolicy builds the policy from config.
+func NewHeaderPolicy(cfg *config.Config) *HeaderPolicy {
+	p := &HeaderPolicy{
+		forward:  newHeaderMatcher(cfg.ForwardHeaders),
+		deny:     newHeaderMatcher(cfg.DenyHeaders),
+		inject:   make(http.Header),
+		response: newHeaderMatcher(cfg.ResponseHeaders),
+	}
+	for _, item := range cfg.InjectHeaders {
+		if name, value, ok := strings.Cut(item, ":"); ok {
+			p.inject.Set(strings.TrimSpace(name), strings.TrimSpace(value))
+		}
+	}
+	return p
+}
+
+// UpstreamHeaders returns the headers for an upstream request made on
+// behalf of a client that sent clientHeaders. Header names are
+// canonicalized, so lowercase names from HTTP/2 clients or hand-built
+// header maps are matched too.
+func (p *HeaderPolicy) UpstreamHeaders(clientHeaders http.Header) http.Header {
+	headers := make(http.Header)
+	for name, values := range clientHeaders {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if hopByHopHeaders[name] || !p.forward.matches(name) || p.deny.matches(name) {
+			continue
+		}
+		headers[name] = append(headers[name], values...)
+	}
+	for name, values := range p.inject {
+		headers[name] = append([]string(nil), values...)
+	}
+	return headers
+}
+
+// MirrorResponseHeaders copies the selected upstream response headers to
+// the client's response headers. Headers the proxy sets itself, such as
+// Content-Type and CORS headers, are never copied.
+func (p *HeaderPolicy) MirrorResponseHeaders(dst, upstream http.Header) {
+	for name, values := range upstream {
+		name = textproto.CanonicalMIMEHeaderKey(name)
+		if hopByHopHeaders[name] || name == "Content-Type" || strings.HasPrefix(name, "Access-Control-") || !p.response.matches(name) {
+			continue
+		}
+		dst[name] = append([]string(nil), values...)
+	}
+}
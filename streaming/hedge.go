@@ -0,0 +1,230 @@
+package streaming
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// HedgeBudget caps the number of hedge requests each tenant may fire per
+// minute. Counters live in a fixed window that is dropped wholesale when it
+// rolls over, so memory stays bounded by the tenants seen in one minute.
+type HedgeBudget struct {
+	mu          sync.Mutex
+	perMinute   int
+	windowStart time.Time
+	used        map[string]int
+}
+
+// NewHedgeBudget creates a budget allowing perMinute hedges per tenant.
+func NewHedgeBudget(perMinute int) *HedgeBudget {
+	return &HedgeBudget{
+		perMinute:   perMinute,
+		windowStart: time.Now(),
+		used:        make(map[string]int),
+	}
+}
+
+// Take consumes one hedge from the tenant's budget if any is left.
+func (b *HedgeBudget) Take(tenant string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if time.Since(b.windowStart) >= time.Minute {
+		b.windowStart = time.Now()
+		b.used = make(map[string]int)
+	}
+	if b.used[tenant] >= b.perMinute {
+		return false
+	}
+	b.used[tenant]++
+	return true
+}
+
+// Hedger races a second, identical upstream request against a slow one and
+// commits to whichever stream produces content first.
+type Hedger struct {
+	delay  time.Duration
+	budget *HedgeBudget
+}
+
+// NewHedger creates a hedger that fires the backup request after delay.
+func NewHedger(delay time.Duration, perMinute int) *Hedger {
+	return &Hedger{
+		delay:  delay,
+		budget: NewHedgeBudget(perMinute),
+	}
+}
+
+// hedgeResult is the outcome of one racing attempt.
+type hedgeResult struct {
+	index int
+	resp  *http.Response
+	err   error
+}
+
+// Do sends the request built by newRequest and, if no content has arrived
+// within the hedge delay, sends a second copy. The first 200 response that
+// yields formal text (or ends its stream) wins and the other is cancelled.
+// The winning response's body replays any lines consumed while racing.
+// Non-200 responses and transport errors only win when no other attempt
+// is still in flight. Hedge decisions are logged through log, the logger of
+// the request being hedged.
+func (h *Hedger) Do(ctx context.Context, log *logger.Logger, client *http.Client, tenant string, newRequest func(context.Context) (*http.Request, error)) (*http.Response, error) {
+	results := make(chan hedgeResult, 2)
+	cancels := make([]context.CancelFunc, 0, 2)
+
+	launch := func() error {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		req, err := newRequest(attemptCtx)
+		if err != nil {
+			cancel()
+			return err
+		}
+		index := len(cancels)
+		cancels = append(cancels, cancel)
+		go func() {
+			resp, err := client.Do(req)
+			switch {
+			case err != nil:
+				cancel()
+			case resp.StatusCode == http.StatusOK:
+				resp.Body = waitForContent(resp.Body, cancel)
+			default:
+				resp.Body = CancelOnClose(resp.Body, cancel)
+			}
+			results <- hedgeResult{index: index, resp: resp, err: err}
+		}()
+		return nil
+	}
+
+	if err := launch(); err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(h.delay)
+	defer timer.Stop()
+
+	pending := 1
+	var failure *hedgeResult
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) == 1 && h.budget.Take(tenant) {
+				log.Info(fmt.Sprintf("No content after %v, firing hedge request", h.delay))
+				if err := launch(); err == nil {
+					pending++
+				}
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil && res.resp.StatusCode == http.StatusOK {
+				if res.index == 1 {
+					log.Info("Hedge request won the race")
+				}
+				h.discard(cancels, res.index, pending, results)
+				if failure != nil && failure.resp != nil {
+					failure.resp.Body.Close()
+				}
+				return res.resp, nil
+			}
+			if pending > 0 {
+				if failure == nil {
+					failure = &res
+				} else if res.resp != nil {
+					res.resp.Body.Close()
+				}
+				continue
+			}
+			if failure != nil {
+				if res.resp != nil {
+					res.resp.Body.Close()
+				}
+				return failure.resp, failure.err
+			}
+			return res.resp, res.err
+		}
+	}
+}
+
+// discard cancels every attempt except the winner and drains their results
+// in the background so their connections are released.
+func (h *Hedger) discard(cancels []context.CancelFunc, winner, pending int, results <-chan hedgeResult) {
+	for i, cancel := range cancels {
+		if i != winner {
+			cancel()
+		}
+	}
+	if pending == 0 {
+		return
+	}
+	go func() {
+		for i := 0; i < pending; i++ {
+			res := <-results
+			if res.resp != nil {
+				res.resp.Body.Close()
+			}
+		}
+	}()
+}
+
+// cancelBody is a response body that cancels its request's context when
+// closed.
+type cancelBody struct {
+	io.Reader
+	body   io.Closer
+	cancel context.CancelFunc
+}
+
+// CancelOnClose wraps an upstream response body so that closing it cancels
+// the request context first. A session can stop reading at a finish line
+// while its line iterator is still blocked in Read; closing an HTTP/1 body
+// under a concurrent Read can stall until the connection times out, but a
+// cancelled request aborts the read immediately.
+func CancelOnClose(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	return &cancelBody{Reader: body, body: body, cancel: cancel}
+}
+
+func (b *cancelBody) Close() error {
+	b.cancel()
+	return b.body.Close()
+}
+
+// waitForContent blocks until the stream yields formal text, a finish or
+// block signal, or ends. It returns a body that replays what was consumed.
+func waitForContent(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	reader := bufio.NewReader(body)
+	var consumed bytes.Buffer
+	for {
+		line, err := reader.ReadString('\n')
+		consumed.WriteString(line)
+		if isFirstContent(strings.TrimRight(line, "\r\n")) || err != nil {
+			break
+		}
+	}
+	return &cancelBody{
+		Reader: io.MultiReader(bytes.NewReader(consumed.Bytes()), reader),
+		body:   body,
+		cancel: cancel,
+	}
+}
+
+// isFirstContent reports whether a line is enough to commit to a stream.
+func isFirstContent(line string) bool {
+	if !IsDataLine(line) {
+		return false
+	}
+	if IsBlockedLine(line) || strings.Contains(line, "finishReason") {
+		return true
+	}
+	content := ParseLineContent(line)
+	return content.Text != "" && !content.IsThought
+}
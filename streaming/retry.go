@@ -2,17 +2,28 @@ package streaming
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"strings"
+	"sync"
 	"time"
 
+	"gemini-antiblock/breaker"
 	"gemini-antiblock/config"
 	"gemini-antiblock/logger"
+	"gemini-antiblock/metrics"
+	"gemini-antiblock/recorder"
+	"gemini-antiblock/tracing"
 )
 
+// ErrShutdown is returned by Process when the session was ended because the
+// proxy is shutting down.
+var ErrShutdown = errors.New("session ended by shutdown")
+
 var nonRetryableStatuses = map[int]bool{
 	400: true, 401: true, 403: true, 404: true, 429: true,
 }
@@ -20,7 +31,7 @@ var nonRetryableStatuses = map[int]bool{
 // BuildRetryRequestBody builds a new request body for retry with accumulated context
 func BuildRetryRequestBody(originalBody map[string]interface{}, accumulatedText string) map[string]interface{} {
 	logger.LogDebug(fmt.Sprintf("Building retry request body. Accumulated text length: %d", len(accumulatedText)))
-	logger.LogDebug(fmt.Sprintf("Accumulated text preview: %s", func() string {
+	logger.LogContent(fmt.Sprintf("Accumulated text preview: %s", func() string {
 		if len(accumulatedText) > 200 {
 			return accumulatedText[:200] + "..."
 		}
@@ -90,6 +101,7 @@ type Session struct {
 	originalRequestBody    map[string]interface{}
 	upstreamURL            string
 	originalHeaders        http.Header
+	headers                *HeaderPolicy
 	client                 *http.Client
 	accumulatedText        string
 	consecutiveRetryCount  int
@@ -97,6 +109,25 @@ type Session struct {
 	sessionStartTime       time.Time
 	isOutputtingFormalText bool
 	swallowModeActive      bool
+	circuitBreaker         *breaker.Breaker
+	fallback               *FallbackTracker
+	hedger                 *Hedger
+	tenant                 string
+	budget                 Budget
+	tokensUsed             int
+	firstTokenSent         bool
+	baseLog                *logger.Logger
+	log                    *logger.Logger
+	ctx                    context.Context
+	attemptSpan            *tracing.Span
+	transcript             *recorder.Transcript
+	doneFilter             DoneTokenFilter
+	shutdown               <-chan struct{}
+	cancelled              chan struct{}
+	cancelOnce             sync.Once
+	statusMu               sync.Mutex
+	status                 SessionStatus
+	lastInterruption       string
 }
 
 // NewSession creates a new streaming session.
@@ -108,31 +139,334 @@ func NewSession(cfg *config.Config, initialReader io.Reader, writer io.Writer, o
 		originalRequestBody: originalRequestBody,
 		upstreamURL:         upstreamURL,
 		originalHeaders:     originalHeaders,
+		headers:             NewHeaderPolicy(cfg),
 		client:              client,
 		sessionStartTime:    time.Now(),
+		baseLog:             logger.Default(),
+		log:                 logger.Default(),
+		ctx:                 context.Background(),
+		cancelled:           make(chan struct{}),
+	}
+}
+
+// SetContext sets the request context. Attempt, retry and backoff spans are
+// created as children of the span it carries, and retry requests are
+// cancelled with it.
+func (s *Session) SetContext(ctx context.Context) {
+	s.ctx = ctx
+}
+
+// SetTranscript attaches a transcript that records every attempt's raw
+// lines, retry bodies and interruption reasons.
+func (s *Session) SetTranscript(t *recorder.Transcript) {
+	s.transcript = t
+}
+
+// SetShutdown sets a channel that, once closed, makes the session stop at
+// the next line or retry and end the stream with an error event.
+func (s *Session) SetShutdown(ch <-chan struct{}) {
+	s.shutdown = ch
+}
+
+// endForShutdown tells the client the stream is over because the proxy is
+// shutting down.
+func (s *Session) endForShutdown() error {
+	s.log.Warn("Proxy is shutting down. Ending stream before completion.")
+	s.flushDoneFilter()
+	s.writeErrorEvent(503, "UNAVAILABLE", "The proxy is shutting down; the stream ended before completion. Please retry the request.")
+	s.finish("shutdown")
+	return ErrShutdown
+}
+
+// backoff waits the configured retry delay inside a trace span. It returns
+// early if the session is cancelled, its client goes away or the proxy
+// starts shutting down.
+func (s *Session) backoff() {
+	_, span := tracing.Start(s.ctx, "session.backoff", tracing.SpanKindInternal,
+		"retry.number", s.consecutiveRetryCount,
+		"backoff.ms", s.cfg.RetryDelayMs.Milliseconds())
+	timer := time.NewTimer(s.cfg.RetryDelayMs)
+	select {
+	case <-timer.C:
+	case <-s.cancelled:
+		timer.Stop()
+	case <-s.shutdown:
+		timer.Stop()
+	case <-s.ctx.Done():
+		timer.Stop()
+	}
+	span.End()
+}
+
+// SetLogger sets the request-scoped logger. Each attempt logs through it
+// with the attempt number attached.
+func (s *Session) SetLogger(l *logger.Logger) {
+	s.baseLog = l
+	s.log = l
+}
+
+// SetStartTime sets the time the client request started, so that
+// time-to-first-token and session duration include the initial upstream call.
+func (s *Session) SetStartTime(t time.Time) {
+	s.sessionStartTime = t
+}
+
+// finish records the session outcome metrics. A session that stops in the
+// middle of an attempt also ends that attempt's span.
+func (s *Session) finish(outcome string) {
+	s.publishStatus(StateFinished)
+	s.transcript.Finish(outcome)
+	if s.attemptSpan != nil {
+		s.attemptSpan.SetAttributes("session.outcome", outcome)
+		s.attemptSpan.End()
+		s.attemptSpan = nil
+	}
+	metrics.StreamSessions.Inc(outcome)
+	metrics.SessionRetries.Observe(float64(s.consecutiveRetryCount))
+	metrics.SessionDuration.Observe(time.Since(s.sessionStartTime).Seconds())
+	if s.budget != nil {
+		s.budget.ChargeTokens(s.tokensUsed)
+	}
+}
+
+// SetCircuitBreaker attaches the upstream circuit breaker. Every stream
+// attempt and retry call is recorded against it, and retries stop as soon
+// as it opens.
+func (s *Session) SetCircuitBreaker(b *breaker.Breaker) {
+	s.circuitBreaker = b
+}
+
+// SetFallbackPolicy enables model fallback for this session. The chain
+// starts at the model named in the upstream URL.
+func (s *Session) SetFallbackPolicy(p *FallbackPolicy) {
+	if p == nil {
+		return
+	}
+	if model := ModelFromURL(s.upstreamURL); model != "" {
+		s.fallback = NewFallbackTracker(p, model)
+	}
+}
+
+// switchModel points subsequent retries at the next model and tells the
+// client about it with an SSE comment, which compliant clients ignore.
+func (s *Session) switchModel(next, reason string) {
+	previous := ModelFromURL(s.upstreamURL)
+	s.upstreamURL = ReplaceModelInURL(s.upstreamURL, next)
+	s.log.Info(fmt.Sprintf("Falling back from model %s to %s after repeated %s interruptions", previous, next, reason))
+
+	comment := fmt.Sprintf(": model-fallback from=%s to=%s reason=%s\n\n", previous, next, reason)
+	s.writer.Write([]byte(comment))
+	if flusher, ok := s.writer.(http.Flusher); ok {
+		flusher.Flush()
 	}
 }
 
+// SetHedger enables hedged retry attempts, charged to the given tenant's
+// hedge budget.
+func (s *Session) SetHedger(h *Hedger, tenant string) {
+	s.hedger = h
+	s.tenant = tenant
+}
+
+// Budget is charged for the upstream calls a session makes beyond the
+// initial request.
+type Budget interface {
+	// ChargeRetry is called before each retry request.
+	ChargeRetry()
+	// ChargeTokens is called once when the session finishes, with the
+	// tokens reported in usageMetadata summed over all attempts.
+	ChargeTokens(tokens int)
+}
+
+// SetBudget makes retries and token usage count against b.
+func (s *Session) SetBudget(b Budget) {
+	s.budget = b
+}
+
+// SetHeaderPolicy sets the policy retry requests take their headers from,
+// so that they match the initial request. By default it is built from the
+// session's configuration.
+func (s *Session) SetHeaderPolicy(p *HeaderPolicy) {
+	s.headers = p
+}
+
+// TokensUsed returns the tokens reported in usageMetadata so far, summed
+// over all attempts.
+func (s *Session) TokensUsed() int {
+	return s.tokensUsed
+}
+
+// newRetryRequest builds a retry request carrying the client headers the
+// header policy forwards.
+func (s *Session) newRetryRequest(ctx context.Context, body []byte) (*http.Request, error) {
+	retryReq, err := http.NewRequestWithContext(ctx, "POST", s.upstreamURL, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	retryReq.Header = s.headers.UpstreamHeaders(s.originalHeaders)
+	return retryReq, nil
+}
+
+// sendRetry sends one retry attempt, hedged if a hedger is configured.
+func (s *Session) sendRetry(body []byte) (*http.Response, error) {
+	ctx, span := tracing.Start(s.ctx, "upstream.retry", tracing.SpanKindClient,
+		"retry.number", s.consecutiveRetryCount,
+		"gemini.model", ModelFromURL(s.upstreamURL))
+	defer span.End()
+	s.transcript.StartAttempt(s.upstreamURL, body)
+
+	newRequest := func(reqCtx context.Context) (*http.Request, error) {
+		req, err := s.newRetryRequest(reqCtx, body)
+		if err == nil {
+			tracing.Inject(ctx, req.Header)
+		}
+		return req, err
+	}
+
+	var resp *http.Response
+	var err error
+	if s.hedger != nil {
+		resp, err = s.hedger.Do(ctx, s.log, s.client, s.tenant, newRequest)
+	} else {
+		reqCtx, cancel := context.WithCancel(ctx)
+		var retryReq *http.Request
+		if retryReq, err = newRequest(reqCtx); err != nil {
+			cancel()
+			return nil, err
+		}
+		if resp, err = s.client.Do(retryReq); err != nil {
+			cancel()
+		} else {
+			resp.Body = CancelOnClose(resp.Body, cancel)
+		}
+	}
+	if err != nil {
+		span.SetError(err)
+		s.transcript.SetResponse(0, err)
+		return nil, err
+	}
+	span.SetAttributes("http.status_code", resp.StatusCode)
+	s.transcript.SetResponse(resp.StatusCode, nil)
+	return resp, nil
+}
+
+// writeErrorEvent sends a terminal SSE error event to the client.
+func (s *Session) writeErrorEvent(code int, status, message string) {
+	errorPayload := map[string]interface{}{
+		"error": map[string]interface{}{
+			"code":    code,
+			"status":  status,
+			"message": message,
+			"details": []interface{}{
+				map[string]interface{}{
+					"@type":                  "proxy.debug",
+					"accumulated_text_chars": len(s.accumulatedText),
+				},
+			},
+		},
+	}
+	errorBytes, _ := json.Marshal(errorPayload)
+	s.writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
+	if flusher, ok := s.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// filterDoneToken strips the [done] sentinel from formal text. A trailing
+// piece of text that may be the start of the sentinel is held back until
+// the next chunk. If held-back text has to be released on a line without a
+// text part, it is written as a chunk of its own first.
+func (s *Session) filterDoneToken(line, text string, isThought, final bool) (string, error) {
+	if isThought || !IsDataLine(line) {
+		return line, nil
+	}
+
+	filtered := s.doneFilter.Filter(text, final)
+	if filtered == text {
+		return line, nil
+	}
+	if replaced, ok := ReplaceLineText(line, filtered); ok {
+		return replaced, nil
+	}
+	return line, s.writeLine(TextLine(filtered))
+}
+
+// flushDoneFilter releases text held back by the [done] filter before the
+// session ends without a final chunk.
+func (s *Session) flushDoneFilter() {
+	if pending := s.doneFilter.Flush(); pending != "" {
+		s.writeLine(TextLine(pending))
+	}
+}
+
+func (s *Session) writeLine(line string) error {
+	if _, err := s.writer.Write([]byte(line + "\n\n")); err != nil {
+		return err
+	}
+	if flusher, ok := s.writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return nil
+}
+
 // Process handles the entire lifecycle of a streaming request, including retries.
 func (s *Session) Process() error {
 	currentReader := s.initialReader
-	logger.LogInfo(fmt.Sprintf("Starting stream processing session. Max retries: %d", s.cfg.MaxConsecutiveRetries))
+	// retryStream is the body of the latest retry response. Each one is
+	// closed before the next retry is sent.
+	var retryStream io.Closer
+	defer func() {
+		if retryStream != nil {
+			retryStream.Close()
+		}
+	}()
+	s.log.Info(fmt.Sprintf("Starting stream processing session. Max retries: %d", s.cfg.MaxConsecutiveRetries))
 
 	for {
+		s.log = s.baseLog.With("attempt", s.consecutiveRetryCount+1)
+		_, s.attemptSpan = tracing.Start(s.ctx, "session.attempt", tracing.SpanKindInternal,
+			"retry.number", s.consecutiveRetryCount)
 		interruptionReason := ""
 		cleanExit := false
 		streamStartTime := time.Now()
 		linesInThisStream := 0
 		textInThisStream := ""
+		tokensInThisStream := 0
 
-		logger.LogDebug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", s.consecutiveRetryCount+1, s.cfg.MaxConsecutiveRetries+1))
+		s.log.Debug(fmt.Sprintf("=== Starting stream attempt %d/%d ===", s.consecutiveRetryCount+1, s.cfg.MaxConsecutiveRetries+1))
 
 		lineCh := make(chan string, 100)
 		go SSELineIterator(currentReader, lineCh)
 
-		for line := range lineCh {
+		for {
+			// Publish before waiting so a stalled stream reports everything
+			// it has processed.
+			s.publishStatus(StateStreaming)
+			var line string
+			var ok bool
+			select {
+			case line, ok = <-lineCh:
+			case <-s.cancelled:
+				s.transcript.EndAttempt("CANCELLED")
+				return s.endForCancel()
+			case <-s.shutdown:
+				s.transcript.EndAttempt("SHUTDOWN")
+				return s.endForShutdown()
+			case <-s.ctx.Done():
+				s.transcript.EndAttempt("CLIENT_GONE")
+				return s.endForClientGone()
+			}
+			if !ok {
+				break
+			}
+
+			s.transcript.AddLine(line)
 			s.totalLinesProcessed++
 			linesInThisStream++
+			if tokens := ExtractTotalTokens(line); tokens > 0 {
+				s.tokensUsed += tokens - tokensInThisStream
+				tokensInThisStream = tokens
+			}
 
 			var textChunk string
 			var isThought bool
@@ -145,16 +479,18 @@ func (s *Session) Process() error {
 
 			if s.swallowModeActive {
 				if isThought {
-					logger.LogDebug("Swallowing thought chunk due to post-retry filter:", line)
+					s.log.Debug("Swallowing thought chunk due to post-retry filter")
+					s.log.Content("Swallowed thought chunk:", line)
+					metrics.SwallowedThoughts.Inc()
 					finishReason := ExtractFinishReason(line)
 					if finishReason != "" {
-						logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
+						s.log.Error(fmt.Sprintf("Stream stopped with reason '%s' while swallowing a 'thought' chunk. Triggering retry.", finishReason))
 						interruptionReason = "FINISH_DURING_THOUGHT"
 						break
 					}
 					continue
 				} else {
-					logger.LogInfo("First formal text chunk received after swallowing. Resuming normal stream.")
+					s.log.Info("First formal text chunk received after swallowing. Resuming normal stream.")
 					s.swallowModeActive = false
 				}
 			}
@@ -163,23 +499,24 @@ func (s *Session) Process() error {
 			needsRetry := false
 
 			if finishReason != "" && isThought {
-				logger.LogError(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
+				s.log.Error(fmt.Sprintf("Stream stopped with reason '%s' on a 'thought' chunk. This is an invalid state. Triggering retry.", finishReason))
 				interruptionReason = "FINISH_DURING_THOUGHT"
 				needsRetry = true
 			} else if IsBlockedLine(line) {
-				logger.LogError(fmt.Sprintf("Content blocked detected in line: %s", line))
+				s.log.Error("Content blocked detected in stream")
+				s.log.Content(fmt.Sprintf("Blocked line: %s", line))
 				interruptionReason = "BLOCK"
 				needsRetry = true
 			} else if finishReason == "STOP" {
 				tempAccumulatedText := s.accumulatedText + textChunk
 				trimmedText := strings.TrimSpace(tempAccumulatedText)
 				if len(trimmedText) == 0 {
-					logger.LogError("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
+					s.log.Error("Finish reason 'STOP' with no text content detected. This indicates an empty response. Triggering retry.")
 					interruptionReason = "FINISH_EMPTY_RESPONSE"
 					needsRetry = true
 				}
 			} else if finishReason != "" && finishReason != "MAX_TOKENS" && finishReason != "STOP" {
-				logger.LogError(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
+				s.log.Error(fmt.Sprintf("Abnormal finish reason: %s. Triggering retry.", finishReason))
 				interruptionReason = "FINISH_ABNORMAL"
 				needsRetry = true
 			}
@@ -189,9 +526,14 @@ func (s *Session) Process() error {
 			}
 
 			isEndOfResponse := finishReason == "STOP" || finishReason == "MAX_TOKENS"
-			processedLine := RemoveDoneTokenFromLine(line, isEndOfResponse)
+			processedLine, err := s.filterDoneToken(line, textChunk, isThought, isEndOfResponse)
+			if err != nil {
+				s.finish("cancelled")
+				return fmt.Errorf("failed to write to output stream: %w", err)
+			}
 
 			if _, err := s.writer.Write([]byte(processedLine + "\n\n")); err != nil {
+				s.finish("cancelled")
 				return fmt.Errorf("failed to write to output stream: %w", err)
 			}
 
@@ -200,6 +542,10 @@ func (s *Session) Process() error {
 			}
 
 			if textChunk != "" && !isThought {
+				if !s.firstTokenSent {
+					s.firstTokenSent = true
+					metrics.TimeToFirstToken.Observe(time.Since(s.sessionStartTime).Seconds())
+				}
 				s.isOutputtingFormalText = true
 				s.accumulatedText += textChunk
 				textInThisStream += textChunk
@@ -208,113 +554,161 @@ func (s *Session) Process() error {
 			if finishReason == "STOP" || finishReason == "MAX_TOKENS" {
 				doneLine := "data: {\"candidates\": [{\"content\": {\"parts\": [{\"text\": \"[done]\"}]}}]}"
 				if _, err := s.writer.Write([]byte(doneLine + "\n\n")); err != nil {
+					s.finish("cancelled")
 					return fmt.Errorf("failed to write [done] token: %w", err)
 				}
 				if flusher, ok := s.writer.(http.Flusher); ok {
 					flusher.Flush()
 				}
-				logger.LogInfo(fmt.Sprintf("Finish reason '%s' accepted as final. Manually injected [done] token. Stream complete.", finishReason))
+				s.log.Info(fmt.Sprintf("Finish reason '%s' accepted as final. Manually injected [done] token. Stream complete.", finishReason))
 				cleanExit = true
 				break
 			}
 		}
 
+		if !cleanExit && s.ctx.Err() != nil {
+			// The read failed because the client went away, not the upstream.
+			s.transcript.EndAttempt("CLIENT_GONE")
+			return s.endForClientGone()
+		}
 		if !cleanExit && interruptionReason == "" {
-			logger.LogError("Stream ended without finish reason - detected as DROP")
+			s.log.Error("Stream ended without finish reason - detected as DROP")
 			interruptionReason = "DROP"
 		}
 
+		if s.circuitBreaker != nil {
+			s.circuitBreaker.RecordStream(!cleanExit)
+		}
+		if !cleanExit {
+			metrics.StreamInterruptions.Inc(interruptionReason)
+			s.attemptSpan.SetAttributes("interruption.reason", interruptionReason)
+		}
+		s.attemptSpan.SetAttributes(
+			"chars.accumulated", len(s.accumulatedText),
+			"chars.attempt", len(textInThisStream),
+			"lines.attempt", linesInThisStream)
+		s.attemptSpan.End()
+		s.attemptSpan = nil
+		s.transcript.EndAttempt(interruptionReason)
+
 		streamDuration := time.Since(streamStartTime)
-		logger.LogDebug("Stream attempt summary:")
-		logger.LogDebug(fmt.Sprintf("  Duration: %v", streamDuration))
-		logger.LogDebug(fmt.Sprintf("  Lines processed: %d", linesInThisStream))
-		logger.LogDebug(fmt.Sprintf("  Text generated this stream: %d chars", len(textInThisStream)))
-		logger.LogDebug(fmt.Sprintf("  Total accumulated text: %d chars", len(s.accumulatedText)))
+		s.log.Debug("Stream attempt summary:")
+		s.log.Debug(fmt.Sprintf("  Duration: %v", streamDuration))
+		s.log.Debug(fmt.Sprintf("  Lines processed: %d", linesInThisStream))
+		s.log.Debug(fmt.Sprintf("  Text generated this stream: %d chars", len(textInThisStream)))
+		s.log.Debug(fmt.Sprintf("  Total accumulated text: %d chars", len(s.accumulatedText)))
 
 		if cleanExit {
 			sessionDuration := time.Since(s.sessionStartTime)
-			logger.LogInfo("=== STREAM COMPLETED SUCCESSFULLY ===")
-			logger.LogInfo(fmt.Sprintf("Total session duration: %v", sessionDuration))
-			logger.LogInfo(fmt.Sprintf("Total lines processed: %d", s.totalLinesProcessed))
-			logger.LogInfo(fmt.Sprintf("Total text generated: %d characters", len(s.accumulatedText)))
-			logger.LogInfo(fmt.Sprintf("Total retries needed: %d", s.consecutiveRetryCount))
+			s.log.Info("=== STREAM COMPLETED SUCCESSFULLY ===")
+			s.log.Info(fmt.Sprintf("Total session duration: %v", sessionDuration))
+			s.log.Info(fmt.Sprintf("Total lines processed: %d", s.totalLinesProcessed))
+			s.log.Info(fmt.Sprintf("Total text generated: %d characters", len(s.accumulatedText)))
+			s.log.Info(fmt.Sprintf("Total retries needed: %d", s.consecutiveRetryCount))
+			s.finish("clean")
 			return nil
 		}
 
-		logger.LogError("=== STREAM INTERRUPTED ===")
-		logger.LogError(fmt.Sprintf("Reason: %s", interruptionReason))
+		s.log.Error("=== STREAM INTERRUPTED ===")
+		s.log.Error(fmt.Sprintf("Reason: %s", interruptionReason))
 
 		if s.cfg.SwallowThoughtsAfterRetry && s.isOutputtingFormalText {
-			logger.LogInfo("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
+			s.log.Info("Retry triggered after formal text output. Will swallow subsequent thought chunks until formal text resumes.")
 			s.swallowModeActive = true
 		}
 
-		if s.consecutiveRetryCount >= s.cfg.MaxConsecutiveRetries {
-			errorPayload := map[string]interface{}{
-				"error": map[string]interface{}{
-					"code":    504,
-					"status":  "DEADLINE_EXCEEDED",
-					"message": fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", s.cfg.MaxConsecutiveRetries, interruptionReason),
-					"details": []interface{}{
-						map[string]interface{}{
-							"@type":                  "proxy.debug",
-							"accumulated_text_chars": len(s.accumulatedText),
-						},
-					},
-				},
+		s.lastInterruption = interruptionReason
+		// A failed retry backs off and sends the next one from here. It is
+		// not a stream attempt, so it is neither read nor counted as an
+		// interruption.
+		observed := false
+		for {
+			if s.consecutiveRetryCount >= s.cfg.MaxConsecutiveRetries {
+				s.flushDoneFilter()
+				s.writeErrorEvent(504, "DEADLINE_EXCEEDED", fmt.Sprintf("Retry limit (%d) exceeded after stream interruption. Last reason: %s.", s.cfg.MaxConsecutiveRetries, interruptionReason))
+				s.finish("retry_limit")
+				return fmt.Errorf("retry limit exceeded")
 			}
-			errorBytes, _ := json.Marshal(errorPayload)
-			s.writer.Write([]byte(fmt.Sprintf("event: error\ndata: %s\n\n", string(errorBytes))))
-			if flusher, ok := s.writer.(http.Flusher); ok {
-				flusher.Flush()
+
+			s.publishStatus(StateRetrying)
+			if err := s.stopRequested(); err != nil {
+				return err
 			}
-			return fmt.Errorf("retry limit exceeded")
-		}
 
-		s.consecutiveRetryCount++
-		logger.LogInfo(fmt.Sprintf("=== STARTING RETRY %d/%d ===", s.consecutiveRetryCount, s.cfg.MaxConsecutiveRetries))
+			if s.circuitBreaker != nil {
+				if err := s.circuitBreaker.Allow(); err != nil {
+					s.log.Error("Upstream circuit breaker is open. Abandoning retries.")
+					s.flushDoneFilter()
+					s.writeErrorEvent(503, "UNAVAILABLE", fmt.Sprintf("Upstream circuit breaker is open; retries abandoned after stream interruption. Last reason: %s.", interruptionReason))
+					s.finish("circuit_open")
+					return fmt.Errorf("circuit breaker open: %w", err)
+				}
+			}
 
-		retryBody := BuildRetryRequestBody(s.originalRequestBody, s.accumulatedText)
-		retryBodyBytes, err := json.Marshal(retryBody)
-		if err != nil {
-			logger.LogError("Failed to marshal retry body:", err)
-			time.Sleep(s.cfg.RetryDelayMs)
-			continue
-		}
+			// The interruption only counts towards a model switch once a
+			// retry is certain, so the client never hears of a switch that
+			// no attempt follows.
+			if !observed {
+				observed = true
+				if next, ok := s.fallback.Observe(interruptionReason); ok {
+					s.switchModel(next, interruptionReason)
+				}
+			}
 
-		retryReq, err := http.NewRequest("POST", s.upstreamURL, bytes.NewReader(retryBodyBytes))
-		if err != nil {
-			logger.LogError("Failed to create retry request:", err)
-			time.Sleep(s.cfg.RetryDelayMs)
-			continue
-		}
+			s.consecutiveRetryCount++
+			s.log = s.baseLog.With("attempt", s.consecutiveRetryCount+1)
+			s.log.Info(fmt.Sprintf("=== STARTING RETRY %d/%d ===", s.consecutiveRetryCount, s.cfg.MaxConsecutiveRetries))
+			if s.budget != nil {
+				s.budget.ChargeRetry()
+			}
 
-		for name, values := range s.originalHeaders {
-			if name == "Authorization" || name == "X-Goog-Api-Key" || name == "Content-Type" || name == "Accept" {
-				for _, value := range values {
-					retryReq.Header.Add(name, value)
+			retryBody := BuildRetryRequestBody(s.originalRequestBody, s.accumulatedText)
+			retryBodyBytes, err := json.Marshal(retryBody)
+			if err != nil {
+				s.log.Error("Failed to marshal retry body:", err)
+				s.backoff()
+				continue
+			}
+
+			if retryStream != nil {
+				retryStream.Close()
+				retryStream = nil
+			}
+			retryStart := time.Now()
+			retryResponse, err := s.sendRetry(retryBodyBytes)
+			metrics.UpstreamLatency.Observe(time.Since(retryStart).Seconds(), "retry")
+			if err != nil {
+				s.log.Error(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", s.consecutiveRetryCount))
+				s.log.Error("Exception during retry:", err)
+				if s.ctx.Err() != nil {
+					return s.endForClientGone()
+				}
+				if s.circuitBreaker != nil {
+					s.circuitBreaker.RecordFailure()
 				}
+				s.backoff()
+				continue
 			}
-		}
+			retryStream = retryResponse.Body
 
-		retryResponse, err := s.client.Do(retryReq)
-		if err != nil {
-			logger.LogError(fmt.Sprintf("=== RETRY ATTEMPT %d FAILED ===", s.consecutiveRetryCount))
-			logger.LogError("Exception during retry:", err)
-			time.Sleep(s.cfg.RetryDelayMs)
-			continue
-		}
-		defer retryResponse.Body.Close()
+			s.log.Info(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
 
-		logger.LogInfo(fmt.Sprintf("Retry request completed. Status: %d %s", retryResponse.StatusCode, retryResponse.Status))
+			if retryResponse.StatusCode != http.StatusOK {
+				s.log.Error(fmt.Sprintf("Retry attempt %d failed with status %d", s.consecutiveRetryCount, retryResponse.StatusCode))
+				if s.circuitBreaker != nil {
+					if breaker.IsFailureStatus(retryResponse.StatusCode) {
+						s.circuitBreaker.RecordFailure()
+					} else {
+						s.circuitBreaker.RecordSuccess()
+					}
+				}
+				s.backoff()
+				continue
+			}
 
-		if retryResponse.StatusCode != http.StatusOK {
-			logger.LogError(fmt.Sprintf("Retry attempt %d failed with status %d", s.consecutiveRetryCount, retryResponse.StatusCode))
-			time.Sleep(s.cfg.RetryDelayMs)
-			continue
+			s.log.Info(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", s.consecutiveRetryCount))
+			currentReader = retryResponse.Body
+			break
 		}
-
-		logger.LogInfo(fmt.Sprintf("✓ Retry attempt %d successful - got new stream", s.consecutiveRetryCount))
-		currentReader = retryResponse.Body
 	}
 }
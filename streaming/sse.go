@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"unicode"
 
 	"gemini-antiblock/logger"
 )
@@ -23,7 +24,7 @@ func SSELineIterator(reader io.Reader, ch chan<- string) {
 		line := scanner.Text()
 		if strings.TrimSpace(line) != "" {
 			lineCount++
-			logger.LogDebug(fmt.Sprintf("SSE Line %d: %s", lineCount,
+			logger.LogContent(fmt.Sprintf("SSE Line %d: %s", lineCount,
 				func() string {
 					if len(line) > 200 {
 						return line[:200] + "..."
@@ -80,6 +81,30 @@ func ExtractFinishReason(line string) string {
 	return ""
 }
 
+// ExtractTotalTokens returns the totalTokenCount from a data line's
+// usageMetadata, or 0 if it has none. Each chunk reports the running total
+// for its response.
+func ExtractTotalTokens(line string) int {
+	if !IsDataLine(line) || !strings.Contains(line, "usageMetadata") {
+		return 0
+	}
+	return ResponseTotalTokens([]byte(line[len("data: "):]))
+}
+
+// ResponseTotalTokens returns the totalTokenCount from a response's
+// usageMetadata, or 0 if it has none.
+func ResponseTotalTokens(body []byte) int {
+	var data struct {
+		UsageMetadata struct {
+			TotalTokenCount int `json:"totalTokenCount"`
+		} `json:"usageMetadata"`
+	}
+	if err := json.Unmarshal(body, &data); err != nil {
+		return 0
+	}
+	return data.UsageMetadata.TotalTokenCount
+}
+
 // LineContent represents parsed content from a data line
 type LineContent struct {
 	Text      string
@@ -134,7 +159,8 @@ func ParseLineContent(line string) LineContent {
 	if thought {
 		logger.LogDebug("Extracted thought chunk. This will be tracked.")
 	} else if text != "" {
-		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars): %s", len(text),
+		logger.LogDebug(fmt.Sprintf("Extracted text chunk (%d chars)", len(text)))
+		logger.LogContent(fmt.Sprintf("Text chunk content: %s",
 			func() string {
 				if len(text) > 100 {
 					return text[:100] + "..."
@@ -149,82 +175,125 @@ func ParseLineContent(line string) LineContent {
 	}
 }
 
-// RemoveDoneTokenFromLine removes [done] token from SSE data line if present
-func RemoveDoneTokenFromLine(line string, shouldRemove bool) string {
-	if !IsDataLine(line) || !shouldRemove {
-		return line
+// DoneToken is the sentinel the injected system prompt asks the model to
+// end its response with.
+const DoneToken = "[done]"
+
+// StripDoneToken removes a [done] sentinel, and any whitespace after it,
+// from the end of text. Everything before the sentinel is kept as is.
+func StripDoneToken(text string) string {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if strings.HasSuffix(trimmed, DoneToken) {
+		return strings.TrimSuffix(trimmed, DoneToken)
+	}
+	return text
+}
+
+// DoneTokenFilter removes the [done] sentinel from a stream of text chunks,
+// including when the model splits it across chunks ("[do", "ne]").
+type DoneTokenFilter struct {
+	pending string
+}
+
+// Filter returns the text to forward for one chunk. A trailing piece of text
+// that could still turn into the sentinel is held back until the next chunk
+// shows whether it does; the final chunk has the sentinel stripped.
+func (f *DoneTokenFilter) Filter(text string, final bool) string {
+	text = f.pending + text
+	f.pending = ""
+	if final {
+		return StripDoneToken(text)
+	}
+
+	held := doneTokenSuffixLen(text)
+	f.pending = text[len(text)-held:]
+	return text[:len(text)-held]
+}
+
+// Flush returns and clears any held-back text.
+func (f *DoneTokenFilter) Flush() string {
+	pending := f.pending
+	f.pending = ""
+	return pending
+}
+
+// doneTokenSuffixLen returns the length of the suffix of text that is either
+// a complete sentinel followed by whitespace or a proper prefix of it.
+func doneTokenSuffixLen(text string) int {
+	trimmed := strings.TrimRightFunc(text, unicode.IsSpace)
+	if strings.HasSuffix(trimmed, DoneToken) {
+		return len(text) - len(trimmed) + len(DoneToken)
+	}
+	for i := len(DoneToken) - 1; i > 0; i-- {
+		if strings.HasSuffix(text, DoneToken[:i]) {
+			return i
+		}
+	}
+	return 0
+}
+
+// ReplaceLineText returns the data line with the text of its first part
+// replaced. It reports false if the line has no text part to replace.
+func ReplaceLineText(line, text string) (string, bool) {
+	if !IsDataLine(line) {
+		return line, false
 	}
 
 	idx := strings.Index(line, "{")
 	if idx == -1 {
-		return line
+		return line, false
 	}
 
 	var data map[string]interface{}
 	if err := json.Unmarshal([]byte(line[idx:]), &data); err != nil {
-		logger.LogDebug("Failed to process line for [done] token removal:", err)
-		return line
+		logger.LogDebug("Failed to parse line for text replacement:", err)
+		return line, false
 	}
 
 	candidates, ok := data["candidates"].([]interface{})
 	if !ok || len(candidates) == 0 {
-		return line
+		return line, false
 	}
-
 	candidate, ok := candidates[0].(map[string]interface{})
 	if !ok {
-		return line
+		return line, false
 	}
-
 	content, ok := candidate["content"].(map[string]interface{})
 	if !ok {
-		return line
+		return line, false
 	}
-
 	parts, ok := content["parts"].([]interface{})
 	if !ok || len(parts) == 0 {
-		return line
+		return line, false
 	}
-
 	part, ok := parts[0].(map[string]interface{})
 	if !ok {
-		return line
-	}
-
-	text, hasText := part["text"].(string)
-	thought, _ := part["thought"].(bool)
-
-	if !hasText || thought {
-		return line
+		return line, false
 	}
-
-	// Remove the longest suffix of "[done]" from the text
-	// This handles cases where [done] is split across chunks
-	originalText := strings.TrimSpace(text)
-	modifiedText := originalText
-
-	// Try to remove each possible suffix of "[done]"
-	doneToken := "[done]"
-	for i := len(doneToken); i > 0; i-- {
-		suffix := doneToken[len(doneToken)-i:]
-		if strings.HasSuffix(originalText, suffix) {
-			modifiedText = strings.TrimSuffix(originalText, suffix)
-			logger.LogDebug(fmt.Sprintf("Removed [done] token suffix '%s' from text content. Original length: %d, Modified length: %d", suffix, len(originalText), len(modifiedText)))
-			break
-		}
+	if _, hasText := part["text"].(string); !hasText {
+		return line, false
 	}
 
-	if originalText != modifiedText {
-		part["text"] = modifiedText
-
-		modifiedData, err := json.Marshal(data)
-		if err != nil {
-			logger.LogDebug("Failed to marshal modified data:", err)
-			return line
-		}
-
-		return line[:idx] + string(modifiedData)
+	part["text"] = text
+	modifiedData, err := json.Marshal(data)
+	if err != nil {
+		logger.LogDebug("Failed to marshal modified data:", err)
+		return line, false
 	}
+	return line[:idx] + string(modifiedData), true
+}
 
-	return line
+// TextLine builds a data line carrying a single text part.
+func TextLine(text string) string {
+	data, _ := json.Marshal(map[string]interface{}{
+		"candidates": []interface{}{
+			map[string]interface{}{
+				"content": map[string]interface{}{
+					"parts": []interface{}{map[string]interface{}{"text": text}},
+					"role":  "model",
+				},
+			},
+		},
+	})
+	return "data: " + string(data)
 }
@@ -0,0 +1,215 @@
+package streaming
+
+import (
+	"bytes"
+	"flag"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"gemini-antiblock/config"
+	"gemini-antiblock/logger"
+)
+
+func TestMain(m *testing.M) {
+	flag.Parse()
+	if !testing.Verbose() {
+		logger.Configure(logger.Options{Level: "error", Output: io.Discard})
+	}
+	os.Exit(m.Run())
+}
+
+func TestStripDoneToken(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"Answer.[done]", "Answer."},
+		{"Answer.\n\n[done]", "Answer.\n\n"},
+		{"  indented[done]\n", "  indented"},
+		{"[done]", ""},
+		{"[done] \n", ""},
+		{"x[done][done]", "x[done]"},
+		{"arr[0]", "arr[0]"},
+		{"ends with ne]", "ends with ne]"},
+		{"[done] in the middle", "[done] in the middle"},
+		{"trailing space \n", "trailing space \n"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := StripDoneToken(tt.in); got != tt.want {
+			t.Errorf("StripDoneToken(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+// splitAt cuts text into chunks at the positions derived from cuts. Cuts
+// fall on rune boundaries, as upstream chunks are always valid UTF-8.
+func splitAt(text string, cuts []byte) []string {
+	positions := make([]int, 0, len(cuts))
+	for _, c := range cuts {
+		p := int(c) % (len(text) + 1)
+		for p > 0 && p < len(text) && !utf8.RuneStart(text[p]) {
+			p--
+		}
+		positions = append(positions, p)
+	}
+	sort.Ints(positions)
+
+	var chunks []string
+	last := 0
+	for _, p := range positions {
+		chunks = append(chunks, text[last:p])
+		last = p
+	}
+	return append(chunks, text[last:])
+}
+
+// filterChunks runs chunks through a DoneTokenFilter, the last one as final.
+func filterChunks(chunks []string) string {
+	var f DoneTokenFilter
+	var out strings.Builder
+	for i, chunk := range chunks {
+		out.WriteString(f.Filter(chunk, i == len(chunks)-1))
+	}
+	return out.String()
+}
+
+func TestDoneTokenFilterEverySplit(t *testing.T) {
+	contents := []string{"", "Hello.", "Answer:\n\n", "arr[0]", "[do", "x [done] y", "ends with e"}
+	for _, content := range contents {
+		text := content + DoneToken
+		for i := 0; i <= len(text); i++ {
+			for j := i; j <= len(text); j++ {
+				chunks := []string{text[:i], text[i:j], text[j:]}
+				if got := filterChunks(chunks); got != content {
+					t.Errorf("chunks %q: got %q, want %q", chunks, got, content)
+				}
+				plain := []string{content[:min(i, len(content))], content[min(i, len(content)):]}
+				if got := filterChunks(plain); got != content {
+					t.Errorf("chunks %q without sentinel: got %q, want %q", plain, got, content)
+				}
+			}
+		}
+	}
+}
+
+func TestDoneTokenFilterFlush(t *testing.T) {
+	var f DoneTokenFilter
+	if got := f.Filter("Partial [d", false); got != "Partial " {
+		t.Fatalf("Filter = %q, want %q", got, "Partial ")
+	}
+	if got := f.Flush(); got != "[d" {
+		t.Fatalf("Flush = %q, want %q", got, "[d")
+	}
+	if got := f.Flush(); got != "" {
+		t.Fatalf("second Flush = %q, want empty", got)
+	}
+}
+
+// FuzzDoneTokenFilter checks that, for any chunk split, reassembling the
+// filtered chunks gives the original text minus the sentinel.
+func FuzzDoneTokenFilter(f *testing.F) {
+	f.Add("Hello, world.", []byte{3, 9})
+	f.Add("Answer\n\n", []byte{8, 9, 10})
+	f.Add("arr[0]", []byte{5})
+	f.Add("[do", []byte{3, 4})
+	f.Add("", []byte{1, 2, 3, 4, 5})
+
+	f.Fuzz(func(t *testing.T, content string, cuts []byte) {
+		if got := filterChunks(splitAt(content+DoneToken, cuts)); got != content {
+			t.Errorf("with sentinel: got %q, want %q", got, content)
+		}
+		if StripDoneToken(content) == content {
+			if got := filterChunks(splitAt(content, cuts)); got != content {
+				t.Errorf("without sentinel: got %q, want %q", got, content)
+			}
+		}
+	})
+}
+
+// FuzzLineProcessing feeds arbitrary upstream lines to the line parsers.
+// None may panic, and stripping may only ever remove the sentinel.
+func FuzzLineProcessing(f *testing.F) {
+	f.Add(TextLine("Hello.[done]"))
+	f.Add(`data: {"candidates":[{"content":{"parts":[{"text":"x","thought":true}]},"finishReason":"STOP"}]}`)
+	f.Add(`data: {"candidates":[{"finishReason":7}]}`)
+	f.Add(`data: {"candidates":[null]}`)
+	f.Add(`data: {"candidates":[{"content":{"parts":[{"text":"unterminated`)
+	f.Add(`data: {"promptFeedback":{"blockReason":"SAFETY"}}`)
+	f.Add(`data: [1,2,3] {"finishReason"`)
+	f.Add(`: keep-alive`)
+
+	f.Fuzz(func(t *testing.T, line string) {
+		content := ParseLineContent(line)
+		ExtractFinishReason(line)
+		IsBlockedLine(line)
+
+		stripped := StripDoneToken(content.Text)
+		if content.IsThought || stripped == content.Text {
+			return
+		}
+		out, ok := ReplaceLineText(line, stripped)
+		if !ok {
+			return
+		}
+		if got, want := ParseLineContent(out).Text, stripped; got != want {
+			t.Fatalf("stripped text = %q, want %q (line %q)", got, want, line)
+		}
+	})
+}
+
+// FuzzSessionDoneToken streams content+"[done]", split into arbitrary
+// chunks, through a Session and checks the text the client receives.
+func FuzzSessionDoneToken(f *testing.F) {
+	f.Add("The answer is 42.", []byte{5, 20})
+	f.Add("List:\n- a\n- b\n", []byte{17, 18, 19})
+	f.Add("see [1]", []byte{6, 7, 8})
+
+	f.Fuzz(func(t *testing.T, content string, cuts []byte) {
+		// JSON encoding replaces invalid UTF-8, and the block heuristic
+		// matches on the raw line, so such inputs cannot round-trip.
+		if !utf8.ValidString(content) || strings.Contains(content, "blockReason") {
+			t.Skip()
+		}
+
+		chunks := splitAt(content+DoneToken, cuts)
+		var upstream strings.Builder
+		for i, chunk := range chunks {
+			line := TextLine(chunk)
+			if i == len(chunks)-1 {
+				line = `data: {"candidates":[{"content":{"parts":[{"text":` + jsonString(chunk) + `}],"role":"model"},"finishReason":"STOP"}]}`
+			}
+			upstream.WriteString(line + "\n\n")
+		}
+
+		var out bytes.Buffer
+		cfg := &config.Config{MaxConsecutiveRetries: 0}
+		session := NewSession(cfg, strings.NewReader(upstream.String()), &out, nil, "http://upstream.test", http.Header{}, http.DefaultClient)
+		if err := session.Process(); err != nil {
+			t.Fatalf("Process: %v", err)
+		}
+
+		lines := strings.Split(strings.TrimSuffix(out.String(), "\n\n"), "\n\n")
+		if lines[len(lines)-1] != `data: {"candidates": [{"content": {"parts": [{"text": "[done]"}]}}]}` {
+			t.Fatalf("missing injected [done] line: %q", out.String())
+		}
+		var received strings.Builder
+		for _, line := range lines[:len(lines)-1] {
+			received.WriteString(ParseLineContent(line).Text)
+		}
+		if received.String() != content {
+			t.Fatalf("client received %q, want %q", received.String(), content)
+		}
+	})
+}
+
+func jsonString(s string) string {
+	line := TextLine(s)
+	start := strings.Index(line, `"text":`) + len(`"text":`)
+	end := strings.LastIndex(line, `}],"role"`)
+	return line[start:end]
+}
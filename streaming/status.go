@@ -0,0 +1,96 @@
+package streaming
+
+import (
+	"errors"
+	"time"
+)
+
+// ErrCancelled is returned by Process when the session was cancelled
+// through Cancel.
+var ErrCancelled = errors.New("session cancelled")
+
+// Session states reported by Status.
+const (
+	StateStreaming = "streaming"
+	StateRetrying  = "retrying"
+	StateFinished  = "finished"
+)
+
+// SessionStatus is a point-in-time view of a running session.
+type SessionStatus struct {
+	State            string    `json:"state"`
+	Attempt          int       `json:"attempt"`
+	Model            string    `json:"model"`
+	AccumulatedChars int       `json:"accumulated_chars"`
+	LinesProcessed   int       `json:"lines_processed"`
+	SwallowMode      bool      `json:"swallow_mode"`
+	FirstTokenSent   bool      `json:"first_token_sent"`
+	LastInterruption string    `json:"last_interruption,omitempty"`
+	StartedAt        time.Time `json:"started_at"`
+}
+
+// Status returns the session's current state. It is safe to call from any
+// goroutine while Process runs.
+func (s *Session) Status() SessionStatus {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	return s.status
+}
+
+// publishStatus copies the session's progress into the snapshot returned by
+// Status. Only the goroutine running Process calls it.
+func (s *Session) publishStatus(state string) {
+	s.statusMu.Lock()
+	defer s.statusMu.Unlock()
+	s.status = SessionStatus{
+		State:            state,
+		Attempt:          s.consecutiveRetryCount + 1,
+		Model:            ModelFromURL(s.upstreamURL),
+		AccumulatedChars: len(s.accumulatedText),
+		LinesProcessed:   s.totalLinesProcessed,
+		SwallowMode:      s.swallowModeActive,
+		FirstTokenSent:   s.firstTokenSent,
+		LastInterruption: s.lastInterruption,
+		StartedAt:        s.sessionStartTime,
+	}
+}
+
+// Cancel makes the session stop at the next line or retry and end the
+// stream with an error event. It is safe to call from any goroutine and
+// more than once.
+func (s *Session) Cancel() {
+	s.cancelOnce.Do(func() { close(s.cancelled) })
+}
+
+// endForCancel tells the client the stream was cancelled by an operator.
+func (s *Session) endForCancel() error {
+	s.log.Warn("Session cancelled by an operator. Ending stream before completion.")
+	s.flushDoneFilter()
+	s.writeErrorEvent(499, "CANCELLED", "The stream was cancelled by the proxy operator before completion.")
+	s.finish("admin_cancelled")
+	return ErrCancelled
+}
+
+// endForClientGone stops a session whose client disconnected. Nothing is
+// written, since no one is left to read it.
+func (s *Session) endForClientGone() error {
+	s.log.Warn("Client disconnected. Ending stream before completion.")
+	s.finish("cancelled")
+	return s.ctx.Err()
+}
+
+// stopRequested ends the session if it was cancelled, its client went away
+// or the proxy is shutting down, returning the error Process should return.
+// It returns nil if the session should go on.
+func (s *Session) stopRequested() error {
+	select {
+	case <-s.cancelled:
+		return s.endForCancel()
+	case <-s.shutdown:
+		return s.endForShutdown()
+	case <-s.ctx.Done():
+		return s.endForClientGone()
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,277 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"gemini-antiblock/logger"
+)
+
+// ExporterOptions configures an OTLP/HTTP exporter.
+type ExporterOptions struct {
+	// Endpoint is the collector base URL, e.g. http://localhost:4318.
+	// Spans are posted to Endpoint + "/v1/traces" unless the endpoint
+	// already ends with that path.
+	Endpoint string
+	// ServiceName is reported as the service.name resource attribute.
+	ServiceName string
+	// BatchSize is the number of spans that triggers an immediate export.
+	BatchSize int
+	// FlushInterval is the longest a finished span waits before export.
+	FlushInterval time.Duration
+	// QueueSize bounds the number of buffered spans; extra spans are dropped.
+	QueueSize int
+	// Client is used to send export requests.
+	Client *http.Client
+}
+
+// Exporter batches finished spans and posts them to an OTLP/HTTP collector
+// using the JSON encoding of the OTLP protocol.
+type Exporter struct {
+	opts   ExporterOptions
+	url    string
+	queue  chan *Span
+	flush  chan chan struct{}
+	done   chan struct{}
+	closed sync.Once
+}
+
+// NewExporter creates an exporter and starts its background loop.
+func NewExporter(opts ExporterOptions) *Exporter {
+	if opts.BatchSize <= 0 {
+		opts.BatchSize = 256
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = 5 * time.Second
+	}
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 2048
+	}
+	if opts.Client == nil {
+		opts.Client = &http.Client{Timeout: 10 * time.Second}
+	}
+	if opts.ServiceName == "" {
+		opts.ServiceName = "gemini-antiblock-proxy"
+	}
+
+	url := strings.TrimRight(opts.Endpoint, "/")
+	if !strings.HasSuffix(url, "/v1/traces") {
+		url += "/v1/traces"
+	}
+
+	e := &Exporter{
+		opts:  opts,
+		url:   url,
+		queue: make(chan *Span, opts.QueueSize),
+		flush: make(chan chan struct{}),
+		done:  make(chan struct{}),
+	}
+	go e.loop()
+	return e
+}
+
+func (e *Exporter) enqueue(span *Span) {
+	select {
+	case e.queue <- span:
+	default:
+		logger.LogDebug("Trace export queue full, dropping span:", span.name)
+	}
+}
+
+// Flush exports all queued spans and waits for the export to finish.
+func (e *Exporter) Flush(ctx context.Context) {
+	ack := make(chan struct{})
+	select {
+	case e.flush <- ack:
+	case <-e.done:
+		return
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case <-ack:
+	case <-ctx.Done():
+	}
+}
+
+// Shutdown flushes pending spans and stops the exporter.
+func (e *Exporter) Shutdown(ctx context.Context) {
+	e.Flush(ctx)
+	e.closed.Do(func() { close(e.done) })
+}
+
+func (e *Exporter) loop() {
+	ticker := time.NewTicker(e.opts.FlushInterval)
+	defer ticker.Stop()
+
+	var batch []*Span
+	for {
+		select {
+		case span := <-e.queue:
+			batch = append(batch, span)
+			if len(batch) >= e.opts.BatchSize {
+				e.export(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = nil
+			}
+		case ack := <-e.flush:
+			for drained := false; !drained; {
+				select {
+				case span := <-e.queue:
+					batch = append(batch, span)
+				default:
+					drained = true
+				}
+			}
+			if len(batch) > 0 {
+				e.export(batch)
+				batch = nil
+			}
+			close(ack)
+		case <-e.done:
+			return
+		}
+	}
+}
+
+func (e *Exporter) export(batch []*Span) {
+	body, err := json.Marshal(e.encode(batch))
+	if err != nil {
+		logger.LogError("Failed to encode trace batch:", err)
+		return
+	}
+
+	resp, err := e.opts.Client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		logger.LogError("Failed to export traces:", err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		logger.LogError(fmt.Sprintf("Trace collector rejected export with status %d", resp.StatusCode))
+	}
+}
+
+// The types below are the subset of the OTLP JSON schema the exporter emits.
+
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+}
+
+func (e *Exporter) encode(batch []*Span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		span := otlpSpan{
+			TraceID:           s.context.TraceID.String(),
+			SpanID:            s.context.SpanID.String(),
+			Name:              s.name,
+			Kind:              int(s.kind),
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+		}
+		if s.parentID.IsValid() {
+			span.ParentSpanID = s.parentID.String()
+		}
+		for _, a := range s.attrs {
+			span.Attributes = append(span.Attributes, encodeAttribute(a))
+		}
+		if s.hasError {
+			span.Status = otlpStatus{Code: 2, Message: s.errorMsg}
+		}
+		s.mu.Unlock()
+		spans = append(spans, span)
+	}
+
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpAttribute{encodeAttribute(Attribute{Key: "service.name", Value: e.opts.ServiceName})},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "gemini-antiblock"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
+
+func encodeAttribute(a Attribute) otlpAttribute {
+	var v otlpValue
+	switch value := a.Value.(type) {
+	case string:
+		v.StringValue = &value
+	case bool:
+		v.BoolValue = &value
+	case int:
+		s := strconv.Itoa(value)
+		v.IntValue = &s
+	case int64:
+		s := strconv.FormatInt(value, 10)
+		v.IntValue = &s
+	case float64:
+		v.DoubleValue = &value
+	default:
+		s := fmt.Sprint(value)
+		v.StringValue = &s
+	}
+	return otlpAttribute{Key: a.Key, Value: v}
+}
@@ -0,0 +1,173 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+// collectorStub records OTLP/HTTP JSON export requests.
+type collectorStub struct {
+	mu       sync.Mutex
+	requests []otlpRequest
+}
+
+func (c *collectorStub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+		http.Error(w, "unexpected export request", http.StatusBadRequest)
+		return
+	}
+	body, _ := io.ReadAll(r.Body)
+	var req otlpRequest
+	if err := json.Unmarshal(body, &req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.mu.Lock()
+	c.requests = append(c.requests, req)
+	c.mu.Unlock()
+	w.WriteHeader(http.StatusOK)
+}
+
+func (c *collectorStub) spans() []otlpSpan {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var spans []otlpSpan
+	for _, req := range c.requests {
+		for _, rs := range req.ResourceSpans {
+			for _, ss := range rs.ScopeSpans {
+				spans = append(spans, ss.Spans...)
+			}
+		}
+	}
+	return spans
+}
+
+func TestExportToCollector(t *testing.T) {
+	collector := &collectorStub{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	exporter := NewExporter(ExporterOptions{Endpoint: server.URL, FlushInterval: time.Hour})
+	SetTracer(NewTracer(exporter))
+	defer SetTracer(nil)
+
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	ctx := Extract(context.Background(), incoming)
+
+	ctx, root := Start(ctx, "proxy.request", SpanKindServer, "request_id", "abc")
+	_, child := Start(ctx, "session.attempt", SpanKindInternal, "retry.number", 2, "interruption.reason", "DROP")
+	child.End()
+	root.End()
+
+	exporter.Shutdown(context.Background())
+
+	spans := collector.spans()
+	if len(spans) != 2 {
+		t.Fatalf("expected 2 exported spans, got %d", len(spans))
+	}
+	byName := map[string]otlpSpan{}
+	for _, s := range spans {
+		byName[s.Name] = s
+	}
+
+	rootSpan := byName["proxy.request"]
+	if rootSpan.TraceID != "0af7651916cd43dd8448eb211c80319c" || rootSpan.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("root span did not join incoming trace: %+v", rootSpan)
+	}
+	attempt := byName["session.attempt"]
+	if attempt.ParentSpanID != rootSpan.SpanID || attempt.TraceID != rootSpan.TraceID {
+		t.Errorf("attempt span is not a child of the root span: %+v", attempt)
+	}
+	found := false
+	for _, a := range attempt.Attributes {
+		if a.Key == "retry.number" && a.Value.IntValue != nil && *a.Value.IntValue == "2" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("retry.number attribute missing from %+v", attempt.Attributes)
+	}
+}
+
+func TestInjectPropagatesCurrentSpan(t *testing.T) {
+	exporter := NewExporter(ExporterOptions{Endpoint: "http://127.0.0.1:0", FlushInterval: time.Hour})
+	SetTracer(NewTracer(exporter))
+	defer SetTracer(nil)
+
+	ctx, span := Start(context.Background(), "upstream.initial", SpanKindClient)
+	header := http.Header{}
+	Inject(ctx, header)
+
+	sc, ok := ParseTraceparent(header.Get("traceparent"))
+	if !ok {
+		t.Fatalf("invalid traceparent %q", header.Get("traceparent"))
+	}
+	if sc.TraceID != span.SpanContext().TraceID || sc.SpanID != span.SpanContext().SpanID {
+		t.Errorf("traceparent %q does not match span", header.Get("traceparent"))
+	}
+}
+
+func TestUnsampledParent(t *testing.T) {
+	collector := &collectorStub{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+
+	exporter := NewExporter(ExporterOptions{Endpoint: server.URL, FlushInterval: time.Hour})
+	SetTracer(NewTracer(exporter))
+	defer SetTracer(nil)
+
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00")
+	ctx, root := Start(Extract(context.Background(), incoming), "proxy.request", SpanKindServer)
+	ctx, child := Start(ctx, "upstream.initial", SpanKindClient)
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	child.End()
+	root.End()
+	exporter.Shutdown(context.Background())
+
+	sc, ok := ParseTraceparent(outgoing.Get("traceparent"))
+	if !ok || sc.Sampled || sc.TraceID.String() != "0af7651916cd43dd8448eb211c80319c" {
+		t.Errorf("traceparent = %q, want the incoming trace, not sampled", outgoing.Get("traceparent"))
+	}
+	if spans := collector.spans(); len(spans) != 0 {
+		t.Errorf("exported %d spans of an unsampled trace", len(spans))
+	}
+}
+
+func TestInjectPassesThroughWhenDisabled(t *testing.T) {
+	SetTracer(nil)
+	incoming := http.Header{}
+	incoming.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+
+	ctx, span := Start(Extract(context.Background(), incoming), "proxy.request", SpanKindServer)
+	if span != nil {
+		t.Fatal("expected no span while tracing is disabled")
+	}
+	outgoing := http.Header{}
+	Inject(ctx, outgoing)
+	if got := outgoing.Get("traceparent"); got != incoming.Get("traceparent") {
+		t.Errorf("traceparent not propagated: %q", got)
+	}
+}
+
+func TestParseTraceparentRejectsInvalid(t *testing.T) {
+	for _, value := range []string{
+		"",
+		"00-00000000000000000000000000000000-b7ad6b7169203331-01",
+		"00-0af7651916cd43dd8448eb211c80319c-0000000000000000-01",
+		"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01",
+		"00-xyz-b7ad6b7169203331-01",
+	} {
+		if _, ok := ParseTraceparent(value); ok {
+			t.Errorf("ParseTraceparent(%q) accepted an invalid header", value)
+		}
+	}
+}
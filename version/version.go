@@ -0,0 +1,15 @@
+// Package version holds build information, set at link time:
+//
+//	go build -ldflags "-X gemini-antiblock/version.Version=v1.2.3 \
+//	  -X gemini-antiblock/version.Commit=$(git rev-parse --short HEAD) \
+//	  -X gemini-antiblock/version.BuildTime=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+package version
+
+var (
+	// Version is the release version, or "dev" for local builds.
+	Version = "dev"
+	// Commit is the git commit the binary was built from.
+	Commit = "unknown"
+	// BuildTime is when the binary was built, in RFC 3339 format.
+	BuildTime = "unknown"
+)